@@ -19,11 +19,101 @@ const (
 	ModelA400 = "A400"
 	ModelJ1   = "Snapmaker J1"
 
+	PatternRectilinear    = "rectilinear"
+	PatternAlignedRect    = "alignedrectilinear"
+	PatternGrid           = "grid"
+	PatternTriangles      = "triangles"
+	PatternStars          = "stars"
+	PatternCubic          = "cubic"
+	PatternLine           = "line"
+	PatternConcentric     = "concentric"
+	PatternHoneycomb      = "honeycomb"
+	PatternHoneycomb3D    = "3dhoneycomb"
+	PatternGyroid         = "gyroid"
+	PatternHilbert        = "hilbertcurve"
+	PatternArchimedean    = "archimedeanchords"
+	PatternOctagramSpiral = "octagramspiral"
+	PatternAdaptiveCubic  = "adaptivecubic"
+	PatternSupportCubic   = "supportcubic"
+	PatternLightning      = "lightning"
+	PatternZigZag         = "zigzag"
+	PatternMonotonic      = "monotonic"
+	PatternMonotonicLine  = "monotonicline"
+	PatternDefault        = "default"
+
+	SpeedPerimeter         = "perimeter"
+	SpeedExternalPerimeter = "external_perimeter"
+	SpeedSparseInfill      = "sparse_infill"
+	SpeedSolidInfill       = "solid_infill" // internal solid infill
+	SpeedTopSolidInfill    = "top_solid_infill"
+	SpeedBridge            = "bridge"
+	SpeedSupport           = "support"
+	SpeedFirstLayer        = "first_layer"
+	SpeedTravel            = "travel"
+	SpeedGapFill           = "gap_fill"
+
+	// the touchscreen takes about 7% longer than the slicer estimates
+	EstimatedTimeFactor = 1.07
+
+	// mm, when the slicer reports none
+	DefaultFilamentDiameter = 1.75
+
+	// PLA, the density of FilamentUsedWeight when the slicer reports none and
+	// the material is not in materialDensities
+	DefaultFilamentDensity = 1.24
+
 	absMinInt64 = 1 << 63
 	maxInt64    = 1<<63 - 1
 	maxUint64   = 1<<64 - 1
 )
 
+// indexes of slicerParams.Accelerations
+const (
+	AccelerationDefault = iota
+	AccelerationOuterWall
+	AccelerationInnerWall
+)
+
 var (
-	reThumb = regexp.MustCompile(`(?m)(?:^; thumbnail begin \d+[x ]\d+ \d+)(?:\n|\r\n?)((?:.+(?:\n|\r\n?))+?)(?:^; thumbnail end)`)
+	reThumb = regexp.MustCompile(`(?m)(?:^; thumbnail(_JPG)? begin (\d+)[x ](\d+) \d+)(?:\n|\r\n?)((?:.+(?:\n|\r\n?))+?)(?:^; thumbnail(?:_JPG)? end)`)
 )
+
+// thumbnailTypes are the mime types by the suffix of "; thumbnail begin"
+var thumbnailTypes = map[string]string{
+	"":     "image/png",
+	"_JPG": "image/jpeg",
+}
+
+// thumbnailExts are the file extensions by the mime type of a thumbnail
+var thumbnailExts = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+}
+
+// materialDensities are the typical g/cm3 of FilamentTypes
+var materialDensities = map[string]float64{
+	"PLA":  1.24,
+	"PETG": 1.27,
+	"ABS":  1.04,
+	"TPU":  1.21,
+	"ASA":  1.07,
+	"PC":   1.20,
+	"PA":   1.14,
+}
+
+// materialAliases are the names slicers and vendors use for a material of
+// materialDensities, a word of the filament type may be one of them too, e.g.
+// "PLA+" or the "PA6" of "PA6-CF"
+var materialAliases = map[string]string{
+	"PLA+":  "PLA",
+	"PET":   "PETG",
+	"PCTG":  "PETG",
+	"ABS+":  "ABS",
+	"TPE":   "TPU",
+	"FLEX":  "TPU",
+	"NYLON": "PA",
+	"PA6":   "PA",
+	"PA11":  "PA",
+	"PA12":  "PA",
+	"PAHT":  "PA",
+}
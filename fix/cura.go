@@ -0,0 +1,156 @@
+package fix
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// curaSetting is the prefix of the lines Cura appends with its settings, the
+// lines are a JSON object of INI texts split in chunks:
+// {"global_quality": "[values]\nlayer_height = 0.2\n", "extruder_quality": ["..."]}
+const curaSetting = ";SETTING_3 "
+
+// curaKeys maps the settings of Cura to the ones of parseParams, the first
+// one of a key wins
+var curaKeys = []struct {
+	cura, key   string
+	perExtruder bool
+}{
+	{"layer_height", "layer_height", false},
+	{"machine_nozzle_size", "nozzle_diameter", true},
+	{"material_diameter", "filament_diameter", true},
+	{"material_print_temperature_layer_0", "first_layer_temperature", true},
+	{"material_print_temperature", "first_layer_temperature", true},
+	{"material_bed_temperature_layer_0", "first_layer_bed_temperature", true},
+	{"material_bed_temperature", "bed_temperature", true},
+	{"retraction_amount", "retract_length", true},
+	{"retraction_retract_speed", "retract_speed", true},
+	{"retraction_prime_speed", "deretract_speed", true},
+	{"speed_print", "max_print_speed", false},
+	{"speed_wall_0", "external_perimeter_speed", false},
+	{"speed_wall_x", "perimeter_speed", false},
+	{"speed_infill", "infill_speed", false},
+	{"speed_travel", "travel_speed", false},
+	{"speed_layer_0", "first_layer_speed", false},
+	{"line_width", "extrusion_width", false},
+	{"wall_line_count", "perimeters", false},
+	{"infill_pattern", "fill_pattern", false},
+	{"skirt_line_count", "skirts", false},
+	{"brim_width", "brim_width", false},
+	{"adhesion_type", "brim_type", false},
+	{"support_enable", "support_material", false},
+	{"material_flow", "material_flow", true},
+	{"acceleration_print", "default_acceleration", false},
+	{"acceleration_wall_0", "outer_wall_acceleration", false},
+	{"acceleration_wall_x", "inner_wall_acceleration", false},
+	{"acceleration_travel", "travel_acceleration", false},
+	{"jerk_print", "machine_max_jerk_x", false},
+	{"jerk_print", "machine_max_jerk_y", false},
+}
+
+// curaSettings decodes the settings block at the end of a Cura file into
+// "; key = value" lines of parseParams, nil if there is none. A truncated
+// block keeps the settings before the cut.
+func curaSettings(gcodes []*GcodeBlock) []*GcodeBlock {
+	var chunks []string
+	for i := len(gcodes) - 1; i >= 0; i-- {
+		chunk, ok := strings.CutPrefix(gcodes[i].String(), curaSetting)
+		if !ok {
+			break
+		}
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	var blob strings.Builder
+	for i := len(chunks) - 1; i >= 0; i-- {
+		blob.WriteString(chunks[i])
+	}
+
+	// walk the tokens, a truncated blob stops at the cut
+	var (
+		global    map[string]string
+		extruders []map[string]string
+		key       string
+		dec       = json.NewDecoder(strings.NewReader(blob.String()))
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		if tok == json.Delim(']') {
+			key = ""
+		}
+		s, ok := tok.(string)
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "" && (s == "global_quality" || s == "extruder_quality"):
+			key = s
+		case key == "global_quality":
+			global, key = parseCuraValues(s), ""
+		case key == "extruder_quality":
+			extruders = append(extruders, parseCuraValues(s))
+		}
+	}
+
+	settings := make([]*GcodeBlock, 0, len(curaKeys))
+	for _, k := range curaKeys {
+		v, ok := global[k.cura]
+		if !k.perExtruder {
+			if ok {
+				settings = append(settings, curaLine(k.key, v))
+			}
+			continue
+		}
+		values := []string{v, v}
+		for i := 0; i < len(extruders) && i < 2; i++ {
+			if e, found := extruders[i][k.cura]; found {
+				values[i], ok = e, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		// an extruder without its own value uses the other one
+		if values[0] == "" {
+			values[0] = values[1]
+		} else if values[1] == "" {
+			values[1] = values[0]
+		}
+		settings = append(settings, curaLine(k.key, strings.Join(values, ",")))
+	}
+	return settings
+}
+
+func curaLine(key, value string) *GcodeBlock {
+	g, _ := ParseGcodeBlock(fmt.Sprintf("; %s = %s", key, value))
+	return g
+}
+
+// parseCuraValues reads the [values] section of a Cura INI text, the
+// formulas of Cura ("=layer_height * 2") are skipped
+func parseCuraValues(ini string) map[string]string {
+	values := map[string]string{}
+	section := ""
+	for _, line := range strings.Split(ini, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if section != "[values]" || !ok {
+			continue
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if k != "" && v != "" && !strings.HasPrefix(v, "=") {
+			values[k] = v
+		}
+	}
+	return values
+}
@@ -0,0 +1,133 @@
+package fix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// detectWindow is how many bytes of the head and tail of a seekable file are
+// scanned, the start gcode is at the head and the slicer config at the tail.
+var detectWindow int64 = 1 << 20
+
+type Detection struct {
+	File          string `json:"file,omitempty"`
+	Slicer        string `json:"slicer"`
+	SlicerVersion string `json:"slicer_version"`
+	Model         string `json:"model"`
+	Version       int    `json:"gcode_version"`
+	PrintMode     string `json:"print_mode"`
+}
+
+func (d *Detection) String() string {
+	slicer := strings.TrimSpace(d.Slicer + " " + d.SlicerVersion)
+	if slicer == "" {
+		slicer = "unknown slicer"
+	}
+	model := d.Model
+	if model == "" {
+		model = "unknown model"
+	}
+	return fmt.Sprintf("%s, %s, v%d, %s", slicer, model, d.Version, d.PrintMode)
+}
+
+// generatorLines is how far from the top the banner of the slicer is looked for
+const generatorLines = 50
+
+// parseGenerator reads the slicer name and version from the banner line, e.g.
+// "; generated by PrusaSlicer 2.7.1+win64 on 2024-01-01 at 00:00:00 UTC"
+// ";Generated with Cura_SteamEngine 5.6.0"
+// "; G-Code generated by Simplify3D(R) Version 4.1.2"
+func parseGenerator(line string) (name, version string, ok bool) {
+	s := strings.TrimSpace(strings.TrimLeft(line, "; "))
+	lower := strings.ToLower(s)
+	for _, prefix := range []string{"generated by ", "generated with ", "g-code generated by ", "sliced by "} {
+		if strings.HasPrefix(lower, prefix) {
+			fields := strings.Fields(s[len(prefix):])
+			if len(fields) > 0 {
+				name = strings.TrimSuffix(fields[0], "(R)")
+			}
+			if len(fields) > 2 && strings.EqualFold(fields[1], "version") {
+				version = fields[2]
+			} else if len(fields) > 1 && fields[1] != "on" {
+				version = fields[1]
+			}
+			return name, strings.TrimSuffix(version, ","), name != ""
+		}
+	}
+	return "", "", false
+}
+
+func isLayerChange(line string) bool {
+	return strings.HasPrefix(line, ";LAYER_CHANGE") ||
+		strings.HasPrefix(line, "; CHANGE_LAYER") ||
+		strings.HasPrefix(line, ";LAYER:")
+}
+
+// Detect reports the slicer, printer model and gcode version without fixing,
+// for a seekable reader only the head and tail of the file are scanned.
+func Detect(r io.Reader) (*Detection, error) {
+	var (
+		d      = &Detection{}
+		gcodes []*GcodeBlock
+	)
+	scan := func(r io.Reader, head bool) error {
+		sc := newScanner(r, ReadOptions{})
+		for sc.Scan() {
+			line := sc.Text()
+			if head && isLayerChange(line) {
+				break
+			}
+			if d.Slicer == "" {
+				if name, version, ok := parseGenerator(line); ok {
+					d.Slicer, d.SlicerVersion = name, version
+				}
+			}
+			if g, err := ParseGcodeBlock(line); err == nil {
+				gcodes = append(gcodes, g)
+			}
+		}
+		return sc.Err()
+	}
+
+	var size int64
+	rs, seekable := r.(io.ReadSeeker)
+	if seekable {
+		var err error
+		if size, err = rs.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err = rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	if seekable && size > 2*detectWindow {
+		if err := scan(io.LimitReader(rs, detectWindow), true); err != nil {
+			return nil, err
+		}
+		if _, err := rs.Seek(size-detectWindow, io.SeekStart); err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(rs)
+		if _, err := br.ReadString('\n'); err != nil { // skip the partial line
+			return nil, err
+		}
+		if err := scan(br, false); err != nil {
+			return nil, err
+		}
+	} else if err := scan(r, false); err != nil {
+		return nil, err
+	}
+
+	// only a part of the file is known, the params may be incomplete
+	p, err := ParseSlicerParams(gcodes)
+	if err != nil && err != ErrInvalidGcode && err != ErrNoPrintable {
+		return nil, err
+	}
+	d.Model = p.Model
+	d.Version = p.Version
+	d.PrintMode = p.PrintMode
+	return d, nil
+}
@@ -0,0 +1,59 @@
+package fix
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DryRun is what a fix would write, without the body, so a wrong detection can
+// be seen before the file is rewritten
+type DryRun struct {
+	File               string    `json:"file,omitempty"`
+	Model              string    `json:"model"`
+	Version            int       `json:"gcode_version"`
+	ToolHead           string    `json:"tool_head"`
+	PrintMode          string    `json:"print_mode"`
+	NozzleTemperatures []float64 `json:"nozzle_temperatures"`
+	BedTemperature     float64   `json:"bed_temperature"`
+	Header             []string  `json:"header"`
+	Warnings           []string  `json:"warnings"`
+}
+
+// NewDryRun describes the header generated from p
+func NewDryRun(p *slicerParams, header [][]byte, warnings []error) *DryRun {
+	d := &DryRun{
+		Model:              p.Model,
+		Version:            p.Version,
+		ToolHead:           p.ToolHead,
+		PrintMode:          p.PrintMode,
+		NozzleTemperatures: p.NozzleTemperatures,
+		BedTemperature:     p.EffectiveFirstLayerBedTemperature(),
+		Header:             make([]string, 0, len(header)),
+		Warnings:           make([]string, 0, len(warnings)),
+	}
+	for _, h := range header {
+		d.Header = append(d.Header, string(h))
+	}
+	for _, w := range warnings {
+		d.Warnings = append(d.Warnings, w.Error())
+	}
+	return d
+}
+
+// String is the summary line followed by the header
+func (d *DryRun) String() string {
+	var b strings.Builder
+	temps := make([]string, 0, len(d.NozzleTemperatures))
+	for _, t := range d.NozzleTemperatures {
+		temps = append(temps, fmt.Sprintf("%.0f", t))
+	}
+	fmt.Fprintf(&b, "%s, v%d, %s, %s, nozzle %s°C, bed %.0f°C\n",
+		d.Model, d.Version, d.ToolHead, d.PrintMode, strings.Join(temps, "/"), d.BedTemperature)
+	for _, w := range d.Warnings {
+		fmt.Fprintf(&b, "Warning: %s\n", w)
+	}
+	for _, h := range d.Header {
+		b.WriteString(h + "\n")
+	}
+	return b.String()
+}
@@ -3,6 +3,7 @@ package fix
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -233,8 +234,11 @@ func GcodeTrimLines(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 */
 
 func GcodeReinforceTower(gcodes []*GcodeBlock) (output []*GcodeBlock) {
-	output = make([]*GcodeBlock, 0, len(gcodes)+2048)
+	return LineReinforceTower().Gcodes(gcodes)
+}
 
+// LineReinforceTower is GcodeReinforceTower one line at a time
+func LineReinforceTower() LineModifier {
 	var (
 		wiping bool
 		e      float32
@@ -242,7 +246,7 @@ func GcodeReinforceTower(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 		cmd    *GcodeBlock
 		z      float32
 	)
-	for _, gcode := range gcodes {
+	return func(gcode *GcodeBlock) []*GcodeBlock {
 		if gcode.IsComment() {
 			if gcode.InComment("; CP TOOLCHANGE WIPE") {
 				wiping = true
@@ -270,12 +274,11 @@ func GcodeReinforceTower(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 					// }
 				}
 				cmd, _ = ParseGcodeBlock(fmt.Sprintf("G1 E%g F%g ;(Fixed: reinforce tower)", e, f))
-				output = append(output, cmd)
+				return []*GcodeBlock{cmd, gcode}
 			}
 		}
-		output = append(output, gcode)
+		return []*GcodeBlock{gcode}
 	}
-	return output
 }
 
 // GcodeReplaceToolNum 查找 Gcode 中的 T/M104/M106/M107/M109 指令，将参数中的 Tnum/Pnum 替换为 num % 2 的结果
@@ -290,100 +293,128 @@ func GcodeReplaceToolNum(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 	nGcodes := len(gcodes)
 	work := func(wi, wn int) {
 		for n := wi; n < nGcodes; n += wn {
-			gcode := gcodes[n]
-			switch gcode.Cmd().Word() {
-			case 'T':
-				{
-					tool, _ := gcode.GetToolNum()
-					if num, t := tool%2, int(tool); num == 0 {
-						idxT0 = t
-					} else {
-						idxT1 = t
-					}
-					gcodes[n].Cmd().SetAddr(tool % 2)
-				}
-			case 'M':
-				{
-					tool, _ := gcode.GetToolNum()
-					str_tool := strconv.Itoa(int(tool) % 2)
-					switch gcode.Cmd().Addr() {
-					case "106", "107": // fan use P
-						if gcode.HasParam('P') {
-							gcodes[n].SetParam('P', str_tool)
-						}
-
-					case "104", "109": // temp use T
-						if gcode.HasParam('T') {
-							gcodes[n].SetParam('T', str_tool)
-						}
-
-					case "301", "303":
-						if gcode.HasParam('E') {
-							gcodes[n].SetParam('E', str_tool)
-						}
-
-					}
-				} // M
-			} // switch word
+			if t := replaceToolNum(gcodes[n]); t == -1 {
+				continue
+			} else if t%2 == 0 {
+				idxT0 = t
+			} else {
+				idxT1 = t
+			}
 		} // for
 	} // work
 
 	GoInParallelAndWait(work)
 
-	// remove unused values for ParseParams()
+	work2 := func(wi, wn int) {
+		for n := wi; n < nGcodes; n += wn {
+			replaceToolSettings(gcodes[n], idxT0, idxT1)
+		}
+	}
+	GoInParallelAndWait(work2)
+	return gcodes
+}
+
+// LineReplaceToolNum is GcodeReplaceToolNum one line at a time, the settings
+// take the last tools of the lines before them, the slicers write them at the
+// end of the file.
+func LineReplaceToolNum() LineModifier {
+	var idxT0, idxT1 int
+	return func(gcode *GcodeBlock) []*GcodeBlock {
+		if t := replaceToolNum(gcode); t == -1 {
+			replaceToolSettings(gcode, idxT0, idxT1)
+		} else if t%2 == 0 {
+			idxT0 = t
+		} else {
+			idxT1 = t
+		}
+		return []*GcodeBlock{gcode}
+	}
+}
+
+// replaceToolNum 将 T/M104/M106/M107/M109/M301/M303 的 Tnum/Pnum/Enum 替换为 num % 2，
+// 返回 T 指令原来的 num，其他指令返回 -1
+func replaceToolNum(gcode *GcodeBlock) int {
+	switch gcode.Cmd().Word() {
+	case 'T':
+		tool, _ := gcode.GetToolNum()
+		gcode.Cmd().SetAddr(tool % 2)
+		return int(tool)
+	case 'M':
+		tool, _ := gcode.GetToolNum()
+		str_tool := strconv.Itoa(int(tool) % 2)
+		switch gcode.Cmd().Addr() {
+		case "106", "107": // fan use P
+			if gcode.HasParam('P') {
+				gcode.SetParam('P', str_tool)
+			}
+
+		case "104", "109": // temp use T
+			if gcode.HasParam('T') {
+				gcode.SetParam('T', str_tool)
+			}
+
+		case "301", "303":
+			if gcode.HasParam('E') {
+				gcode.SetParam('E', str_tool)
+			}
+
+		}
+	}
+	return -1
+}
+
+// replaceToolSettings keeps the values of idxT0 and idxT1 in the settings of
+// ParseParams, the unused values are removed
+func replaceToolSettings(gcode *GcodeBlock, idxT0, idxT1 int) {
+	defer func() {
+		if r := recover(); r != nil {
+			// fmt.Println(r, comment)
+		}
+	}()
 	prefixes := []string{
 		"; filament used [",
 		"; filament_type = ",
 		"; filament_retraction_length = ",
+		"; retract_length_toolchange = ",
 		"; nozzle_temperature_initial_layer = ",
 		"; hot_plate_temp_initial_layer = ",
 	}
-	work2 := func(wi, wn int) {
-		defer func() {
-			if r := recover(); r != nil {
-				// fmt.Println(r, comment)
-			}
-		}()
-		for n := wi; n < nGcodes; n += wn {
-			gcode := gcodes[n]
-			if gcode.IsComment() {
-				comment := gcode.Comment()
-				if len(comment) > 15 {
-					for _, prefix := range prefixes {
-						if strings.HasPrefix(comment, prefix) {
-							i := strings.Index(comment, "=")
-							if i != -1 {
-								v := comment[i+1:]
-								var (
-									vs        []string
-									delimiter = ","
-								)
-								if strings.Contains(v, ";") {
-									delimiter = ";"
-								}
-								vs = strings.Split(v, delimiter)
-								l := len(vs)
-								if l >= idxT0 {
-									vs[0] = strings.TrimSpace(vs[idxT0])
-								}
-								if l >= idxT1 {
-									vs[1] = strings.TrimSpace(vs[idxT1])
-								}
-								nv := strings.Join(vs[:2], delimiter)
-								var buf bytes.Buffer
-								buf.WriteString(comment[:i+2])
-								buf.WriteString(nv)
-								gcodes[n].SetComment(buf.String())
-							}
-							break
-						}
-					}
+	if !gcode.IsComment() {
+		return
+	}
+	comment := gcode.Comment()
+	if len(comment) <= 15 {
+		return
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(comment, prefix) {
+			i := strings.Index(comment, "=")
+			if i != -1 {
+				v := comment[i+1:]
+				var (
+					vs        []string
+					delimiter = ","
+				)
+				if strings.Contains(v, ";") {
+					delimiter = ";"
 				}
+				vs = strings.Split(v, delimiter)
+				l := len(vs)
+				if l > idxT0 {
+					vs[0] = strings.TrimSpace(vs[idxT0])
+				}
+				if l > idxT1 {
+					vs[1] = strings.TrimSpace(vs[idxT1])
+				}
+				nv := strings.Join(vs[:2], delimiter)
+				var buf bytes.Buffer
+				buf.WriteString(comment[:i+2])
+				buf.WriteString(nv)
+				gcode.SetComment(buf.String())
 			}
+			break
 		}
 	}
-	GoInParallelAndWait(work2)
-	return gcodes
 }
 
 func GcodeFixOrcaToolUnload(gcodes []*GcodeBlock) (output []*GcodeBlock) {
@@ -392,14 +423,27 @@ func GcodeFixOrcaToolUnload(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 	var (
 		check bool
 		cmd   *GcodeBlock
+		hooks = filamentGcodeBlocks(gcodes)
+		hook  int // commands left of the filament_start/end_gcode at the tool change
 	)
-	for _, gcode := range gcodes {
+	for n, gcode := range gcodes {
 		if gcode.IsComment() {
 			if gcode.InComment("; CP TOOLCHANGE START") {
 				check = true
 			}
 			if gcode.InComment("; CP TOOLCHANGE END") {
 				check = false
+				hook = 0
+			}
+		} else if check {
+			if hook == 0 {
+				hook = matchGcodeBlock(gcodes[n:], hooks)
+			}
+			if hook > 0 {
+				// the commands of a hook are kept as they are
+				hook--
+				output = append(output, gcode)
+				continue
 			}
 		}
 		if check && gcode.Is("M104") {
@@ -414,3 +458,378 @@ func GcodeFixOrcaToolUnload(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 	}
 	return output
 }
+
+// lineInsertAfterHoming inserts g right after homing, or before the first move
+// when the start gcode does not home.
+func lineInsertAfterHoming(g *GcodeBlock) LineModifier {
+	done := false
+	return func(gcode *GcodeBlock) []*GcodeBlock {
+		switch {
+		case done:
+		case gcode.Is("G28"):
+			done = true
+			return []*GcodeBlock{gcode, g}
+		case gcode.Is("G0") || gcode.Is("G1"):
+			done = true
+			return []*GcodeBlock{g, gcode}
+		}
+		return []*GcodeBlock{gcode}
+	}
+}
+
+// GcodeSetOrigin sets the work origin after homing
+func GcodeSetOrigin(x, y, z float64) GcodeModifier {
+	return LineSetOrigin(x, y, z).Gcodes
+}
+
+// LineSetOrigin is GcodeSetOrigin one line at a time
+func LineSetOrigin(x, y, z float64) LineModifier {
+	origin, _ := ParseGcodeBlock(fmt.Sprintf("G92 X%g Y%g Z%g ;(Fixed: set origin)", x, y, z))
+	return lineInsertAfterHoming(origin)
+}
+
+// GcodeSetAcceleration sets the print and travel acceleration after homing,
+// a missing one falls back to the other.
+func GcodeSetAcceleration(print, travel float64) GcodeModifier {
+	return LineSetAcceleration(print, travel).Gcodes
+}
+
+// LineSetAcceleration is GcodeSetAcceleration one line at a time
+func LineSetAcceleration(print, travel float64) LineModifier {
+	if print <= 0 {
+		print = travel
+	}
+	if travel <= 0 {
+		travel = print
+	}
+	if print <= 0 {
+		return nil
+	}
+	accel, _ := ParseGcodeBlock(fmt.Sprintf("M204 P%g T%g ;(Fixed: acceleration)", print, travel))
+	return lineInsertAfterHoming(accel)
+}
+
+// DefaultArcTolerance is used to linearize arcs when the slicer does not report one
+const DefaultArcTolerance = 0.0125
+
+// GcodeLinearizeArcs replaces G2/G3 with G1 segments, each segment deviates
+// from the arc by tolerance at most, so the segment length follows the radius.
+func GcodeLinearizeArcs(tolerance float64) GcodeModifier {
+	return LineLinearizeArcs(tolerance).Gcodes
+}
+
+// LineLinearizeArcs is GcodeLinearizeArcs one line at a time
+func LineLinearizeArcs(tolerance float64) LineModifier {
+	if tolerance <= 0 {
+		tolerance = DefaultArcTolerance
+	}
+	var (
+		pos        [4]float64 // X Y Z E
+		relativeXY bool
+		relativeE  bool
+	)
+	axes := []byte("XYZE")
+	return func(gcode *GcodeBlock) []*GcodeBlock {
+		switch {
+		case gcode.Is("G90"):
+			relativeXY, relativeE = false, false
+		case gcode.Is("G91"):
+			relativeXY, relativeE = true, true
+		case gcode.Is("M82"):
+			relativeE = false
+		case gcode.Is("M83"):
+			relativeE = true
+		case gcode.Is("G92"):
+			for i, axis := range axes {
+				var v float32
+				if gcode.GetParam(axis, &v) == nil {
+					pos[i] = float64(v)
+				}
+			}
+		case gcode.Is("G0") || gcode.Is("G1"):
+			for i, axis := range axes {
+				var v float32
+				if gcode.GetParam(axis, &v) == nil {
+					if (i < 3 && relativeXY) || (i == 3 && relativeE) {
+						pos[i] += float64(v)
+					} else {
+						pos[i] = float64(v)
+					}
+				}
+			}
+		case gcode.Is("G2") || gcode.Is("G3"):
+			segments, end, ok := linearizeArc(gcode, pos, relativeXY, relativeE, tolerance)
+			if ok {
+				pos = end
+				return segments
+			}
+		}
+		return []*GcodeBlock{gcode}
+	}
+}
+
+func linearizeArc(gcode *GcodeBlock, start [4]float64, relativeXY, relativeE bool, tolerance float64) (segments []*GcodeBlock, end [4]float64, ok bool) {
+	end = start
+	axes := []byte("XYZE")
+	for i, axis := range axes {
+		var v float32
+		if gcode.GetParam(axis, &v) == nil {
+			if (i < 3 && relativeXY) || (i == 3 && relativeE) {
+				end[i] += float64(v)
+			} else {
+				end[i] = float64(v)
+			}
+		}
+	}
+
+	var (
+		i, j, r float32
+		cx, cy  float64
+		cw      = gcode.Is("G2")
+	)
+	if gcode.HasParam('I') || gcode.HasParam('J') {
+		gcode.GetParam('I', &i)
+		gcode.GetParam('J', &j)
+		cx, cy = start[0]+float64(i), start[1]+float64(j)
+	} else if gcode.GetParam('R', &r) == nil && r != 0 {
+		dx, dy := end[0]-start[0], end[1]-start[1]
+		d := math.Hypot(dx, dy)
+		if d == 0 {
+			return nil, end, false
+		}
+		h := math.Sqrt(math.Max(float64(r)*float64(r)-d*d/4, 0))
+		// the center is left of the chord for a minor ccw arc
+		if cw == (r > 0) {
+			h = -h
+		}
+		cx, cy = (start[0]+end[0])/2-h*dy/d, (start[1]+end[1])/2+h*dx/d
+	} else {
+		return nil, end, false
+	}
+
+	radius := math.Hypot(start[0]-cx, start[1]-cy)
+	if radius == 0 {
+		return nil, end, false
+	}
+	a0 := math.Atan2(start[1]-cy, start[0]-cx)
+	sweep := math.Atan2(end[1]-cy, end[0]-cx) - a0
+	if cw && sweep >= 0 {
+		sweep -= 2 * math.Pi
+	} else if !cw && sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+
+	step := math.Pi / 2
+	if tolerance < radius {
+		step = math.Min(step, 2*math.Acos(1-tolerance/radius))
+	}
+	n := int(math.Ceil(math.Abs(sweep) / step))
+	if n < 1 {
+		n = 1
+	}
+
+	var f float32
+	hasF := gcode.GetParam('F', &f) == nil
+	hasZ, hasE := gcode.HasParam('Z'), gcode.HasParam('E')
+	prev := start
+	for s := 1; s <= n; s++ {
+		t := float64(s) / float64(n)
+		p := [4]float64{end[0], end[1], start[2] + (end[2]-start[2])*t, start[3] + (end[3]-start[3])*t}
+		if s < n {
+			a := a0 + sweep*t
+			p[0], p[1] = cx+radius*math.Cos(a), cy+radius*math.Sin(a)
+		}
+		seg := &GcodeBlock{cmd: &Gcode{word: 'G', addr: "1"}}
+		for k, axis := range axes {
+			if (k == 2 && !hasZ) || (k == 3 && !hasE) {
+				continue
+			}
+			v := p[k]
+			if (k < 3 && relativeXY) || (k == 3 && relativeE) {
+				v -= prev[k]
+			}
+			g := &Gcode{word: axis}
+			g.SetAddr(v)
+			seg.params = append(seg.params, g)
+		}
+		if s == 1 {
+			if hasF {
+				g := &Gcode{word: 'F'}
+				g.SetAddr(int(f))
+				seg.params = append(seg.params, g)
+			}
+			seg.SetComment(";(Fixed: linearized %s)", gcode.Cmd())
+		}
+		segments = append(segments, seg)
+		prev = p
+	}
+	return segments, end, true
+}
+
+// ClampZMargin is how far a Z move may exceed the max height before it is clamped
+const ClampZMargin = 5.0
+
+// GcodeClampZ rewrites absolute Z moves above maxZ+ClampZMargin to maxZ,
+// each clamp is reported with logf.
+func GcodeClampZ(maxZ float64, logf func(format string, v ...any)) GcodeModifier {
+	return LineClampZ(maxZ, logf).Gcodes
+}
+
+// LineClampZ is GcodeClampZ one line at a time
+func LineClampZ(maxZ float64, logf func(format string, v ...any)) LineModifier {
+	if maxZ <= 0 {
+		return nil
+	}
+	var (
+		n        int
+		relative bool
+	)
+	return func(gcode *GcodeBlock) []*GcodeBlock {
+		n++
+		switch {
+		case gcode.Is("G90"):
+			relative = false
+		case gcode.Is("G91"):
+			relative = true
+		case (gcode.Is("G0") || gcode.Is("G1")) && !relative:
+			var z float32
+			if gcode.GetParam('Z', &z) == nil && float64(z) > maxZ+ClampZMargin {
+				logf("line %d: Z%g is above the max height %gmm, clamped", n, z, maxZ)
+				gcode.SetParam('Z', fmt.Sprintf("%.3f", maxZ))
+				gcode.AppendComment("(Fixed: clamped Z%g)", z)
+			}
+		}
+		return []*GcodeBlock{gcode}
+	}
+}
+
+// GcodeEnsureHeat waits for the nozzle temperature before the first extrusion,
+// the firmware stops with a cold extrusion error otherwise. temps are the
+// temperatures of each tool, an omission is reported with logf.
+func GcodeEnsureHeat(temps []float64, logf func(format string, v ...any)) GcodeModifier {
+	return LineEnsureHeat(temps, logf).Gcodes
+}
+
+// LineEnsureHeat is GcodeEnsureHeat one line at a time
+func LineEnsureHeat(temps []float64, logf func(format string, v ...any)) LineModifier {
+	var (
+		n        int
+		done     bool
+		tool     int
+		relative bool
+		lastE    float64
+		heated   = map[int]bool{}
+	)
+	return func(gcode *GcodeBlock) []*GcodeBlock {
+		n++
+		if done {
+			return []*GcodeBlock{gcode}
+		}
+		switch {
+		case gcode.Cmd().Word() == 'T':
+			var t int
+			if gcode.Cmd().AddrAs(&t) == nil {
+				tool = t
+			}
+		case gcode.Is("M82"):
+			relative = false
+		case gcode.Is("M83"):
+			relative = true
+		case gcode.Is("G92"):
+			var e float32
+			if gcode.GetParam('E', &e) == nil {
+				lastE = float64(e)
+			}
+		case gcode.Is("M109") && (gcode.HasParam('S') || gcode.HasParam('R')):
+			t := tool
+			gcode.GetParam('T', &t)
+			heated[t] = true
+		case gcode.Is("G0") || gcode.Is("G1") || gcode.Is("G2") || gcode.Is("G3"):
+			var e float32
+			if gcode.GetParam('E', &e) != nil {
+				break
+			}
+			de := float64(e)
+			if !relative {
+				de, lastE = de-lastE, de
+			}
+			if de <= 0 {
+				break
+			}
+			done = true
+			if heated[tool] || tool < 0 || tool >= len(temps) || temps[tool] <= 0 {
+				break
+			}
+			logf("line %d: T%d extrudes before waiting for the nozzle temperature, M109 is added", n, tool)
+			heat, _ := ParseGcodeBlock(fmt.Sprintf("M109 T%d S%g ;(Fixed: wait for nozzle temperature)", tool, temps[tool]))
+			return []*GcodeBlock{heat, gcode}
+		}
+		return []*GcodeBlock{gcode}
+	}
+}
+
+// GcodeProgress adds M73 after each layer change for the progress bar of the
+// touchscreen, the percent follows the layer index and the remaining minutes
+// the estimated time. The "; layer N of M" comments of the slicer are used
+// instead when there are some. A file with M73 of the slicer is left as is.
+func GcodeProgress(totalLayers int, estimatedSec int) GcodeModifier {
+	return func(gcodes []*GcodeBlock) []*GcodeBlock {
+		layers, layerOf := 0, false
+		for _, gcode := range gcodes {
+			if gcode.Is("M73") {
+				return gcodes
+			}
+			line := gcode.String()
+			if isLayerChange(line) {
+				layers++
+			} else if _, _, ok := parseLayerOf(line); ok {
+				layerOf = true
+			}
+		}
+		if totalLayers <= 0 {
+			totalLayers = layers
+		}
+		return LineProgress(totalLayers, estimatedSec, layerOf).Gcodes(gcodes)
+	}
+}
+
+// LineProgress is GcodeProgress one line at a time, the layers and whether the
+// slicer writes "; layer N of M" comments are known in advance. It is nil
+// without layers.
+func LineProgress(totalLayers int, estimatedSec int, layerOf bool) LineModifier {
+	if totalLayers <= 0 && !layerOf {
+		return nil
+	}
+	layer := 0
+	return func(gcode *GcodeBlock) []*GcodeBlock {
+		line := gcode.String()
+		var percent int
+		if layerOf {
+			n, m, ok := parseLayerOf(line)
+			if !ok {
+				return []*GcodeBlock{gcode}
+			}
+			// the percent is of the layers done before N
+			percent = (n - 1) * 100 / m
+		} else if isLayerChange(line) {
+			percent = layer * 100 / totalLayers
+			layer++
+		} else {
+			return []*GcodeBlock{gcode}
+		}
+		if percent < 0 {
+			percent = 0
+		} else if percent > 100 {
+			percent = 100
+		}
+		return []*GcodeBlock{gcode, progressGcode(percent, estimatedSec)}
+	}
+}
+
+// progressGcode is M73 of the percent done, the remaining minutes are of the
+// estimated time
+func progressGcode(percent int, estimatedSec int) *GcodeBlock {
+	remaining := int(math.Round(float64(estimatedSec) * float64(100-percent) / 100 / 60))
+	progress, _ := ParseGcodeBlock(fmt.Sprintf("M73 P%d R%d ;(Fixed: progress)", percent, remaining))
+	return progress
+}
@@ -0,0 +1,69 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gzipMagic starts every gzip stream, a .gz extension alone is not trusted
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Decompress returns a reader of the gcode of r, it is decompressed when r is
+// gzip. A seekable r that is not gzip is returned as it is.
+func Decompress(r io.Reader) (io.Reader, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		magic := make([]byte, len(gzipMagic))
+		n, _ := io.ReadFull(rs, magic)
+		if _, err := rs.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(magic[:n], gzipMagic) {
+			return gzip.NewReader(rs)
+		}
+		return rs, nil
+	}
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// Compress returns a writer of the output at path to w, it is gzip when path
+// ends in .gz. Close flushes it but does not close w.
+func Compress(w io.Writer, path string) io.WriteCloser {
+	if strings.EqualFold(filepath.Ext(path), ".gz") {
+		return gzip.NewWriter(w)
+	}
+	return nopCloser{w}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// isGcodeFile reports whether path is a .gcode or a .gcode.gz file
+func isGcodeFile(path string) bool {
+	path = strings.ToLower(path)
+	return strings.HasSuffix(path, ".gcode") || strings.HasSuffix(path, ".gcode.gz")
+}
+
+// ParseFile parses the params of the file at path as ScanParams does, a gzip
+// file is decompressed
+func ParseFile(path string) (*slicerParams, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	return ScanParams(r)
+}
@@ -1,109 +1,322 @@
 package fix
 
 import (
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func H(s string, p ...any) []byte {
 	return []byte(fmt.Sprintf(s, p...))
 }
 
-func headerV0() [][]byte {
+// LubanComments adds the comments Snapmaker Luban reads to preview a job
+var LubanComments = false
+
+// SlicerComment credits the slicer and its version in the header
+var SlicerComment = false
+
+// BodyChecksum adds the CRC32 of the body to the header
+var BodyChecksum = false
+
+// bodyChecksum is the CRC32 (IEEE) of the body as WriteGcodes writes it,
+// the bytes following ";Header End" and its blank line.
+func bodyChecksum(gcodes []*GcodeBlock) uint32 {
+	h := crc32.NewIEEE()
+	for _, g := range gcodes {
+		io.WriteString(h, g.String()+"\n")
+	}
+	return h.Sum32()
+}
+
+func checksumComment(version int, sum uint32) []byte {
+	if version == 1 {
+		return H(";Checksum CRC32:%08x", sum)
+	}
+	return H(";checksum_crc32: %08x", sum)
+}
+
+// slicerComment credits the slicer of the banner
+func slicerComment(p *slicerParams) []byte {
+	slicer := strings.TrimSpace(p.SlicerName + " " + p.SlicerVersion)
+	if p.Version == 1 {
+		return H(";Slicer:%s", slicer)
+	}
+	return H(";slicer: %s", slicer)
+}
+
+// lubanComments are the fields of a Luban generated header missing from the
+// firmware header of p.Version, Luban reads the thumbnail as ";thumbnail: ".
+func lubanComments(p *slicerParams) [][]byte {
+	h := make([][]byte, 0, 10)
+	h = append(h, H(";renderMethod: line"))
+	if p.Version == 0 {
+		return h
+	}
+	h = append(h, H(";header_type: 3dp"))
+	h = append(h, H(";estimated_time(s): %d", p.EstimatedTimeSec))
+	h = append(h, H(";nozzle_temperature(°C): %.0f", p.NozzleTemperatures[0]))
+	h = append(h, H(";build_plate_temperature(°C): %.0f", p.EffectiveFirstLayerBedTemperature()))
+	h = append(h, H(";layer_height: %.2f", p.LayerHeight))
+	h = append(h, H(";matierial_weight: %.4f", p.AllFilamentUsedWeight()))
+	h = append(h, H(";matierial_length: %.5f", p.AllFilamentUsed()/1000.0))
+	if len(p.Thumbnail) > 0 {
+		h = append(h, H(";thumbnail: %s", p.Thumbnail))
+	}
+	return h
+}
+
+// slot is a value of the second extruder in the header, the second slot a
+// single extruder profile does not report is written as 0
+func slot(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func headerV0(p *slicerParams, extra [][]byte) [][]byte {
 	h := make([][]byte, 0, 36)
 	h = append(h, H(Mark))
 	h = append(h, H(";Header Start"))
 	h = append(h, H(";FAVOR:Marlin"))
 	h = append(h, H(";TIME:6666"))
-	h = append(h, H(";Filament used: %.5fm", Params.AllFilamentUsed()/1000.0))
-	h = append(h, H(";Layer height: %.2f", Params.LayerHeight))
+	h = append(h, H(";Filament used: %.5fm", p.AllFilamentUsed()/1000.0))
+	h = append(h, H(";Layer height: %.2f", p.LayerHeight))
 	h = append(h, H(";header_type: 3dp"))
-	h = append(h, H(";tool_head: %s", Params.ToolHead))
-	h = append(h, H(";machine: %s", Params.Model))
-	h = append(h, H(";file_total_lines: %d", Params.TotalLines+34))
-	h = append(h, H(";estimated_time(s): %.0f", float64(Params.EstimatedTimeSec)*1.07))
-	// h = append(h, H(";nozzle_temperature(°C): %.0f", Params.EffectiveNozzleTemperature()))
-	h = append(h, H(";nozzle_temperature(°C): %.0f", Params.NozzleTemperatures[0]))
-	// h = append(h, H(";nozzle_0_temperature(°C): %.0f", Params.NozzleTemperatures[0]))
-	h = append(h, H(";nozzle_0_diameter(mm): %.1f", Params.NozzleDiameters[0]))
-	h = append(h, H(";nozzle_0_material: %s", Params.FilamentTypes[0]))
-	h = append(h, H(";Extruder 0 Retraction Distance: %.2f", Params.Retractions[0]))
-	h = append(h, H(";Extruder 0 Switch Retraction Distance: %.2f", Params.SwitchRetraction[0]))
-	h = append(h, H(";nozzle_1_temperature(°C): %.0f", Params.NozzleTemperatures[1]))
-	h = append(h, H(";nozzle_1_diameter(mm): %.1f", Params.NozzleDiameters[1]))
-	h = append(h, H(";nozzle_1_material: %s", Params.FilamentTypes[1]))
-	h = append(h, H(";Extruder 1 Retraction Distance: %.2f", Params.Retractions[1]))
-	h = append(h, H(";Extruder 1 Switch Retraction Distance: %.2f", Params.SwitchRetraction[1]))
-	h = append(h, H(";build_plate_temperature(°C): %.0f", Params.EffectiveBedTemperature()))
-	h = append(h, H(";work_speed(mm/minute): %.0f", Params.PrintSpeedSec*60))
-	h = append(h, H(";max_x(mm): %.4f", Params.MaxX))
-	h = append(h, H(";max_y(mm): %.4f", Params.MaxY))
-	h = append(h, H(";max_z(mm): %.4f", Params.MaxZ))
-	h = append(h, H(";min_x(mm): %.4f", Params.MinX))
-	h = append(h, H(";min_y(mm): %.4f", Params.MinY))
-	h = append(h, H(";min_z(mm): %.4f", Params.MinZ))
-	h = append(h, H(";layer_number: %d", Params.TotalLayers))
-	h = append(h, H(";layer_height: %.2f", Params.LayerHeight))
-	h = append(h, H(";matierial_weight: %.4f", Params.AllFilamentUsedWeight()))
-	h = append(h, H(";matierial_length: %.5f", Params.AllFilamentUsed()/1000.0))
-
-	if len(Params.Thumbnail) > 0 {
-		h = append(h, H(";thumbnail: %s", Params.Thumbnail))
+	h = append(h, H(";tool_head: %s", p.ToolHead))
+	h = append(h, H(";machine: %s", p.Model))
+	h = append(h, H(";file_total_lines: %d", p.TotalLines+34+len(extra)))
+	h = append(h, H(";estimated_time(s): %d", p.EstimatedTimeSec))
+	// h = append(h, H(";nozzle_temperature(°C): %.0f", p.EffectiveNozzleTemperature()))
+	h = append(h, H(";nozzle_temperature(°C): %.0f", p.NozzleTemperatures[0]))
+	// h = append(h, H(";nozzle_0_temperature(°C): %.0f", p.NozzleTemperatures[0]))
+	h = append(h, H(";nozzle_0_diameter(mm): %.1f", p.NozzleDiameters[0]))
+	h = append(h, H(";nozzle_0_material: %s", p.FilamentTypes[0]))
+	h = append(h, H(";Extruder 0 Retraction Distance: %.2f", p.Retractions[0]))
+	h = append(h, H(";Extruder 0 Switch Retraction Distance: %.2f", p.SwitchRetractions[0]))
+	h = append(h, H(";nozzle_1_temperature(°C): %.0f", slot(p.NozzleTemperatures[1])))
+	h = append(h, H(";nozzle_1_diameter(mm): %.1f", slot(p.NozzleDiameters[1])))
+	h = append(h, H(";nozzle_1_material: %s", p.FilamentTypes[1]))
+	h = append(h, H(";Extruder 1 Retraction Distance: %.2f", slot(p.Retractions[1])))
+	h = append(h, H(";Extruder 1 Switch Retraction Distance: %.2f", slot(p.SwitchRetractions[1])))
+	h = append(h, H(";build_plate_temperature(°C): %.0f", p.EffectiveFirstLayerBedTemperature()))
+	h = append(h, H(";work_speed(mm/minute): %.0f", p.PrintSpeedSec*60))
+	h = append(h, H(";max_x(mm): %.4f", p.MaxX))
+	h = append(h, H(";max_y(mm): %.4f", p.MaxY))
+	h = append(h, H(";max_z(mm): %.4f", p.MaxZ))
+	h = append(h, H(";min_x(mm): %.4f", p.MinX))
+	h = append(h, H(";min_y(mm): %.4f", p.MinY))
+	h = append(h, H(";min_z(mm): %.4f", p.MinZ))
+	h = append(h, H(";layer_number: %d", p.TotalLayers))
+	h = append(h, H(";layer_height: %.2f", p.LayerHeight))
+	h = append(h, H(";matierial_weight: %.4f", p.AllFilamentUsedWeight()))
+	h = append(h, H(";matierial_length: %.5f", p.AllFilamentUsed()/1000.0))
+
+	if len(p.Thumbnail) > 0 {
+		h = append(h, H(";thumbnail: %s", p.Thumbnail))
 	}
 
+	h = append(h, extra...)
 	h = append(h, H(";Header End\n\n"))
 	return h
 }
 
-func headerV1() [][]byte {
+func headerV1(p *slicerParams, extra [][]byte) [][]byte {
 	h := make([][]byte, 0, 32)
 	h = append(h, H(Mark))
 	h = append(h, H(";Header Start"))
 	h = append(h, H(";Version:1"))
-	h = append(h, H(";Printer:%s", Params.Model))
-	h = append(h, H(";Estimated Print Time:%d", Params.EstimatedTimeSec))
-	h = append(h, H(";Lines:%d", Params.TotalLines+27))
-	h = append(h, H(";Extruder Mode:%s", Params.PrintMode))
-	h = append(h, H(";Extruder 0 Nozzle Size:%.1f", Params.NozzleDiameters[0]))
-	h = append(h, H(";Extruder 0 Material:%s", Params.FilamentTypes[0]))
-	h = append(h, H(";Extruder 0 Print Temperature:%.0f", Params.NozzleTemperatures[0]))
-	h = append(h, H(";Extruder 0 Retraction Distance:%.2f", Params.Retractions[0]))
-	h = append(h, H(";Extruder 0 Switch Retraction Distance:%.2f", Params.SwitchRetraction[0]))
-	h = append(h, H(";Extruder 1 Nozzle Size:%.1f", Params.NozzleDiameters[1]))
-	h = append(h, H(";Extruder 1 Material:%s", Params.FilamentTypes[1]))
-	h = append(h, H(";Extruder 1 Print Temperature:%.0f", Params.NozzleTemperatures[1]))
-	h = append(h, H(";Extruder 1 Retraction Distance:%.2f", Params.Retractions[1]))
-	h = append(h, H(";Extruder 1 Switch Retraction Distance:%.2f", Params.SwitchRetraction[1]))
-	h = append(h, H(";Bed Temperature:%.0f", Params.EffectiveBedTemperature()))
-	h = append(h, H(";Work Range - Min X:%.4f", Params.MinX))
-	h = append(h, H(";Work Range - Min Y:%.4f", Params.MinY))
-	h = append(h, H(";Work Range - Min Z:%.4f", Params.MinZ))
-	h = append(h, H(";Work Range - Max X:%.4f", Params.MaxX))
-	h = append(h, H(";Work Range - Max Y:%.4f", Params.MaxY))
-	h = append(h, H(";Work Range - Max Z:%.4f", Params.MaxZ))
-
-	if Params.LeftExtruderUsed && Params.RightExtruderUsed {
+	h = append(h, H(";Printer:%s", p.Model))
+	h = append(h, H(";Estimated Print Time:%d", p.SlicerTimeSec))
+	h = append(h, H(";Lines:%d", p.TotalLines+27+len(extra)))
+	h = append(h, H(";Extruder Mode:%s", p.PrintMode))
+	h = append(h, H(";Extruder 0 Nozzle Size:%.1f", p.NozzleDiameters[0]))
+	h = append(h, H(";Extruder 0 Material:%s", p.FilamentTypes[0]))
+	h = append(h, H(";Extruder 0 Print Temperature:%.0f", p.NozzleTemperatures[0]))
+	h = append(h, H(";Extruder 0 Retraction Distance:%.2f", p.Retractions[0]))
+	h = append(h, H(";Extruder 0 Switch Retraction Distance:%.2f", p.SwitchRetractions[0]))
+	h = append(h, H(";Extruder 1 Nozzle Size:%.1f", slot(p.NozzleDiameters[1])))
+	h = append(h, H(";Extruder 1 Material:%s", p.FilamentTypes[1]))
+	h = append(h, H(";Extruder 1 Print Temperature:%.0f", slot(p.NozzleTemperatures[1])))
+	h = append(h, H(";Extruder 1 Retraction Distance:%.2f", slot(p.Retractions[1])))
+	h = append(h, H(";Extruder 1 Switch Retraction Distance:%.2f", slot(p.SwitchRetractions[1])))
+	h = append(h, H(";Bed Temperature:%.0f", p.EffectiveFirstLayerBedTemperature()))
+	h = append(h, H(";Work Range - Min X:%.4f", p.MinX))
+	h = append(h, H(";Work Range - Min Y:%.4f", p.MinY))
+	h = append(h, H(";Work Range - Min Z:%.4f", p.MinZ))
+	h = append(h, H(";Work Range - Max X:%.4f", p.MaxX))
+	h = append(h, H(";Work Range - Max Y:%.4f", p.MaxY))
+	h = append(h, H(";Work Range - Max Z:%.4f", p.MaxZ))
+
+	if p.LeftExtruderUsed && p.RightExtruderUsed {
 		h = append(h, H(";Extruder(s) Used:2"))
 	} else {
 		h = append(h, H(";Extruder(s) Used:1"))
 	}
 
-	if len(Params.Thumbnail) > 0 {
-		h = append(h, H(";Thumbnail:%s", Params.Thumbnail))
+	if len(p.Thumbnail) > 0 {
+		h = append(h, H(";Thumbnail:%s", p.Thumbnail))
 	}
 
+	h = append(h, extra...)
 	h = append(h, H(";Header End\n\n"))
 	return h
 }
 
+// ExtractHeader parses the gcodes into Params and returns their header
 func ExtractHeader(gcodes []*GcodeBlock) (headers [][]byte, err error) {
 	if err = ParseParams(gcodes); err != nil {
 		return
 	}
+	return Params.Header(gcodes), nil
+}
 
-	if Params.Version == 1 {
-		headers = headerV1()
-	} else {
-		headers = headerV0()
+// Header is the firmware header of the gcodes parsed into p
+func (p *slicerParams) Header(gcodes []*GcodeBlock) [][]byte {
+	var sum uint32
+	if BodyChecksum {
+		// the body is final, the modifiers have been applied
+		sum = bodyChecksum(gcodes)
+	}
+	return p.header(sum)
+}
+
+// header is Header of a body with the checksum sum
+func (p *slicerParams) header(sum uint32) [][]byte {
+	var extra [][]byte
+	if SlicerComment && p.SlicerName != "" {
+		extra = append(extra, slicerComment(p))
+	}
+	if LubanComments {
+		extra = append(extra, lubanComments(p)...)
+	}
+	if BodyChecksum {
+		extra = append(extra, checksumComment(p.Version, sum))
+	}
+	if p.Version == 1 {
+		return headerV1(p, extra)
+	}
+	return headerV0(p, extra)
+}
+
+// headerLimits are the fields the touchscreen firmware reads from a header
+type headerLimits struct {
+	Separator string                // between key and value
+	Required  []string              // keys
+	Ranges    map[string]valueRange // numeric keys
+	Enums     map[string][]string
+}
+
+// maxHeaderLine is the longest line the firmware reads, the thumbnail is read separately
+const maxHeaderLine = 255
+
+var headerConstraints = map[int]headerLimits{
+	0: {
+		Separator: ": ",
+		Required:  []string{"header_type", "tool_head", "machine", "file_total_lines", "estimated_time(s)", "nozzle_temperature(°C)", "build_plate_temperature(°C)"},
+		Ranges: map[string]valueRange{
+			"file_total_lines":            {1, maxInt64},
+			"estimated_time(s)":           {0, maxInt64},
+			"nozzle_temperature(°C)":      {0, maxNozzleTemperature},
+			"nozzle_0_temperature(°C)":    {0, maxNozzleTemperature},
+			"nozzle_1_temperature(°C)":    {0, maxNozzleTemperature},
+			"nozzle_0_diameter(mm)":       {0, 2},
+			"nozzle_1_diameter(mm)":       {0, 2},
+			"build_plate_temperature(°C)": {-1, maxBedTemperature},
+			"layer_number":                {0, maxInt64},
+		},
+		Enums: map[string][]string{
+			"header_type": {"3dp"},
+			"tool_head":   {ToolheadSingle, ToolheadDual},
+			"machine":     {ModelA150, ModelA250, ModelA350, ModelA400, ModelJ1},
+		},
+	},
+	1: {
+		Separator: ":",
+		Required:  []string{"Version", "Printer", "Estimated Print Time", "Lines", "Extruder Mode", "Extruder 0 Nozzle Size", "Extruder 0 Material", "Extruder(s) Used"},
+		Ranges: map[string]valueRange{
+			"Estimated Print Time":         {0, maxInt64},
+			"Lines":                        {1, maxInt64},
+			"Extruder 0 Nozzle Size":       {0, 2},
+			"Extruder 1 Nozzle Size":       {0, 2},
+			"Extruder 0 Print Temperature": {0, maxNozzleTemperature},
+			"Extruder 1 Print Temperature": {0, maxNozzleTemperature},
+			"Bed Temperature":              {-1, maxBedTemperature},
+			"Extruder(s) Used":             {1, 2},
+		},
+		Enums: map[string][]string{
+			"Version":       {"1"},
+			"Printer":       {ModelA150, ModelA250, ModelA350, ModelA400, ModelJ1},
+			"Extruder Mode": {PrintModeDefault, PrintModeBackup, PrintModeDuplication, PrintModeMirror},
+		},
+	},
+}
+
+// ValidateHeader checks a header of ExtractHeader against the constraints of
+// the firmware, the firmware rejects or misreads a header that fails.
+func ValidateHeader(version int, headers [][]byte) error {
+	limits, ok := headerConstraints[version]
+	if !ok {
+		return fmt.Errorf("unknown header version %d", version)
+	}
+
+	var (
+		errs   []error
+		fields = map[string]string{}
+	)
+	for _, h := range headers {
+		line := strings.TrimSpace(string(h))
+		if strings.HasPrefix(strings.ToLower(line), ";thumbnail") {
+			continue
+		}
+		if len(line) > maxHeaderLine {
+			errs = append(errs, fmt.Errorf("header line is longer than %d: %.32s...", maxHeaderLine, line))
+		}
+		if k, v, ok := strings.Cut(strings.TrimPrefix(line, ";"), limits.Separator); ok {
+			fields[k] = v
+		}
+	}
+
+	for _, k := range limits.Required {
+		if _, ok := fields[k]; !ok {
+			errs = append(errs, fmt.Errorf("header field %q is missing", k))
+		}
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fields[k]
+		r, ok := limits.Ranges[k]
+		if !ok {
+			continue
+		}
+		if f, err := strconv.ParseFloat(v, 64); err != nil {
+			errs = append(errs, fmt.Errorf("header field %q is not a number: %q", k, v))
+		} else if !r.Contains(f) {
+			errs = append(errs, fmt.Errorf("header field %q is out of range %g-%g: %s", k, r.Min, r.Max, v))
+		}
+	}
+	for _, k := range keys {
+		if enum, ok := limits.Enums[k]; ok && !contains(enum, fields[k]) {
+			errs = append(errs, fmt.Errorf("header field %q has an unknown value %q", k, fields[k]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	return
+	return false
 }
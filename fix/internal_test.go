@@ -1,10 +1,25 @@
 package fix
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -52,7 +67,8 @@ G1
 `)
 
 	comp := []byte("data:image/png;base64,xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyyzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz")
-	r := convertThumbnail(gcodes)
+	thumb, _ := SelectThumbnail(parseThumbnails(gcodes), 0, 0)
+	r := thumb.DataURI()
 	if 0 != bytes.Compare(r, comp) {
 		t.Error(r, comp)
 	}
@@ -75,6 +91,10 @@ func TestConvertEstimatedTime(t *testing.T) {
 	if r := convertEstimatedTime(gcodes); 2*86400+1*60+2 != r {
 		t.Error("2d 1m 2s /", r)
 	}
+	gcodes = " 1.23 minutes"
+	if r := convertEstimatedTime(gcodes); 74 != r {
+		t.Error("1.23 minutes /", r)
+	}
 }
 
 func TestSplit(t *testing.T) {
@@ -124,8 +144,8 @@ func TestSplitFloat(t *testing.T) {
 	if r[0] != 0.2 {
 		t.Error("index 0 value is not 0.2, but:", r[0])
 	}
-	if r[1] != 0 {
-		t.Error("index 1 value is not 0, but:", r[1])
+	if r[1] != -1 {
+		t.Error("index 1 value is not -1, but:", r[1])
 	}
 
 	s = "0.4, 0.689123"
@@ -179,6 +199,76 @@ func _parseGcodes(s string) []*GcodeBlock {
 	return r
 }
 
+// _fixture builds a minimal sliced file, settings overwrite the defaults and
+// an empty value removes the setting.
+func _fixture(settings map[string]string, body ...string) []*GcodeBlock {
+	config := map[string]string{
+		"printer_model":                         "Snapmaker A350",
+		"filament used [mm]":                    "2.00, 0.00",
+		"filament used [g]":                     "3.00, 0.00",
+		"filament_type":                         "PLA;PLA",
+		"first_layer_temperature":               "210,210",
+		"first_layer_bed_temperature":           "60,60",
+		"nozzle_diameter":                       "0.4,0.4",
+		"retract_length":                        "0.8,0.8",
+		"retract_length_toolchange":             "10,10",
+		"layer_height":                          "0.2",
+		"max_print_speed":                       "80",
+		"estimated printing time (normal mode)": "1h 2m 3s",
+	}
+	for k, v := range settings {
+		if v == "" {
+			delete(config, k)
+		} else {
+			config[k] = v
+		}
+	}
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := []string{"; generated by PrusaSlicer 2.7.1 on 2024-01-01 at 00:00:00 UTC", "G28", "G90", "M83", "T0"}
+	if len(body) > 0 {
+		lines = append(lines, body...)
+	} else {
+		lines = append(lines, _moves(20)...)
+	}
+	for _, k := range keys {
+		lines = append(lines, "; "+k+" = "+config[k])
+	}
+	return _parseGcodes(strings.Join(lines, "\n"))
+}
+
+// _moves are n extrusions, a body of _fixture needs 20 lines to be valid
+func _moves(n int) []string {
+	moves := make([]string, n)
+	for i := range moves {
+		moves[i] = "G1 X10 Y10 E0.1 F1200"
+	}
+	return moves
+}
+
+// _params parses the slicer params of a _fixture
+func _params(t *testing.T, settings map[string]string, body ...string) *slicerParams {
+	t.Helper()
+	p, err := ParseSlicerParams(_fixture(settings, body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// _warnings are the messages of warnings, one per line
+func _warnings(warnings []error) string {
+	lines := make([]string, len(warnings))
+	for i, w := range warnings {
+		lines[i] = w.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
 func TestGcodeShutoff(t *testing.T) {
 	gcode := `
 T0 ; initial tool
@@ -552,6 +642,17 @@ func TestGcodeReplaceToolNum(t *testing.T) {
 	})
 
 	comp := func(gcodes []*GcodeBlock, want []*GcodeBlock) {
+		text := func(gcodes []*GcodeBlock) string {
+			lines := make([]string, len(gcodes))
+			for i, g := range gcodes {
+				lines[i] = g.String()
+			}
+			return strings.TrimSpace(strings.Join(lines, "\n"))
+		}
+		// the settings follow the tool changes, one line at a time gives the same
+		if got := LineReplaceToolNum().Gcodes(_parseGcodes(text(gcodes))); text(got) != text(want) {
+			t.Errorf("LineReplaceToolNum: got %s, want %s", text(got), text(want))
+		}
 		got := GcodeReplaceToolNum(gcodes)
 		if (reflect.DeepEqual(got, want)) != true {
 			results := make([]string, 0, len(got)+len(want)+1)
@@ -963,47 +1064,3979 @@ M104 S299
 	}
 }
 
-func BenchmarkParseGcodeBlock(b *testing.B) {
-	code := " G0.1  X1.23 Z.3 E-.004 R Y .333 F500000 ;  comment"
-	b.SetBytes(int64(len(code)))
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		g, err := ParseGcodeBlock(code)
-		if err != nil {
-			b.Fatal(err)
+func TestValidateRetractions(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		warning  string
+	}{
+		{"in range", nil, ""},
+		{"out of range", map[string]string{"retract_length": "8,0.8"}, "T0 retraction 8.00mm is out of range 0.0-4.0mm for Snapmaker 2.0 A350"},
+		{"unused extruder is ignored", map[string]string{"retract_length": "0.8,8"}, ""},
+		{"switch retraction", map[string]string{"retract_length_toolchange": "30,10"}, "T0 switch retraction 30.00mm is out of range 0.0-20.0mm for Snapmaker 2.0 A350"},
+		{"j1", map[string]string{"printer_model": "Snapmaker J1", "retract_length": "3,0.8"}, "T0 retraction 3.00mm is out of range 0.0-2.0mm for Snapmaker J1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestValidateIDEXTravel(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		body     []string
+		warning  string
+	}{
+		{"default mode", map[string]string{"avoid_crossing_perimeters": "0"}, nil, ""},
+		{"idex avoidance on", map[string]string{"avoid_crossing_perimeters": "1"}, []string{"M605 S2"}, ""},
+		{"idex avoidance off", map[string]string{"avoid_crossing_perimeters": "0"}, []string{"M605 S2"}, "avoid crossing perimeters is disabled, travel moves of IDEX Duplication may knock over the print of the idle nozzle"},
+		{"idex bbs avoidance off", map[string]string{"reduce_crossing_wall": "false"}, []string{"M605 S3"}, "avoid crossing perimeters is disabled, travel moves of IDEX Mirror may knock over the print of the idle nozzle"},
+		{"idex not set", nil, []string{"M605 S2"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body := c.body
+			if body != nil {
+				body = append(body, _moves(20)...)
+			}
+			if err := ParseParams(_fixture(c.settings, body...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestForceVersion(t *testing.T) {
+	defer func() { ForceVersion = -1 }()
+
+	cases := []struct {
+		name     string
+		settings map[string]string
+		body     []string
+		force    int
+		want     int
+		warning  string
+	}{
+		{"a350 detected", nil, nil, -1, 0, ""},
+		{"a350 forced v0", nil, nil, 0, 0, ""},
+		{"a350 forced v1", nil, nil, 1, 1, ""},
+		{"notes v1 forced v0", map[string]string{"printer_notes": "SNAPMAKER_GCODE_V1"}, nil, 0, 0, ""},
+		{"marker v1 forced v0", nil, []string{"; SNAPMAKER_GCODE_V1"}, 0, 0, ""},
+		{"notes v0 forced v1", map[string]string{"printer_notes": "SNAPMAKER_GCODE_V0"}, nil, 1, 1, ""},
+		{"j1 detected", map[string]string{"printer_model": "Snapmaker J1"}, nil, -1, 1, ""},
+		{"j1 forced v1", map[string]string{"printer_model": "Snapmaker J1"}, nil, 1, 1, ""},
+		{"j1 forced v0", map[string]string{"printer_model": "Snapmaker J1"}, nil, 0, 0, "Snapmaker J1 only supports G-code v1, the printer may reject a v0 header"},
+		{"idex forced v0", nil, []string{"M605 S2"}, 0, 0, "Snapmaker J1 only supports G-code v1, the printer may reject a v0 header"},
+		{"idex notes v1 forced v0", map[string]string{"printer_notes": "SNAPMAKER_GCODE_V1"}, []string{"M605 S3"}, 0, 0, "Snapmaker J1 only supports G-code v1, the printer may reject a v0 header"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ForceVersion = c.force
+			body := c.body
+			if body != nil {
+				body = append(body, _moves(20)...)
+			}
+			if err := ParseParams(_fixture(c.settings, body...)); err != nil {
+				t.Fatal(err)
+			}
+			if Params.Version != c.want {
+				t.Errorf("got version %d, want %d", Params.Version, c.want)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestFilamentGcode(t *testing.T) {
+	hooks := `"; Filament gcode\nM104 S215\nM900 K0.02";"; Filament gcode\n"`
+	settings := map[string]string{
+		"printer_model":        "Snapmaker J1",
+		"filament used [mm]":   "0.50, 2.00",
+		"filament used [g]":    "3.00, 1.50",
+		"filament_start_gcode": hooks,
+		"filament_end_gcode":   `"";""`,
+	}
+	body := []string{"M605 S1", "T1"}
+	body = append(body, _moves(20)...)
+	body = append(body,
+		"; CP TOOLCHANGE START",
+		"T0",
+		"M104 S215",
+		"M900 K0.02",
+		"M104 S278",
+		"; CP TOOLCHANGE END",
+		"G1 X10 Y10 E0.5",
+		// the command of a hook without the rest of the hook is not the hook
+		"; CP TOOLCHANGE START",
+		"T1",
+		"M104 S215",
+		"; CP TOOLCHANGE END",
+	)
+
+	gcodes := _fixture(settings, body...)
+	if err := ParseParams(gcodes); err != nil {
+		t.Fatal(err)
+	}
+	if !Params.HasFilamentGcode() {
+		t.Error("expect filament gcode but not")
+	}
+	if want := "; Filament gcode\nM104 S215\nM900 K0.02"; Params.FilamentStartGcode[0] != want {
+		t.Errorf("got %q, want %q", Params.FilamentStartGcode[0], want)
+	}
+	if Params.FilamentStartGcode[1] != "; Filament gcode\n" || Params.FilamentEndGcode[0] != "" {
+		t.Errorf("unexpected hooks: %q %q", Params.FilamentStartGcode, Params.FilamentEndGcode)
+	}
+	if got, want := _warnings(Params.Validate()), "filament_start_gcode of T0 sets temperature (M104 S215), it runs at every tool change and may override pre-heat or shutoff"; got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+
+	result := GcodeFixOrcaToolUnload(gcodes)
+	var got []string
+	for _, g := range result {
+		if len(got) > 0 || g.String() == "; CP TOOLCHANGE START" {
+			got = append(got, g.String())
 		}
-		_ = g.String()
+	}
+	want := []string{
+		"; CP TOOLCHANGE START",
+		"T0",
+		"M104 S215",
+		"M900 K0.02",
+		";(Fixed: remove: M104 S278)",
+		"; CP TOOLCHANGE END",
+		"G1 X10 Y10 E0.5",
+		"; CP TOOLCHANGE START",
+		"T1",
+		";(Fixed: remove: M104 S215)",
+		"; CP TOOLCHANGE END",
+	}
+	if len(got) < len(want) || !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("got %q, want %q", got, want)
 	}
 }
 
-func BenchmarkGcodeAsType(b *testing.B) {
-	g, err := ParseGcode("E-.004")
+func TestManifest(t *testing.T) {
+	settings := map[string]string{
+		"retract_length": "8,0.8",
+		"min_x":          "10",
+		"min_y":          "20",
+		"min_z":          "0.2",
+		"max_x":          "110",
+		"max_y":          "120",
+		"max_z":          "30",
+	}
+	if err := ParseParams(_fixture(settings)); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManifest(Params, Params.Validate())
+	m.Thumbnail = "out.gcode.png"
+	got, err := m.JSON()
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
-	var t float32
-	for i := 0; i < b.N; i++ {
-		err = g.AddrAs(&t)
+	want := `{
+  "schema": 1,
+  "model": "Snapmaker 2.0 A350",
+  "gcode_version": 0,
+  "tool_head": "singleExtruderToolheadForSM2",
+  "print_mode": "Default",
+  "extruders": [
+    {
+      "index": 0,
+      "material": "PLA",
+      "nozzle_diameter_mm": 0.4,
+      "temperature_c": 210,
+      "filament_used_mm": 2,
+      "filament_weight_g": 3
+    }
+  ],
+  "estimated_time_sec": 3984,
+  "filament_used_mm": 2,
+  "filament_weight_g": 3,
+  "bounding_box": {
+    "min": [
+      10,
+      20,
+      0.2
+    ],
+    "max": [
+      110,
+      120,
+      30
+    ]
+  },
+  "lines": 43,
+  "thumbnail": "out.gcode.png",
+  "warnings": [
+    "T0 retraction 8.00mm is out of range 0.0-4.0mm for Snapmaker 2.0 A350"
+  ]
+}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// the thumbnail is embedded as its data uri
+	Params.Thumbnail = []byte("data:image/png;base64,iVBORw0KGgo=")
+	if m = NewManifest(Params, nil); m.ThumbnailURI != string(Params.Thumbnail) || m.ThumbnailType != "image/png" {
+		t.Errorf("got thumbnail %q of %q", m.ThumbnailURI, m.ThumbnailType)
+	}
+}
+
+func TestFirstLayerLineWidth(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		first    float64
+		warning  string
+	}{
+		{"prusa", map[string]string{"extrusion_width": "0.45", "first_layer_extrusion_width": "0.6", "filament_max_volumetric_speed": "12,12"}, 0.6, ""},
+		{"prusa percent", map[string]string{"extrusion_width": "0.45", "first_layer_extrusion_width": "200%", "filament_max_volumetric_speed": "12,12"}, 0.8, "T0 first layer flow 12.8mm3/s exceeds the max volumetric speed 12.0mm3/s"},
+		{"bbs", map[string]string{"line_width": "0.42", "initial_layer_line_width": "0.8", "filament_max_volumetric_speed": "12,12"}, 0.8, "T0 first layer flow 12.8mm3/s exceeds the max volumetric speed 12.0mm3/s"},
+		{"same as steady", map[string]string{"line_width": "0.42", "filament_max_volumetric_speed": "12,12"}, 0.42, ""},
+		{"unlimited", map[string]string{"line_width": "0.42", "initial_layer_line_width": "0.8", "filament_max_volumetric_speed": "0,0"}, 0.8, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if w := Params.EffectiveFirstLayerLineWidth(); w < c.first-0.0001 || w > c.first+0.0001 {
+				t.Errorf("got first layer width %f, want %f", w, c.first)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func _fixtureText(settings map[string]string, body ...string) string {
+	lines := make([]string, 0, 64)
+	for _, g := range _fixture(settings, body...) {
+		lines = append(lines, g.String())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestDetect(t *testing.T) {
+	defer func(w int64) { detectWindow = w }(detectWindow)
+
+	layers := []string{"M605 S2", ";LAYER_CHANGE"}
+	layers = append(layers, _moves(200)...)
+
+	cases := []struct {
+		name string
+		text string
+		want Detection
+	}{
+		{"prusa a350", _fixtureText(nil), Detection{Slicer: "PrusaSlicer", SlicerVersion: "2.7.1", Model: ModelA350, Version: 0, PrintMode: PrintModeDefault}},
+		{"prusa j1 duplication", _fixtureText(map[string]string{"printer_model": "Snapmaker J1"}, layers...), Detection{Slicer: "PrusaSlicer", SlicerVersion: "2.7.1", Model: ModelJ1, Version: 1, PrintMode: PrintModeDuplication}},
+		{"orca a250 v1", strings.Replace(_fixtureText(map[string]string{"printer_model": "", "bed_shape": "0x0,230x0,230x250,0x250", "printer_notes": "SNAPMAKER_GCODE_V1"}), "PrusaSlicer 2.7.1", "OrcaSlicer 1.9.0", 1), Detection{Slicer: "OrcaSlicer", SlicerVersion: "1.9.0", Model: ModelA250, Version: 1, PrintMode: PrintModeDefault}},
+		{"cura", ";Generated with Cura_SteamEngine 5.6.0\n" + _fixtureText(map[string]string{"printer_model": "A150"}), Detection{Slicer: "Cura_SteamEngine", SlicerVersion: "5.6.0", Model: ModelA150, Version: 0, PrintMode: PrintModeDefault}},
+		{"settings only", _fixtureText(map[string]string{"printer_model": "Snapmaker J1"}, "M117 no moves"), Detection{Slicer: "PrusaSlicer", SlicerVersion: "2.7.1", Model: ModelJ1, Version: 1, PrintMode: PrintModeDefault}},
+	}
+	for _, c := range cases {
+		for _, window := range []int64{1 << 20, 1024} {
+			detectWindow = window
+			t.Run(c.name, func(t *testing.T) {
+				for _, r := range []io.Reader{strings.NewReader(c.text), bytes.NewBufferString(c.text)} {
+					d, err := Detect(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if *d != c.want {
+						t.Errorf("window %d, %T: got %+v, want %+v", window, r, *d, c.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		infill   string
+		support  string
+	}{
+		{"prusa", map[string]string{"fill_pattern": "gyroid", "support_material_pattern": "rectilinear-grid"}, PatternGyroid, PatternGrid},
+		{"bbs", map[string]string{"sparse_infill_pattern": "honeycomb", "support_base_pattern": "default"}, PatternHoneycomb, PatternDefault},
+		{"unknown", map[string]string{"sparse_infill_pattern": "CrossHatch"}, "crosshatch", ""},
+		{"missing", nil, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if Params.InfillPattern != c.infill || Params.SupportPattern != c.support {
+				t.Errorf("got %q/%q, want %q/%q", Params.InfillPattern, Params.SupportPattern, c.infill, c.support)
+			}
+		})
+	}
+}
+
+func TestNoPrintableContent(t *testing.T) {
+	cases := map[string][]*GcodeBlock{
+		"empty":        _parseGcodes(""),
+		"comment only": _parseGcodes("; generated by PrusaSlicer 2.7.1\n;\n; nothing here\n"),
+		"header only":  _fixture(nil, "M117 sliced", "M104 S210"),
+	}
+	for name, gcodes := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := ParseParams(gcodes); err != ErrNoPrintable {
+				t.Errorf("got %v, want %v", err, ErrNoPrintable)
+			}
+		})
+	}
+	// the params are resolved all the same
+	if ParseParams(cases["header only"]); Params.Model != ModelA350 {
+		t.Errorf("got model %q, want %q", Params.Model, ModelA350)
+	}
+	if err := ParseParams(_fixture(nil)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBrimEars(t *testing.T) {
+	bounds := map[string]string{"min_x": "2", "min_y": "100", "max_x": "100", "max_y": "200", "brim_width": "5"}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		ears     bool
+		warning  string
+	}{
+		{"no ears", nil, false, "brim of 5.0mm (-3.0,95.0)-(105.0,205.0) may extend beyond the 320x350 bed, check the bed clearance"}, // the full brim crosses the bed edge
+		{"superslicer ears", map[string]string{"brim_ears": "1", "brim_ears_detection_length": "1"}, true, "brim ears (-3.0,95.0)-(105.0,205.0) may extend beyond the 320x350 bed"},
+		{"orca ears", map[string]string{"brim_type": "brim_ears"}, true, "brim ears (-3.0,95.0)-(105.0,205.0) may extend beyond the 320x350 bed"},
+		{"orca ears in bed", map[string]string{"brim_type": "brim_ears", "min_x": "10"}, true, ""},
+		{"orca outer only", map[string]string{"brim_type": "outer_only"}, false, "brim of 5.0mm (-3.0,95.0)-(105.0,205.0) may extend beyond the 320x350 bed, check the bed clearance"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := make(map[string]string)
+			for k, v := range bounds {
+				settings[k] = v
+			}
+			for k, v := range c.settings {
+				settings[k] = v
+			}
+			if err := ParseParams(_fixture(settings)); err != nil {
+				t.Fatal(err)
+			}
+			if Params.BrimEars != c.ears {
+				t.Errorf("got brim ears %v, want %v", Params.BrimEars, c.ears)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestGcodeSetOrigin(t *testing.T) {
+	gcodes := _parseGcodes(`
+M104 S210
+G28 ; home
+G90
+G1 X10 Y10 F3000
+`)
+	want := _parseGcodes(`
+M104 S210
+G28 ; home
+G92 X10 Y20 Z0.5 ;(Fixed: set origin)
+G90
+G1 X10 Y10 F3000
+`)
+	if got := GcodeSetOrigin(10, 20, 0.5)(gcodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	gcodes = _parseGcodes("G1 X10 Y10 F3000")
+	want = _parseGcodes("G92 X0 Y0 Z0 ;(Fixed: set origin)\nG1 X10 Y10 F3000")
+	if got := GcodeSetOrigin(0, 0, 0)(gcodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cases := []struct {
+		model   string
+		x, y, z float64
+		valid   bool
+	}{
+		{"Snapmaker A350", 10, 20, 0.5, true},
+		{"Snapmaker A150", 200, 20, 0, false},
+		{"Snapmaker J1", 10, 20, 0, false},
+	}
+	for _, c := range cases {
+		if err := ParseParams(_fixture(map[string]string{"printer_model": c.model})); err != nil {
+			t.Fatal(err)
+		}
+		if err := Params.ValidateOrigin(c.x, c.y, c.z); (err == nil) != c.valid {
+			t.Errorf("%s: unexpected result %v", c.model, err)
+		}
+	}
+}
+
+func TestResolution(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     float64
+	}{
+		{"prusa", map[string]string{"resolution": "0", "gcode_resolution": "0.0125"}, 0.0125},
+		{"orca", map[string]string{"resolution": "0.012"}, 0.012},
+		{"missing", nil, 0},
+		{"fine", map[string]string{"resolution": "0.005"}, 0.005},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if r := Params.EffectiveResolution(); r != c.want {
+				t.Errorf("got %g, want %g", r, c.want)
+			}
+			if got := _warnings(Params.Validate()); got != "" {
+				t.Errorf("unexpected warnings: %q", got)
+			}
+			Params.TotalLines = largeFileLines + 1
+			want := ""
+			if c.name == "fine" {
+				want = "2000001 lines with 0.005mm gcode resolution, a coarser resolution makes a smaller file"
+			}
+			if got := _warnings(Params.Validate()); got != want {
+				t.Errorf("got warnings %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestComputedFilamentUsed(t *testing.T) {
+	defer func() { RecomputeFilament = false }()
+
+	absolute := []string{
+		"M82",
+		"G92 E0",
+		"G1 X10 Y10 E10 F1200",
+		"G1 X20 Y10 E20",
+		"G1 E19.2 F2100 ; retract",
+		"G0 X30 Y30",
+		"G1 E20 F2100 ; unretract",
+		"G1 X40 Y40 E30.5",
+		"G92 E0",
+		"T1",
+		"G1 X10 Y10 E5",
+	}
+	relative := []string{
+		"M83",
+		"G1 X10 Y10 E10 F1200",
+		"G1 X20 Y10 E10",
+		"G1 E-0.8 F2100",
+		"G0 X30 Y30",
+		"G1 E0.8 F2100",
+		"G1 X40 Y40 E10.5",
+		"T1",
+		"G2 X10 Y10 I5 J5 E5",
+	}
+	for i := 0; i < 20; i++ {
+		absolute = append(absolute, ";")
+		relative = append(relative, ";")
+	}
+
+	cases := []struct {
+		name     string
+		body     []string
+		reported string
+		want     []float64
+		warning  string
+	}{
+		{"absolute", absolute, "30.5,5", []float64{30.5, 5}, ""},
+		{"relative", relative, "30.6,5", []float64{30.6, 5}, ""},
+		{"discrepancy", relative, "50,5", []float64{50, 5}, "T0 filament used 50.00mm differs from 30.50mm extruded by the moves"},
+		{"missing", relative, "", []float64{30.5, 5}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(map[string]string{"filament used [mm]": c.reported}, c.body...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := Params.ComputedFilamentUsed; math.Abs(got[0]-30.5) > 0.001 || math.Abs(got[1]-5) > 0.001 {
+				t.Errorf("got computed %v", got)
+			}
+			if got := Params.FilamentUsed; math.Abs(got[0]-c.want[0]) > 0.001 || math.Abs(got[1]-c.want[1]) > 0.001 {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+
+	RecomputeFilament = true
+	if err := ParseParams(_fixture(map[string]string{"filament used [mm]": "50,5"}, relative...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := Params.FilamentUsed[0]; math.Abs(got-30.5) > 0.001 {
+		t.Errorf("got %v, want recomputed", got)
+	}
+}
+
+func TestSurfacePatterns(t *testing.T) {
+	cases := []struct {
+		name               string
+		settings           map[string]string
+		top, bottom, solid string
+	}{
+		{"superslicer", map[string]string{"top_fill_pattern": "monotonic", "bottom_fill_pattern": "concentric", "solid_fill_pattern": "rectilinear"}, PatternMonotonic, PatternConcentric, PatternRectilinear},
+		{"bbs", map[string]string{"top_surface_pattern": "monotonicline", "bottom_surface_pattern": "monotonic", "internal_solid_infill_pattern": "zig-zag"}, PatternMonotonicLine, PatternMonotonic, PatternZigZag},
+		{"missing", nil, "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if Params.TopPattern != c.top || Params.BottomPattern != c.bottom || Params.SolidInfillPattern != c.solid {
+				t.Errorf("got %q/%q/%q, want %q/%q/%q", Params.TopPattern, Params.BottomPattern, Params.SolidInfillPattern, c.top, c.bottom, c.solid)
+			}
+			m := NewManifest(Params, nil)
+			if m.TopPattern != c.top || m.BottomPattern != c.bottom || m.SolidPattern != c.solid {
+				t.Errorf("unexpected manifest: %+v", m)
+			}
+		})
+	}
+}
+
+func TestAllowJ1V0(t *testing.T) {
+	defer func() { AllowJ1V0 = false }()
+
+	const j1V0 = "Snapmaker J1 only supports G-code v1, the printer may reject a v0 header"
+	idex := []string{"M605 S2"}
+	idex = append(idex, _moves(20)...)
+	cases := []struct {
+		name     string
+		allow    bool
+		settings map[string]string
+		body     []string
+		want     int
+		warning  string
+	}{
+		{"j1", false, map[string]string{"printer_model": "Snapmaker J1"}, nil, 1, ""},
+		{"j1 allowed", true, map[string]string{"printer_model": "Snapmaker J1"}, nil, 0, j1V0},
+		{"j1 allowed with v1 notes", true, map[string]string{"printer_model": "Snapmaker J1", "printer_notes": "SNAPMAKER_GCODE_V1"}, nil, 1, ""},
+		{"idex allowed", true, nil, idex, 0, j1V0},
+		{"a350 allowed", true, nil, nil, 0, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			AllowJ1V0 = c.allow
+			if err := ParseParams(_fixture(c.settings, c.body...)); err != nil {
+				t.Fatal(err)
+			}
+			if Params.Version != c.want {
+				t.Errorf("got version %d, want %d", Params.Version, c.want)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestThinFeatures(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		feature  float64
+		bead     float64
+		warning  string
+	}{
+		{"prusa defaults", map[string]string{"perimeter_generator": "arachne", "min_feature_size": "25%", "min_bead_width": "85%"}, 0.1, 0.34, ""},
+		{"bbs small features", map[string]string{"wall_generator": "arachne", "min_feature_size": "0.02", "min_bead_width": "0.15"}, 0.02, 0.15, "min feature size 0.020mm is too small for the 0.4mm nozzle\nmin bead width 0.150mm is too thin for the 0.4mm nozzle, thin features may under-extrude"},
+		{"classic", map[string]string{"perimeter_generator": "classic", "min_feature_size": "0.02", "min_bead_width": "0.15"}, 0.02, 0.15, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(Params.MinFeatureSize-c.feature) > 0.0001 || math.Abs(Params.MinBeadWidth-c.bead) > 0.0001 {
+				t.Errorf("got %g/%g, want %g/%g", Params.MinFeatureSize, Params.MinBeadWidth, c.feature, c.bead)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestMirrorTree(t *testing.T) {
+	root, outDir := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"a.gcode":          _fixtureText(nil),
+		"sub/b.gcode":      _fixtureText(nil),
+		"sub/deep/c.GCODE": _fixtureText(nil),
+		"sub/fixed.gcode":  Mark + "\n" + _fixtureText(nil),
+		"sub/notes.txt":    "not a gcode",
+		"done/d.gcode":     _fixtureText(nil),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// already processed
+	if err := os.MkdirAll(filepath.Join(outDir, "done"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "done/d.gcode"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := func(in, out string) error {
+		f, err := os.Open(in)
 		if err != nil {
-			b.Fatal(err)
+			return err
 		}
-		_ = t
+		defer f.Close()
+		gcodes, err := ReadGcodes(f)
+		if err != nil {
+			return err
+		}
+		headers, err := ExtractHeader(gcodes)
+		if err != nil {
+			return err
+		}
+		w, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		return WriteGcodes(w, headers, gcodes)
+	}
+	processed, skipped, err := MirrorTree(root, outDir, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processed) != 3 || len(skipped) != 2 {
+		t.Errorf("processed %v, skipped %v", processed, skipped)
+	}
+	for _, name := range []string{"a.gcode", "sub/b.gcode", "sub/deep/c.GCODE"} {
+		data, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.HasPrefix(data, []byte(Mark)) {
+			t.Errorf("%s is not fixed", name)
+		}
+	}
+	for _, name := range []string{"sub/fixed.gcode", "sub/notes.txt"} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not be written: %v", name, err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(outDir, "done/d.gcode")); len(data) != 0 {
+		t.Error("already processed file is overwritten")
+	}
+
+	// everything is processed now
+	processed, skipped, err = MirrorTree(root, outDir, fn)
+	if err != nil || len(processed) != 0 || len(skipped) != 5 {
+		t.Errorf("processed %v, skipped %v, err %v", processed, skipped, err)
 	}
 }
 
-func BenchmarkToolNum(b *testing.B) {
-	g, err := ParseGcodeBlock("M104 S255 T1 ; tool T2")
+func TestProcessDir(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"notes.txt":       "not a gcode",
+		"sub/fixed.gcode": Mark + "\n" + _fixtureText(nil),
+		"sub/empty.gcode": "",
+	}
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("sub/%d.gcode", i)] = _fixtureText(map[string]string{"max_print_speed": strconv.Itoa(50 + i)})
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each file is fixed in place with its own params
+	fn := func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		gcodes, err := ReadGcodes(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		parsed, err := NewParsedGcode(gcodes)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := parsed.Write(&b); err != nil {
+			return err
+		}
+		return os.WriteFile(path, b.Bytes(), 0644)
+	}
+	r, err := ProcessDir(root, fn)
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
-	for i := 0; i < b.N; i++ {
-		if t, err := g.GetToolNum(); err == nil {
-			if t != 1 {
-				b.Fatalf("got %d, want %d", t, 1)
+	if got := r.String(); got != "8 fixed, 1 skipped, 1 failed" {
+		t.Errorf("got %s: %v", got, r.Err())
+	}
+	if err := r.Err(); err == nil || !errors.Is(err, ErrNoPrintable) || !strings.Contains(err.Error(), "empty.gcode") {
+		t.Errorf("got %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		data, err := os.ReadFile(filepath.Join(root, fmt.Sprintf("sub/%d.gcode", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf(";work_speed(mm/minute): %d\n", (50+i)*60); !bytes.Contains(data, []byte(want)) {
+			t.Errorf("%d.gcode has no %q", i, want)
+		}
+	}
+
+	// everything is fixed now
+	if r, err = ProcessDir(root, fn); err != nil || len(r.Skipped) != 9 {
+		t.Errorf("got %v, %v", r, err)
+	}
+}
+
+func TestLinearizeArcs(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		fitting  bool
+		want     float64
+	}{
+		{"orca", map[string]string{"enable_arc_fitting": "1", "resolution": "0.012"}, true, 0.012},
+		{"prusa", map[string]string{"arc_fitting": "emit_center", "gcode_resolution": "0.0125"}, true, 0.0125},
+		{"prusa disabled", map[string]string{"arc_fitting": "disabled"}, false, 0},
+		{"tolerance", map[string]string{"arc_fitting": "emit_center", "arc_fitting_tolerance": "5%"}, true, 0.02},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
 			}
-		} else {
+			if Params.ArcFitting != c.fitting {
+				t.Errorf("ArcFitting: got %v, want %v", Params.ArcFitting, c.fitting)
+			}
+			if r := Params.EffectiveArcTolerance(); math.Abs(r-c.want) > 1e-9 {
+				t.Errorf("got %g, want %g", r, c.want)
+			}
+			if c.fitting && Params.ValidateArcTolerance(c.want*2) == nil {
+				t.Error("expected a warning for a coarser tolerance")
+			}
+			if Params.ValidateArcTolerance(c.want) != nil {
+				t.Error("unexpected warning for the same tolerance")
+			}
+		})
+	}
+
+	arcs := []struct {
+		name  string
+		lines []string
+		end   [2]float32
+		e     float64
+	}{
+		{"ccw ij", []string{"G90", "M83", "G1 X10 Y0", "G3 X0 Y10 I-10 J0 E2 F1200"}, [2]float32{0, 10}, 2},
+		{"cw r", []string{"G90", "M83", "G1 X0 Y10", "G2 X10 Y0 R10 E2"}, [2]float32{10, 0}, 2},
+		{"absolute e", []string{"G90", "M82", "G92 E5", "G1 X10 Y0", "G3 X0 Y10 I-10 J0 E7"}, [2]float32{0, 10}, 7},
+	}
+	for _, c := range arcs {
+		t.Run(c.name, func(t *testing.T) {
+			const tolerance = 0.01
+			gcodes := GcodeLinearizeArcs(tolerance)(_parseGcodes(strings.Join(c.lines, "\n")))
+
+			var segments []*GcodeBlock
+			for _, g := range gcodes {
+				if g.Is("G2") || g.Is("G3") {
+					t.Fatalf("arc is not linearized: %s", g)
+				}
+				if g.InComment("linearized") || len(segments) > 0 {
+					segments = append(segments, g)
+				}
+			}
+			// 2*acos(1-0.01/10) per segment for a quarter circle
+			if len(segments) != 18 {
+				t.Errorf("got %d segments", len(segments))
+			}
+			var x, y, e float32
+			for _, g := range segments {
+				g.GetParam('X', &x)
+				g.GetParam('Y', &y)
+				if r := math.Hypot(float64(x), float64(y)); math.Abs(r-10) > 0.001 {
+					t.Errorf("%s is off the arc by %g", g, r-10)
+				}
+				var v float32
+				g.GetParam('E', &v)
+				if strings.Contains(c.name, "absolute") {
+					e = v
+				} else {
+					e += v
+				}
+			}
+			if [2]float32{x, y} != c.end {
+				t.Errorf("ends at %g,%g, want %v", x, y, c.end)
+			}
+			if math.Abs(float64(e)-c.e) > 0.001 {
+				t.Errorf("E: got %g, want %g", e, c.e)
+			}
+			var f int
+			if segments[0].GetParam('F', &f); strings.Contains(c.name, "ij") && f != 1200 {
+				t.Errorf("F: got %d", f)
+			}
+		})
+	}
+}
+
+func TestParsedGcode(t *testing.T) {
+	body := []string{
+		"; thumbnail begin 2x2 40",
+		"; iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC",
+		"; thumbnail end",
+		"M104 S210",
+		";LAYER_CHANGE",
+		";Z:0.2",
+		"G1 X10 Y10 E0.5 F1200",
+		"G1 X20 Y10 E0.5",
+		";LAYER_CHANGE",
+		";Z:0.4",
+		"G1 X10 Y10 E0.5",
+		";LAYER_CHANGE",
+		";Z:0.6",
+		"G1 X20 Y10 E0.5",
+	}
+	gcodes := _fixture(nil, body...)
+	parsed, err := NewParsedGcode(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first, last := string(parsed.Header[1]), string(parsed.Header[len(parsed.Header)-1]); first != ";Header Start" || !strings.HasPrefix(last, ";Header End") {
+		t.Errorf("header bounds: %q - %q", first, last)
+	}
+	if len(parsed.Body) != len(gcodes) {
+		t.Errorf("body: got %d lines, want %d", len(parsed.Body), len(gcodes))
+	}
+
+	if len(parsed.Thumbnail) != 3 {
+		t.Fatalf("thumbnail: got %d lines", len(parsed.Thumbnail))
+	}
+	if !strings.HasPrefix(parsed.Thumbnail[0].String(), "; thumbnail begin") || parsed.Thumbnail[2].String() != "; thumbnail end" {
+		t.Errorf("thumbnail bounds: %s - %s", parsed.Thumbnail[0], parsed.Thumbnail[2])
+	}
+
+	if len(parsed.Layers) != 3 {
+		t.Fatalf("got %d layers", len(parsed.Layers))
+	}
+	for i, want := range []int{4, 3, 3} {
+		layer := parsed.Layers[i]
+		if i == len(parsed.Layers)-1 {
+			// the last layer runs to the end of the file with the end gcode and config
+			if len(layer) < want {
+				t.Errorf("layer %d: got %d lines", i, len(layer))
+			}
+		} else if len(layer) != want {
+			t.Errorf("layer %d: got %d lines, want %d", i, len(layer), want)
+		}
+		if layer[0].String() != ";LAYER_CHANGE" || layer[1].String() != fmt.Sprintf(";Z:%.1f", 0.2*float64(i+1)) {
+			t.Errorf("layer %d starts with %s %s", i, layer[0], layer[1])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := parsed.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	WriteGcodes(&want, parsed.Header, gcodes)
+	if buf.String() != want.String() {
+		t.Error("Write differs from WriteGcodes")
+	}
+}
+
+func TestRamming(t *testing.T) {
+	ramming := `"120 100 4 4 4 4| 0.05 4 0.45 4";"120 100 8 8| 0.05 8"`
+	body := []string{
+		"G1 X10 Y10 E1 F1200",
+		"T1",
+		"G1 X10 Y10 E1",
+		"T0",
+		"G1 X10 Y10 E1",
+		"T1",
+		"G1 X10 Y10 E1",
+	}
+	settings := map[string]string{
+		"filament used [mm]":          "2.00, 2.00",
+		"filament_ramming_parameters": ramming,
+		"filament_diameter":           "1.75,1.75",
+	}
+
+	if err := ParseParams(_fixture(settings, body...)); err != nil {
+		t.Fatal(err)
+	}
+	single := Params.EstimatedTimeSec
+	if sec := Params.RammingTimeSec(); sec != 0 {
+		t.Errorf("single material ramming time: got %g", sec)
+	}
+
+	settings["single_extruder_multi_material"] = "1"
+	if err := ParseParams(_fixture(settings, body...)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(Params.ToolChanges, []int{2, 1}) || !Params.ChangesTools() {
+		t.Errorf("tool changes: got %v", Params.ToolChanges)
+	}
+	if _params(t, nil).ChangesTools() {
+		t.Error("tool changes without T1")
+	}
+	// T0 rams 1s and 4mm3 twice, T1 0.5s and 4mm3 once
+	if sec := Params.RammingTimeSec(); sec != 2.5 {
+		t.Errorf("ramming time: got %g, want 2.5", sec)
+	}
+	if Params.EstimatedTimeSec != single+3 {
+		t.Errorf("estimated time: got %d, want %d", Params.EstimatedTimeSec, single+3)
+	}
+	area := math.Pi * 1.75 * 1.75 / 4
+	waste := Params.RammingWaste()
+	if math.Abs(waste[0]-8/area) > 1e-9 || math.Abs(waste[1]-4/area) > 1e-9 {
+		t.Errorf("waste: got %v", waste)
+	}
+	m := NewManifest(Params, nil)
+	if m.RammingTime != 3 || math.Abs(m.FilamentWaste-12/area) > 1e-9 {
+		t.Errorf("manifest: got %ds, %gmm", m.RammingTime, m.FilamentWaste)
+	}
+}
+
+func TestValidateMaterials(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		allowed  []string
+		wantErr  string
+	}{
+		{"allowed", nil, []string{"PLA", "PETG"}, ""},
+		{"case", map[string]string{"filament_type": "petg;PETG"}, []string{"pla", "petg"}, ""},
+		{"disallowed", map[string]string{"filament_type": "ABS;PLA"}, []string{"PLA", "PETG"}, `T0 material "ABS" is not allowed, allowed materials: PLA, PETG`},
+		{"unused extruder", map[string]string{"filament_type": "PLA;ABS"}, []string{"PLA"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			err := Params.ValidateMaterials(c.allowed)
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			} else if err == nil || err.Error() != c.wantErr {
+				t.Errorf("got %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestWallSettings(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     string
+	}{
+		{"prusa", map[string]string{"perimeters": "3", "perimeter_generator": "arachne", "wall_distribution_count": "1", "seam_position": "aligned"},
+			`{"generator":"arachne","loops":3,"distribution_count":1,"seam_position":"aligned"}`},
+		{"orca", map[string]string{"wall_loops": "2", "wall_generator": "classic", "seam_position": "back"},
+			`{"generator":"classic","loops":2,"seam_position":"back"}`},
+		{"vase", map[string]string{"perimeters": "0"}, `{"loops":0}`},
+		{"missing", nil, `null`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(NewManifest(Params, nil).Walls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestGcodeClampZ(t *testing.T) {
+	body := []string{
+		"G1 Z0.2 F600",
+		"G1 X10 Y10 E1 F1200",
+		"G1 Z9999 F600",
+		"G1 X20 Y10 E1",
+		"G91",
+		"G1 Z9999",
+		"G90",
+		"G1 Z303",
+	}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		maxZ     float64
+	}{
+		{"prusa", map[string]string{"max_print_height": "300"}, 300},
+		{"orca", map[string]string{"printable_height": "250"}, 250},
+		{"build volume", nil, 330},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gcodes := _fixture(c.settings, body...)
+			if err := ParseParams(gcodes); err != nil {
+				t.Fatal(err)
+			}
+			if z := Params.SafeMaxZ(); z != c.maxZ {
+				t.Fatalf("SafeMaxZ: got %g, want %g", z, c.maxZ)
+			}
+
+			var logs []string
+			gcodes = GcodeClampZ(Params.SafeMaxZ(), func(format string, v ...any) {
+				logs = append(logs, fmt.Sprintf(format, v...))
+			})(gcodes)
+
+			var zs []string
+			for _, g := range gcodes {
+				var z string
+				if g.GetParam('Z', &z) == nil {
+					zs = append(zs, z)
+				}
+			}
+			// relative moves are kept, 303 is within the margin of 300
+			want := []string{"0.2", fmt.Sprintf("%.3f", c.maxZ), "9999", "303"}
+			if c.maxZ+ClampZMargin < 303 {
+				want[3] = fmt.Sprintf("%.3f", c.maxZ)
+			}
+			if !reflect.DeepEqual(zs[:4], want) {
+				t.Errorf("got %v, want %v", zs[:4], want)
+			}
+			clamped := 0
+			for _, z := range want {
+				if z == fmt.Sprintf("%.3f", c.maxZ) {
+					clamped++
+				}
+			}
+			if len(logs) != clamped {
+				t.Errorf("got %d logs, want %d: %v", len(logs), clamped, logs)
+			}
+		})
+	}
+}
+
+func TestSupportInterface(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     string
+	}{
+		{"prusa", map[string]string{"support_material_interface_layers": "3", "support_material_interface_pattern": "rectilinear", "support_material_interface_spacing": "0.2", "interface_shells": "1"},
+			`{"layers":3,"pattern":"rectilinear","spacing_mm":0.2,"interface_shells":true}`},
+		{"orca", map[string]string{"support_interface_top_layers": "2", "support_interface_pattern": "concentric", "support_interface_spacing": "0"},
+			`{"layers":2,"pattern":"concentric","spacing_mm":0}`},
+		{"missing", nil, `null`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(NewManifest(Params, nil).Interface)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	defer func() { ForceVersion = -1 }()
+
+	for _, version := range []int{0, 1} {
+		ForceVersion = version
+		headers, err := ExtractHeader(_fixture(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateHeader(version, headers); err != nil {
+			t.Errorf("v%d: %s", version, err)
+		}
+		if err := ValidateHeader(1-version, headers); err == nil {
+			t.Errorf("v%d header is valid as v%d", version, 1-version)
+		}
+
+		replace := func(prefix, line string) [][]byte {
+			x := [][]byte{}
+			for _, h := range headers {
+				if !strings.HasPrefix(string(h), prefix) {
+					x = append(x, h)
+				} else if line != "" {
+					x = append(x, []byte(line))
+				}
+			}
+			return x
+		}
+		cases := map[int][]struct {
+			prefix, line, wantErr string
+		}{
+			0: {
+				{";machine:", "", `header field "machine" is missing`},
+				{";machine:", ";machine: Snapmaker 3.0", `header field "machine" has an unknown value "Snapmaker 3.0"`},
+				{";nozzle_temperature", ";nozzle_temperature(°C): 450", `header field "nozzle_temperature(°C)" is out of range 0-350: 450`},
+				{";file_total_lines:", ";file_total_lines: many", `header field "file_total_lines" is not a number: "many"`},
+				{";tool_head:", ";tool_head: " + strings.Repeat("x", maxHeaderLine),
+					"header line is longer than 255: ;tool_head: xxxxxxxxxxxxxxxxxxxx...\n" +
+						`header field "tool_head" has an unknown value "` + strings.Repeat("x", maxHeaderLine) + `"`},
+			},
+			1: {
+				{";Lines:", "", `header field "Lines" is missing`},
+				{";Extruder Mode:", ";Extruder Mode:IDEX", `header field "Extruder Mode" has an unknown value "IDEX"`},
+				{";Bed Temperature:", ";Bed Temperature:200", `header field "Bed Temperature" is out of range -1-150: 200`},
+				{";Extruder(s) Used:", ";Extruder(s) Used:3", `header field "Extruder(s) Used" is out of range 1-2: 3`},
+			},
+		}
+		for _, c := range cases[version] {
+			err := ValidateHeader(version, replace(c.prefix, c.line))
+			if err == nil || err.Error() != c.wantErr {
+				t.Errorf("v%d %q: got %v, want %q", version, c.line, err, c.wantErr)
+			}
+		}
+	}
+}
+
+func TestSkirt(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		layers   int
+		margin   float64
+	}{
+		{"prusa", map[string]string{"skirts": "2", "skirt_height": "3", "skirt_distance": "6", "first_layer_extrusion_width": "0.5"}, 3, 7},
+		{"orca", map[string]string{"skirt_loops": "1", "skirt_height": "60", "skirt_distance": "2", "initial_layer_line_width": "0.42"}, 50, 2.42},
+		{"draft shield", map[string]string{"skirts": "1", "skirt_height": "1", "draft_shield": "enabled"}, 50, 0.4},
+		{"limited draft shield", map[string]string{"skirts": "1", "skirt_height": "4", "draft_shield": "limited"}, 4, 0.4},
+		{"no skirt", map[string]string{"skirts": "0", "skirt_height": "3", "skirt_distance": "6"}, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := map[string]string{"total_layer_number": "50", "min_x": "100", "min_y": "100", "max_x": "200", "max_y": "200"}
+			for k, v := range c.settings {
+				settings[k] = v
+			}
+			if err := ParseParams(_fixture(settings)); err != nil {
+				t.Fatal(err)
+			}
+			if layers := Params.SkirtLayers(); layers != c.layers {
+				t.Errorf("got %d layers, want %d", layers, c.layers)
+			}
+			minX, minY, maxX, maxY := Params.FootprintBounds()
+			for i, v := range []float64{100 - minX, 100 - minY, maxX - 200, maxY - 200} {
+				if math.Abs(v-c.margin) > 1e-9 {
+					t.Errorf("bound %d: got margin %g, want %g", i, v, c.margin)
+				}
+			}
+		})
+	}
+}
+
+func TestLubanComments(t *testing.T) {
+	defer func() { ForceVersion, LubanComments = -1, false }()
+
+	thumbnail := []string{
+		"; thumbnail begin 2x2 40",
+		"; iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC",
+		"; thumbnail end",
+	}
+	body := append(thumbnail, strings.Split(strings.Repeat("G1 X10 Y10 E0.1 F1200\n", 20), "\n")...)
+	golden := map[int]string{
+		0: `;renderMethod: line`,
+		1: `;renderMethod: line
+;header_type: 3dp
+;estimated_time(s): 3984
+;nozzle_temperature(°C): 210
+;build_plate_temperature(°C): 60
+;layer_height: 0.20
+;matierial_weight: 3.0000
+;matierial_length: 0.00200
+;thumbnail: data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC`,
+	}
+	linesField := map[int]string{0: ";file_total_lines: ", 1: ";Lines:"}
+
+	for _, version := range []int{0, 1} {
+		ForceVersion = version
+		gcodes := _fixture(nil, body...)
+
+		LubanComments = false
+		firmware, err := ExtractHeader(gcodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		LubanComments = true
+		luban, err := ExtractHeader(gcodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := strings.Split(golden[version], "\n")
+		if len(luban) != len(firmware)+len(want) {
+			t.Fatalf("v%d: got %d lines, want %d", version, len(luban), len(firmware)+len(want))
+		}
+		var got []string
+		for _, h := range luban[len(luban)-1-len(want) : len(luban)-1] {
+			got = append(got, string(h))
+		}
+		if strings.Join(got, "\n") != golden[version] {
+			t.Errorf("v%d: got\n%s\nwant\n%s", version, strings.Join(got, "\n"), golden[version])
+		}
+
+		// the firmware header is kept, only the line count includes the comments
+		var lines [2]int
+		for i, h := range [][][]byte{firmware, luban} {
+			for _, line := range h {
+				if v, ok := strings.CutPrefix(string(line), linesField[version]); ok {
+					lines[i], _ = strconv.Atoi(v)
+				}
+			}
+		}
+		if lines[1]-lines[0] != len(want) {
+			t.Errorf("v%d: line count %d, want %d", version, lines[1], lines[0]+len(want))
+		}
+		if err := ValidateHeader(version, luban); err != nil {
+			t.Errorf("v%d: %s", version, err)
+		}
+	}
+}
+
+func TestGcodeSetAcceleration(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     string
+	}{
+		{"both", map[string]string{"default_acceleration": "1500", "travel_acceleration": "3000"}, "M204 P1500 T3000 ;(Fixed: acceleration)"},
+		{"print only", map[string]string{"default_acceleration": "1000"}, "M204 P1000 T1000 ;(Fixed: acceleration)"},
+		{"travel only", map[string]string{"travel_acceleration": "2000"}, "M204 P2000 T2000 ;(Fixed: acceleration)"},
+		{"walls only", map[string]string{"outer_wall_acceleration": "500", "inner_wall_acceleration": "1000"}, "M204 P500 T500 ;(Fixed: acceleration)"},
+		{"default over walls", map[string]string{"default_acceleration": "1500", "outer_wall_acceleration": "500"}, "M204 P1500 T1500 ;(Fixed: acceleration)"},
+		{"missing", nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gcodes := _fixture(c.settings)
+			if err := ParseParams(gcodes); err != nil {
+				t.Fatal(err)
+			}
+			gcodes = GcodeSetAcceleration(Params.EffectiveAcceleration(), Params.TravelAcceleration)(gcodes)
+
+			want := []string{"G28", "G90"}
+			if c.want != "" {
+				want = []string{"G28", c.want, "G90"}
+			}
+			var got []string
+			for i, g := range gcodes {
+				if g.Is("G28") {
+					for _, g := range gcodes[i : i+len(want)] {
+						got = append(got, g.String())
+					}
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLayerIndex(t *testing.T) {
+	body := []string{
+		"M104 S210",
+		";LAYER_CHANGE",
+		";Z:0.2",
+		";TYPE:Skirt/Brim",
+		"G1 X10 Y10 E0.5 F1200",
+		";TYPE:External perimeter",
+		"G1 X20 Y10 E0.5",
+		";LAYER_CHANGE",
+		";Z:0.4",
+		";TYPE:Solid infill",
+		"G1 X10 Y10 E0.5",
+		"; CHANGE_LAYER",
+		"; Z_HEIGHT: 0.6",
+		"; FEATURE: Outer wall",
+		"G1 X20 Y10 E0.5",
+		";LAYER:3",
+		"G1 Z0.8",
+		"G1 X10 Y10 E0",
+	}
+	gcodes := _fixture(nil, body...)
+	parsed, err := NewParsedGcode(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := parsed.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.String()
+
+	index := parsed.LayerIndex()
+	if len(index) != 4 {
+		t.Fatalf("got %d layers", len(index))
+	}
+	wantZ := []float64{0.2, 0.4, 0.6, 0.8}
+	wantFeatures := [][]string{{"Skirt/Brim", "External perimeter"}, {"Solid infill"}, {"Outer wall"}, nil}
+	for i, layer := range index {
+		if parsed.Body[layer.Line] != parsed.Layers[i][0] {
+			t.Errorf("layer %d: line %d is not the layer change", i, layer.Line)
+		}
+		if want := parsed.Layers[i][0].String() + "\n"; !strings.HasPrefix(file[layer.Offset:], want) {
+			t.Errorf("layer %d: offset %d starts with %.20q, want %q", i, layer.Offset, file[layer.Offset:], want)
+		}
+		if math.Abs(layer.Z-wantZ[i]) > 1e-6 {
+			t.Errorf("layer %d: got Z %g, want %g", i, layer.Z, wantZ[i])
+		}
+		var features []string
+		for _, f := range layer.Features {
+			features = append(features, f.Type)
+			if line := parsed.Body[f.Line].String() + "\n"; !strings.HasPrefix(file[f.Offset:], line) {
+				t.Errorf("layer %d feature %s: offset %d starts with %.20q", i, f.Type, f.Offset, file[f.Offset:])
+			}
+		}
+		if !reflect.DeepEqual(features, wantFeatures[i]) {
+			t.Errorf("layer %d: got features %q, want %q", i, features, wantFeatures[i])
+		}
+	}
+}
+
+func TestPurgeWaste(t *testing.T) {
+	body := []string{
+		"G1 X10 Y10 E1 F1200",
+		"T1",
+		"G1 X10 Y10 E1",
+		"T0",
+		"G1 X10 Y10 E1",
+		"T1",
+		"G1 X10 Y10 E1",
+	}
+	area := math.Pi * 1.75 * 1.75 / 4
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     []float64 // mm3
+	}{
+		{"no wipe tower", map[string]string{"wiping_volumes_matrix": "0,70,70,0"}, []float64{0, 0}},
+		{"matrix", map[string]string{"wipe_tower": "1", "wiping_volumes_matrix": "0,70,50,0", "filament_minimal_purge_on_wipe_tower": "15,15"}, []float64{50, 140}},
+		{"minimal purge", map[string]string{"wipe_tower": "1", "wiping_volumes_matrix": "0,70,50,0", "filament_minimal_purge_on_wipe_tower": "60,100"}, []float64{60, 200}},
+		{"orca", map[string]string{"enable_prime_tower": "1", "flush_volumes_matrix": "0,70,50,0", "filament_minimal_purge_on_wipe_tower": "60,15"}, []float64{60, 140}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := map[string]string{"filament used [mm]": "2.00, 2.00", "filament_diameter": "1.75,1.75"}
+			for k, v := range c.settings {
+				settings[k] = v
+			}
+			if err := ParseParams(_fixture(settings, body...)); err != nil {
+				t.Fatal(err)
+			}
+			waste := Params.PurgeWaste()
+			for i := range waste {
+				if math.Abs(waste[i]-c.want[i]/area) > 1e-9 {
+					t.Errorf("T%d: got %gmm, want %gmm", i, waste[i], c.want[i]/area)
+				}
+			}
+			if m := NewManifest(Params, nil); math.Abs(m.FilamentWaste-(c.want[0]+c.want[1])/area) > 1e-9 {
+				t.Errorf("manifest: got %gmm", m.FilamentWaste)
+			}
+		})
+	}
+
+	// single material never switches
+	if err := ParseParams(_fixture(map[string]string{"wipe_tower": "1", "filament_minimal_purge_on_wipe_tower": "60,60"})); err != nil {
+		t.Fatal(err)
+	}
+	if waste := Params.PurgeWaste(); waste[0] != 0 || waste[1] != 0 {
+		t.Errorf("single material: got %v", waste)
+	}
+}
+
+func TestValidateTemperatures(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		wantErr  string
+	}{
+		{"celsius", nil, ""},
+		{"fahrenheit nozzle", map[string]string{"first_layer_temperature": "410,210"}, "T0 nozzle temperature 410°C is above 350°C, is it 410°F (210°C)?"},
+		{"fahrenheit bed", map[string]string{"first_layer_bed_temperature": "400,60"}, "T0 bed temperature 400°C is above 150°C, is it 400°F (204°C)?"},
+		{"unused extruder", map[string]string{"first_layer_temperature": "210,410"}, ""},
+		{"high temperature", map[string]string{"first_layer_temperature": "320,320", "first_layer_bed_temperature": "130,130"}, ""},
+		{"orca", map[string]string{"first_layer_temperature": "", "nozzle_temperature_initial_layer": "480,480"}, "T0 nozzle temperature 480°C is above 350°C, is it 480°F (249°C)?"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gcodes := _fixture(c.settings)
+			if err := ParseParams(gcodes); err != nil {
+				t.Fatal(err)
+			}
+			err := Params.ValidateTemperatures()
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				// the header takes what passes the check
+				if err := ValidateHeader(Params.Version, Params.Header(gcodes)); err != nil {
+					t.Errorf("invalid header: %s", err)
+				}
+			} else if err == nil || err.Error() != c.wantErr {
+				t.Errorf("got %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestSpeeds(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     map[string]float64
+		print    float64
+	}{
+		{"prusa", map[string]string{
+			"perimeter_speed": "60", "external_perimeter_speed": "50%", "infill_speed": "100",
+			"solid_infill_speed": "80%", "top_solid_infill_speed": "50%", "bridge_speed": "30",
+			"support_material_speed": "60", "first_layer_speed": "50%", "travel_speed": "150",
+		}, map[string]float64{
+			SpeedPerimeter: 60, SpeedExternalPerimeter: 30, SpeedSparseInfill: 100,
+			SpeedSolidInfill: 80, SpeedTopSolidInfill: 40, SpeedBridge: 30,
+			SpeedSupport: 60, SpeedTravel: 150,
+		}, 80},
+		{"bambu", map[string]string{
+			"max_print_speed": "", "inner_wall_speed": "150", "outer_wall_speed": "120", "sparse_infill_speed": "270",
+			"internal_solid_infill_speed": "250", "top_surface_speed": "200", "bridge_speed": "50",
+			"support_speed": "150", "initial_layer_speed": "50", "travel_speed": "500",
+		}, map[string]float64{
+			SpeedPerimeter: 150, SpeedExternalPerimeter: 120, SpeedSparseInfill: 270,
+			SpeedSolidInfill: 250, SpeedTopSolidInfill: 200, SpeedBridge: 50,
+			SpeedSupport: 150, SpeedFirstLayer: 50, SpeedTravel: 500,
+		}, 120},
+		{"missing", nil, map[string]float64{}, 80},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(Params.Speeds, c.want) {
+				t.Errorf("got %v, want %v", Params.Speeds, c.want)
+			}
+			if Params.PrintSpeedSec != c.print {
+				t.Errorf("print speed: got %g, want %g", Params.PrintSpeedSec, c.print)
+			}
+		})
+	}
+}
+
+func TestRecount(t *testing.T) {
+	defer func() { ForceVersion, LubanComments = -1, false }()
+
+	cases := []struct {
+		version int
+		luban   bool
+		field   string
+	}{
+		{0, false, ";file_total_lines: "},
+		{1, false, ";Lines:"},
+		{0, true, ";file_total_lines: "},
+		{1, true, ";Lines:"},
+	}
+	count := func(data []byte, field string) int {
+		for _, line := range strings.Split(string(data), "\n") {
+			if v, ok := strings.CutPrefix(line, field); ok {
+				n, _ := strconv.Atoi(v)
+				return n
+			}
+		}
+		return -1
+	}
+	for _, c := range cases {
+		ForceVersion, LubanComments = c.version, c.luban
+		gcodes := _fixture(nil)
+		headers, err := ExtractHeader(gcodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := WriteGcodes(&buf, headers, gcodes); err != nil {
+			t.Fatal(err)
+		}
+		fixed := buf.Bytes()
+
+		// an unedited file is kept
+		got, err := Recount(fixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, fixed) {
+			t.Errorf("v%d luban %v: unedited file is changed", c.version, c.luban)
+		}
+
+		// remove 3 moves and add a comment
+		edited := strings.Replace(string(fixed), "G1 X10 Y10 E0.1 F1200\n", "", 3)
+		edited = strings.Replace(edited, "G28\n", "G28\n; edited\n", 1)
+		got, err = Recount([]byte(edited))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := count(fixed, c.field) - 2; count(got, c.field) != want {
+			t.Errorf("v%d luban %v: got %d lines, want %d", c.version, c.luban, count(got, c.field), want)
+		}
+		if strings.Replace(string(got), c.field+strconv.Itoa(count(got, c.field)), "", 1) != strings.Replace(edited, c.field+strconv.Itoa(count(fixed, c.field)), "", 1) {
+			t.Errorf("v%d luban %v: lines other than the count are changed", c.version, c.luban)
+		}
+	}
+
+	if _, err := Recount([]byte(_fixtureText(nil))); err != ErrNoHeader {
+		t.Errorf("got %v, want ErrNoHeader", err)
+	}
+}
+
+func TestFlowRampSlope(t *testing.T) {
+	ramped := []string{
+		"G1 X10 Y10 F6000",
+		"G1 X20 Y10 E0.2 F600",
+		"G1 X30 Y10 E0.4 F1200",
+		"G1 X40 Y10 E0.4 F1800",
+	}
+	fast := append(ramped, "G1 X50 Y10 E0.6 F2400")
+	cases := []struct {
+		name    string
+		slope   string
+		body    []string
+		used    string
+		warning string
+	}{
+		{"nominal", "", ramped, "1.00, 0.00", "T0 first layer flow 7.2mm3/s exceeds the max volumetric speed 5.0mm3/s\nT0 print flow 7.2mm3/s exceeds the max volumetric speed 5.0mm3/s"},
+		{"ramped", "1.8", ramped, "1.00, 0.00", ""},
+		{"ramped superslicer", "", ramped, "1.00, 0.00", ""},
+		{"too fast", "1.8", fast, "1.60, 0.00", "T0 peak flow 5.8mm3/s exceeds the max volumetric speed 5.0mm3/s"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := map[string]string{
+				"extrusion_width":                              "0.45",
+				"filament_max_volumetric_speed":                "5,5",
+				"filament used [mm]":                           c.used,
+				"max_volumetric_extrusion_rate_slope_positive": c.slope,
+			}
+			if strings.Contains(c.name, "superslicer") {
+				settings["max_volumetric_extrusion_rate_slope"] = "1.8"
+			}
+			if err := ParseParams(_fixture(settings, c.body...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := _warnings(Params.Validate()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+	// 0.06mm of filament per mm at 40mm/s
+	if flow, want := Params.PeakVolumetricFlow(0), 2.4*math.Pi*1.75*1.75/4; math.Abs(flow-want) > 1e-3 {
+		t.Errorf("peak flow: got %g, want %g", flow, want)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	body := []string{
+		"; thumbnail begin 2x2 40",
+		"; iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC",
+		"; thumbnail end",
+	}
+	body = append(body, strings.Split(strings.TrimSpace(strings.Repeat("G1 X10 Y10 E0.1 F1200\n", 20)), "\n")...)
+	gcodes := _fixture(nil, body...)
+	headers, err := ExtractHeader(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteGcodes(&buf, headers, gcodes); err != nil {
+		t.Fatal(err)
+	}
+	fixed := buf.String()
+	lines := strings.Split(fixed, "\n")
+	lineOf := func(prefix string) int {
+		for i, line := range lines {
+			if strings.HasPrefix(line, prefix) {
+				return i + 1
+			}
+		}
+		t.Fatalf("%q not found", prefix)
+		return 0
+	}
+
+	if d := Compare([]byte(fixed), []byte(fixed)); d != nil {
+		t.Errorf("identical files differ: %s", d)
+	}
+
+	cases := []struct {
+		name, old, new, section, prefix string
+	}{
+		{"header", ";machine: Snapmaker 2.0 A350", ";machine: Snapmaker 2.0 A250", "header", ";machine:"},
+		{"header thumbnail", ";thumbnail: data:image/png;base64,iVBOR", ";thumbnail: data:image/png;base64,AAAAA", "thumbnail", ";thumbnail:"},
+		{"source thumbnail", "; iVBORw0KGgo", "; AAAAw0KGgo", "thumbnail", "; iVBORw0KGgo"},
+		{"body", "M83\n", "M82\n", "body", "M83"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reference := strings.Replace(fixed, c.old, c.new, 1)
+			d := Compare([]byte(fixed), []byte(reference))
+			if d == nil {
+				t.Fatal("no difference")
+			}
+			if d.Section != c.section || d.Line != lineOf(c.prefix) {
+				t.Errorf("got line %d in the %s, want line %d in the %s", d.Line, d.Section, lineOf(c.prefix), c.section)
+			}
+		})
+	}
+
+	// a truncated reference differs at its end
+	truncated := strings.Join(lines[:len(lines)-3], "\n")
+	if d := Compare([]byte(fixed), []byte(truncated)); d == nil || d.Line != len(lines)-2 || d.Section != "body" {
+		t.Errorf("truncated: got %v", d)
+	}
+}
+
+func TestGcodeEnsureHeat(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		want   string // the line before the first extrusion
+		logged bool
+	}{
+		{"missing", `
+M104 S210
+G28
+M83
+G1 Z0.3 F600
+G1 X10 Y10 E1 F1200`, "M109 T0 S210 ;(Fixed: wait for nozzle temperature)", true},
+		{"present", `
+M104 S210
+M109 S210
+M83
+G1 X10 Y10 E1 F1200`, "M83", false},
+		{"other tool heated", `
+M109 T1 S220
+T0
+M83
+G1 X10 Y10 E1 F1200`, "M109 T0 S210 ;(Fixed: wait for nozzle temperature)", true},
+		{"retract first", `
+M82
+G92 E0
+G1 E-0.8 F2100
+M109 S210
+G1 X10 Y10 E1 F1200`, "M109 S210", false},
+		{"first line", `G1 X10 Y10 E1 F1200`, "M109 T0 S210 ;(Fixed: wait for nozzle temperature)", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var logs []string
+			gcodes := GcodeEnsureHeat([]float64{210, 220}, func(format string, v ...any) {
+				logs = append(logs, fmt.Sprintf(format, v...))
+			})(_parseGcodes(c.body))
+
+			for i, g := range gcodes {
+				var e float32
+				if g.GetParam('E', &e) == nil && e > 0 {
+					before := ""
+					if i > 0 {
+						before = gcodes[i-1].String()
+					}
+					if before != c.want {
+						t.Errorf("got %q before the first extrusion, want %q", before, c.want)
+					}
+					break
+				}
+			}
+			if (len(logs) == 1) != c.logged {
+				t.Errorf("got logs %q", logs)
+			}
+		})
+	}
+}
+
+func TestEffectiveBedTemperature(t *testing.T) {
+	body := []string{
+		"G1 X10 Y10 E1 F1200",
+		"T1",
+		"G1 X10 Y10 E1",
+	}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		body     []string
+		want     float64
+	}{
+		{"single", map[string]string{"first_layer_bed_temperature": "60,100"}, nil, 60},
+		{"dual higher second", map[string]string{"filament used [mm]": "1.00, 1.00", "first_layer_bed_temperature": "60,100"}, body, 100},
+		{"dual higher first", map[string]string{"filament used [mm]": "1.00, 1.00", "first_layer_bed_temperature": "80,60"}, body, 80},
+		{"idex", map[string]string{"filament used [mm]": "1.00, 1.00", "first_layer_bed_temperature": "65,90", "printer_model": "Snapmaker J1"}, body, 90},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings, c.body...)); err != nil {
+				t.Fatal(err)
+			}
+			if temp := Params.EffectiveBedTemperature(); temp != c.want {
+				t.Errorf("got %g, want %g", temp, c.want)
+			}
+		})
+	}
+}
+
+func TestBridgeFlowWeight(t *testing.T) {
+	defer func() { RecomputeFilament = false }()
+
+	// the slicer scales the E of the bridge by its flow ratio
+	body := []string{
+		";TYPE:External perimeter",
+		"G1 X10 Y10 E1 F1200",
+		";TYPE:Bridge infill",
+		"G1 X20 Y10 E0.8",
+	}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		flow     float64
+		gap      float64
+	}{
+		{"prusa", map[string]string{"bridge_flow_ratio": "0.8", "gap_fill_speed": "40", "filament_density": "1.27,1.24"}, 0.8, 40},
+		{"bambu", map[string]string{"bridge_flow": "0.8", "gap_infill_speed": "50", "filament_density": "1.27,1.24"}, 0.8, 50},
+		{"default density", map[string]string{"gap_fill_speed": "40"}, 0, 40},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			RecomputeFilament = true
+			if err := ParseParams(_fixture(c.settings, body...)); err != nil {
+				t.Fatal(err)
+			}
+			if flow := Params.FlowRatios[SpeedBridge]; flow != c.flow {
+				t.Errorf("bridge flow: got %g, want %g", flow, c.flow)
+			}
+			if gap := Params.Speeds[SpeedGapFill]; gap != c.gap {
+				t.Errorf("gap fill speed: got %g, want %g", gap, c.gap)
+			}
+
+			density := 1.27
+			if c.name == "default density" {
+				density = DefaultFilamentDensity
+			}
+			want := 1.8 * math.Pi * 1.75 * 1.75 / 4 * density / 1000
+			if math.Abs(Params.FilamentUsed[0]-1.8) > 1e-6 || math.Abs(Params.FilamentUsedWeight[0]-want) > 1e-9 {
+				t.Errorf("got %gmm %gg, want 1.8mm %gg", Params.FilamentUsed[0], Params.FilamentUsedWeight[0], want)
+			}
+		})
+	}
+
+	// the weight of the slicer is kept
+	RecomputeFilament = false
+	if err := ParseParams(_fixture(map[string]string{"filament used [mm]": "1.80, 0.00"}, body...)); err != nil {
+		t.Fatal(err)
+	}
+	if Params.FilamentUsedWeight[0] != 3 {
+		t.Errorf("got %gg, want 3g", Params.FilamentUsedWeight[0])
+	}
+}
+
+func TestBodyChecksum(t *testing.T) {
+	defer func() { ForceVersion, BodyChecksum = -1, false }()
+
+	checksum := func(t *testing.T, data []byte, field string) {
+		t.Helper()
+		header, body, ok := bytes.Cut(data, []byte(";Header End\n\n"))
+		if !ok {
+			t.Fatal("no header end")
+		}
+		want := fmt.Sprintf("%s%08x\n", field, crc32.ChecksumIEEE(body))
+		if !bytes.Contains(header, []byte(want)) {
+			t.Errorf("checksum %q not found in header:\n%s", want, header)
+		}
+	}
+	for version, field := range []string{";checksum_crc32: ", ";Checksum CRC32:"} {
+		ForceVersion, BodyChecksum = version, true
+		gcodes := GcodeFixShutoff(_fixture(nil))
+		parsed, err := NewParsedGcode(GcodeSetAcceleration(1000, 2000)(gcodes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateHeader(version, parsed.Header); err != nil {
+			t.Error(err)
+		}
+		var buf bytes.Buffer
+		if err := parsed.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		fixed := buf.Bytes()
+		checksum(t, fixed, field)
+
+		// the line counts the checksum
+		if got, err := Recount(fixed); err != nil || !bytes.Equal(got, fixed) {
+			t.Errorf("v%d: recount changed the file, %v", version, err)
+		}
+
+		// the checksum of an edited body is updated
+		edited := bytes.Replace(fixed, []byte("G1 X10 Y10 E0.1 F1200\n"), nil, 1)
+		got, err := Recount(edited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksum(t, got, field)
+	}
+
+	BodyChecksum = false
+	headers, err := ExtractHeader(_fixture(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.Join(headers, nil), []byte("CRC32")) {
+		t.Error("checksum is added without BodyChecksum")
+	}
+}
+
+func TestFirstLayerFlowWeight(t *testing.T) {
+	defer func() { RecomputeFilament = false }()
+
+	// the first layer over-extrudes by the ratio of the slicer
+	body := []string{
+		";LAYER_CHANGE",
+		";Z:0.2",
+		"G1 X10 Y10 E1.15 F1200",
+		";LAYER_CHANGE",
+		";Z:0.4",
+		"G1 X20 Y10 E1",
+	}
+	want := 2.15 * math.Pi * 1.75 * 1.75 / 4 * DefaultFilamentDensity / 1000
+	for _, ratio := range []string{"1.15", ""} {
+		RecomputeFilament = true
+		if err := ParseParams(_fixture(map[string]string{"first_layer_flow_ratio": ratio}, body...)); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := Params.FlowRatios[SpeedFirstLayer]; ratio != "" && got != 1.15 || ratio == "" && ok {
+			t.Errorf("ratio %q: got first layer flow %g", ratio, got)
+		}
+		if math.Abs(Params.FilamentUsedWeight[0]-want) > 1e-9 {
+			t.Errorf("ratio %q: got %gg, want %gg", ratio, Params.FilamentUsedWeight[0], want)
+		}
+	}
+}
+
+func TestFixResult(t *testing.T) {
+	defer func() { ForceVersion = -1 }()
+	ForceVersion = 1
+
+	gcodes := _fixture(nil,
+		"; thumbnail begin 2x2 40",
+		"; iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC",
+		"; thumbnail end",
+		"M104 S210",
+		"G1 X10 Y10 E0.5 F1200",
+		"G2 X20 Y10 I5 J0 E0.5",
+	)
+	original := make([]string, len(gcodes))
+	for i, g := range gcodes {
+		original[i] = g.String()
+	}
+	gcodes = GcodeEnsureHeat([]float64{210, 210}, func(string, ...any) {})(gcodes)
+	gcodes = GcodeSetAcceleration(1000, 2000)(gcodes)
+	gcodes = GcodeLinearizeArcs(0.1)(gcodes)
+	parsed, err := NewParsedGcode(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewFixResult(original, parsed, []error{errors.New("bed is too hot")})
+	if r.Fixes["linearized G2"] != 1 || r.Fixes["wait for nozzle temperature"] != 1 || r.Fixes["acceleration"] != 1 {
+		t.Errorf("got fixes %v", r.Fixes)
+	}
+	// the arc is replaced by its segments
+	segments := 0
+	for _, g := range parsed.Body {
+		if g.Is("G1") && !strings.HasPrefix(g.String(), "G1 X10 Y10 E0.5") {
+			segments++
+		}
+	}
+	if segments < 2 || r.Added != segments+2 || r.Removed != 1 {
+		t.Errorf("got %d added, %d removed, want %d, 1", r.Added, r.Removed, segments+2)
+	}
+
+	explained := r.Explain()
+	for _, want := range []string{
+		"header: version 1 for " + ModelA350,
+		"thumbnail: 2x2 png",
+		fmt.Sprintf("lines: %d added, 1 removed", segments+2),
+		"temperature: T0 210°C",
+		"temperature: bed 60°C",
+		"fixed: acceleration (1)",
+		"fixed: linearized G2 (1)",
+		"fixed: wait for nozzle temperature (1)",
+		"warning: bed is too hot",
+	} {
+		if !strings.Contains(explained, want) {
+			t.Errorf("%q not found in:\n%s", want, explained)
+		}
+	}
+	if strings.Contains(explained, "T1") {
+		t.Errorf("unused extruder is explained:\n%s", explained)
+	}
+
+	// the tools past T1 of a toolchanger, T1 stands for the nozzle of T3
+	gcodes = _fixture(map[string]string{
+		"filament used [mm]":      "2.00,0.00,1.00,1.00",
+		"first_layer_temperature": "210,210,230,240",
+		"filament_type":           "PLA;PLA;PETG;PETG",
+	}, "T0", "G1 X10 Y10 E0.5 F1200", "T2", "G1 X20 Y10 E0.5", "T3", "G1 X20 Y20 E0.5")
+	if parsed, err = NewParsedGcode(gcodes); err != nil {
+		t.Fatal(err)
+	}
+	explained = NewFixResult(nil, parsed, nil).Explain()
+	if want := "temperature: T0 210°C\ntemperature: T1 210°C\ntemperature: T2 230°C\ntemperature: T3 240°C\n"; !strings.Contains(explained, want) {
+		t.Errorf("%q not found in:\n%s", want, explained)
+	}
+}
+
+func TestJerk(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		jerk     []float64
+		jd       float64
+		want     string
+	}{
+		{"prusa jerk", map[string]string{"machine_max_jerk_x": "10,8", "machine_max_jerk_y": "9,8", "machine_max_junction_deviation": "0.02,0.02"}, []float64{10, 9}, 0.02, "M205 X10 Y9"},
+		{"junction deviation", map[string]string{"machine_max_junction_deviation": "0.013,0.013"}, []float64{-1, -1}, 0.013, "M205 J0.013"},
+		{"zero jerk", map[string]string{"machine_max_jerk_x": "0"}, []float64{0, -1}, -1, "M205 X0 Y0"},
+		{"missing", nil, []float64{-1, -1}, -1, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(Params.Jerk, c.jerk) || Params.JunctionDeviation != c.jd {
+				t.Errorf("got jerk %v, junction deviation %g, want %v, %g", Params.Jerk, Params.JunctionDeviation, c.jerk, c.jd)
+			}
+			if got := Params.JerkGcode(); got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCuraSettings(t *testing.T) {
+	// in the order of cura
+	blob, _ := json.Marshal(struct {
+		Global    string   `json:"global_quality"`
+		Extruders []string `json:"extruder_quality"`
+	}{
+		"[general]\nversion = 4\nname = Fine\n\n[values]\nlayer_height = 0.12\nspeed_wall_0 = 40\nline_width = =machine_nozzle_size\nmaterial_bed_temperature = 65\n\n",
+		[]string{
+			"[general]\nversion = 4\n\n[values]\nmaterial_print_temperature = 215\nmachine_nozzle_size = 0.6\nmaterial_diameter = 1.75\n\n",
+			"[general]\nversion = 4\n\n[values]\nmaterial_diameter = 2.85\n\n",
+		},
+	})
+	// cura splits the blob in chunks of its own length
+	var settings []string
+	for len(blob) > 60 {
+		settings = append(settings, ";SETTING_3 "+string(blob[:60]))
+		blob = blob[60:]
+	}
+	settings = append(settings, ";SETTING_3 "+string(blob))
+	cura := func(settings []string) []*GcodeBlock {
+		return _parseGcodes(strings.Join(append([]string{
+			";FLAVOR:Marlin",
+			";Generated with Cura_SteamEngine 5.6.0",
+			"G28",
+			"M83",
+			"G1 X10 Y10 E0.5 F1200",
+			";End of Gcode",
+		}, settings...), "\n"))
+	}
+
+	// the model of cura is unknown, the settings are parsed anyway
+	gcodes := cura(settings)
+	if err := ParseParams(gcodes); err != nil && err != ErrInvalidGcode {
+		t.Fatal(err)
+	}
+	if Params.LayerHeight != 0.12 || Params.Speeds[SpeedExternalPerimeter] != 40 {
+		t.Errorf("got layer height %g, speeds %v", Params.LayerHeight, Params.Speeds)
+	}
+	if Params.NozzleTemperatures[0] != 215 || Params.BedTemperatures[0] != 65 {
+		t.Errorf("got temperatures %v, bed %v", Params.NozzleTemperatures, Params.BedTemperatures)
+	}
+	if !reflect.DeepEqual(Params.NozzleDiameters, []float64{0.6, 0.6}) || !reflect.DeepEqual(Params.FilamentDiameters, []float64{1.75, 2.85}) {
+		t.Errorf("got nozzle diameters %v, filament diameters %v", Params.NozzleDiameters, Params.FilamentDiameters)
+	}
+	if Params.LineWidth != 0 {
+		t.Errorf("formula is parsed as line width %g", Params.LineWidth)
+	}
+	if Params.TotalLines != len(gcodes) {
+		t.Errorf("got %d lines, want %d", Params.TotalLines, len(gcodes))
+	}
+
+	// a truncated blob keeps the complete settings
+	if err := ParseParams(cura(settings[:len(settings)-1])); err != nil && err != ErrInvalidGcode {
+		t.Fatal(err)
+	}
+	if Params.LayerHeight != 0.12 || Params.NozzleTemperatures[0] != 215 {
+		t.Errorf("truncated: got layer height %g, temperatures %v", Params.LayerHeight, Params.NozzleTemperatures)
+	}
+}
+
+func TestEstimatedTimeFactor(t *testing.T) {
+	if err := ParseParams(_fixture(map[string]string{"estimated printing time (normal mode)": "2d 12h 8m 58s"})); err != nil {
+		t.Fatal(err)
+	}
+	if Params.EstimatedTimeSec != 231696 || Params.SlicerTimeSec != 216538 {
+		t.Errorf("got %d, slicer %d", Params.EstimatedTimeSec, Params.SlicerTimeSec)
+	}
+
+	// V0 shows the corrected time, V1 the time of the slicer
+	for version, want := range map[int]string{0: ";estimated_time(s): 231696", 1: ";Estimated Print Time:216538"} {
+		p := *Params
+		p.Version = version
+		if header := bytes.Join(p.header(0), []byte("\n")); !bytes.Contains(header, []byte(want+"\n")) {
+			t.Errorf("v%d: got %s, want %s", version, header, want)
+		}
+	}
+}
+
+func TestSilentModeEstimatedTime(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     int
+	}{
+		{"silent only", map[string]string{"estimated printing time (normal mode)": "", "estimated printing time (silent mode)": "1h 40m"}, 6420},
+		{"normal first", map[string]string{"estimated printing time (silent mode)": "1h 40m"}, 3984},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ParseParams(_fixture(c.settings)); err != nil {
+				t.Fatal(err)
+			}
+			if Params.EstimatedTimeSec != c.want {
+				t.Errorf("got %d, want %d", Params.EstimatedTimeSec, c.want)
+			}
+		})
+	}
+
+	// the normal mode keeps its priority when it follows the silent mode
+	body := []string{"; estimated printing time (silent mode) = 1h 40m", "; estimated printing time (normal mode) = 1h 2m 3s"}
+	body = append(body, _moves(20)...)
+	if err := ParseParams(_fixture(map[string]string{"estimated printing time (normal mode)": ""}, body...)); err != nil {
+		t.Fatal(err)
+	}
+	if Params.EstimatedTimeSec != 3984 {
+		t.Errorf("got %d, want the normal mode", Params.EstimatedTimeSec)
+	}
+}
+
+func TestReadParams(t *testing.T) {
+	saved := Params
+	defer func() { Params = saved }()
+	Params = NewParams()
+	global := Params
+
+	text := _fixtureText(nil,
+		"; thumbnail begin 2x2 40",
+		"; iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC",
+		"; thumbnail end",
+		"G1 X10 Y10 E0.5 F1200",
+	)
+	p, err := ReadParams(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Params != global || Params.Model != "" {
+		t.Error("Params is changed")
+	}
+	if p.Model != ModelA350 || p.NozzleTemperatures[0] != 210 {
+		t.Errorf("got model %q, temperatures %v", p.Model, p.NozzleTemperatures)
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["thumbnail"] != string(p.Thumbnail) || !strings.HasPrefix(string(p.Thumbnail), "data:image/png;base64,") {
+		t.Errorf("got thumbnail %v", fields["thumbnail"])
+	}
+	if fields["model"] != ModelA350 || fields["estimated_time_sec"] != float64(p.EstimatedTimeSec) {
+		t.Errorf("got %s", data)
+	}
+	if _, ok := fields["toolSwitches"]; ok {
+		t.Error("unexported field is written")
+	}
+}
+
+func TestParseSlicerParamsConcurrent(t *testing.T) {
+	saved := Params
+	defer func() { Params = saved }()
+	Params = NewParams()
+	global := Params
+
+	fixtures := map[string][]*GcodeBlock{
+		ModelA350: _fixture(nil),
+		ModelJ1:   _fixture(map[string]string{"printer_model": "Snapmaker J1"}),
+	}
+	var wg sync.WaitGroup
+	for model, gcodes := range fixtures {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(model string, gcodes []*GcodeBlock) {
+				defer wg.Done()
+				p, err := ParseSlicerParams(gcodes)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if p.Model != model || p.Version == 1 != (model == ModelJ1) {
+					t.Errorf("got %s v%d, want %s", p.Model, p.Version, model)
+				}
+			}(model, gcodes)
+		}
+	}
+	wg.Wait()
+
+	if _, err := NewParsedGcode(fixtures[ModelJ1]); err != nil {
+		t.Fatal(err)
+	}
+	if Params != global {
+		t.Error("Params is changed")
+	}
+}
+
+func TestKISSlicer(t *testing.T) {
+	body := []string{
+		"; KISSlicer - PRO",
+		"; Estimated Build Time:   61.50 minutes",
+		"; destring_length = 1.5",
+		"; temperature_C = 215",
+	}
+	body = append(body, _moves(20)...)
+	settings := map[string]string{
+		"estimated printing time (normal mode)": "",
+		"first_layer_temperature":               "",
+		"retract_length":                        "",
+	}
+	p := _params(t, settings, body...)
+	if want := int(math.Round(3690 * EstimatedTimeFactor)); p.EstimatedTimeSec != want {
+		t.Errorf("got %ds, want %ds", p.EstimatedTimeSec, want)
+	}
+	if p.Retractions[0] != 1.5 || p.NozzleTemperatures[0] != 215 {
+		t.Errorf("got retractions %v, temperatures %v", p.Retractions, p.NozzleTemperatures)
+	}
+}
+
+func TestArtisanToolhead(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		artisan  bool
+		toolhead string
+	}{
+		{"artisan one extruder", map[string]string{"printer_model": "Snapmaker Artisan"}, true, ToolheadDual},
+		{"artisan both extruders", map[string]string{"printer_model": "Snapmaker Artisan", "filament used [mm]": "2.00, 1.00"}, true, ToolheadDual},
+		{"a400 one extruder", map[string]string{"printer_model": "Snapmaker A400"}, false, ToolheadSingle},
+		{"a400 both extruders", map[string]string{"printer_model": "Snapmaker A400", "filament used [mm]": "2.00, 1.00"}, false, ToolheadDual},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if p.Model != ModelA400 || p.IsArtisan != c.artisan || p.ToolHead != c.toolhead {
+				t.Errorf("got %s, artisan %v, %s", p.Model, p.IsArtisan, p.ToolHead)
+			}
+		})
+	}
+}
+
+func TestObjects(t *testing.T) {
+	body := []string{
+		"G1 Z0.2 F600",
+		"; printing object cube id:0 copy 0",
+		"G1 X10 Y10 F3000",
+		"G1 X20 Y10 E1 F1200",
+		"G1 X20 Y20 E1",
+		"; stop printing object cube id:0 copy 0",
+		"; printing object tall id:1 copy 0",
+		"G1 X200 Y10",
+		"G1 X240 Y30 E2",
+		"; stop printing object tall id:1 copy 0",
+		"G1 Z0.4",
+		"; printing object cube id:0 copy 0",
+		"G1 X20 Y20",
+		"G1 X15 Y5 E1",
+		"; stop printing object cube id:0 copy 0",
+		"; printing object empty id:2 copy 0",
+		"; stop printing object empty id:2 copy 0",
+		"G1 X300 Y300 E1",
+	}
+	p := _params(t, map[string]string{"printer_model": "Snapmaker A250"}, body...)
+	want := []BoundingBox{
+		{"cube id:0 copy 0", [3]float64{10, 5, 0.2}, [3]float64{20, 20, 0.4}},
+		{"tall id:1 copy 0", [3]float64{200, 10, 0.2}, [3]float64{240, 30, 0.2}},
+	}
+	// Z is parsed as float32
+	round := func(boxes []BoundingBox) []BoundingBox {
+		for i := range boxes {
+			for j := 0; j < 3; j++ {
+				boxes[i].Min[j] = math.Round(boxes[i].Min[j]*1000) / 1000
+				boxes[i].Max[j] = math.Round(boxes[i].Max[j]*1000) / 1000
+			}
+		}
+		return boxes
+	}
+	if got := round(append([]BoundingBox{}, p.Objects...)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if p.MinX != 10 || p.MinY != 5 || p.MaxX != 240 || p.MaxY != 30 || math.Abs(p.MaxZ-0.4) > 1e-6 {
+		t.Errorf("got bounds (%g,%g)-(%g,%g,%g)", p.MinX, p.MinY, p.MaxX, p.MaxY, p.MaxZ)
+	}
+	if got, want := _warnings(p.validateObjects()), `object "tall id:1 copy 0" (200.0,10.0,0.2)-(240.0,30.0,0.2) exceeds the 230x250x235 build volume of Snapmaker 2.0 A250`; got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+
+	// the bounds of the slicer are kept as they cover the objects
+	p = _params(t, map[string]string{"min_x": "1", "max_x": "250", "max_y": "250", "max_z": "10"}, body...)
+	if p.MinX != 1 || p.MinY != 0 || p.MaxX != 250 || p.MaxZ != 10 {
+		t.Errorf("got bounds (%g,%g)-(%g,%g,%g)", p.MinX, p.MinY, p.MaxX, p.MaxY, p.MaxZ)
+	}
+
+	p = _params(t, nil)
+	if len(p.Objects) != 0 {
+		t.Errorf("got objects %v", p.Objects)
+	}
+}
+
+func TestFilamentVolumeWeight(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     float64
+	}{
+		{"petg", map[string]string{"filament used [g]": "", "filament used [cm3]": "4.81, 0.00", "filament_density": "1.27,1.24"}, 4.81 * 1.27},
+		{"unknown density", map[string]string{"filament used [g]": "", "filament used [cm3]": "4.81, 0.00"}, 4.81 * DefaultFilamentDensity},
+		{"weight of the slicer", map[string]string{"filament used [cm3]": "4.81, 0.00", "filament_density": "1.27,1.24"}, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if math.Abs(p.FilamentUsedWeight[0]-c.want) > 1e-9 || p.FilamentUsedVolume[0] != 4.81 {
+				t.Errorf("got %gg of %gcm3, want %gg", p.FilamentUsedWeight[0], p.FilamentUsedVolume[0], c.want)
+			}
+		})
+	}
+}
+
+func TestMaterialDensity(t *testing.T) {
+	settings := map[string]string{
+		"filament_type":       "PLA;PETG",
+		"filament used [mm]":  "1600.00, 1600.00",
+		"filament used [g]":   "",
+		"filament used [cm3]": "4.00, 4.00",
+	}
+	p := _params(t, settings)
+	if pla, petg := p.FilamentUsedWeight[0], p.FilamentUsedWeight[1]; math.Abs(pla-4.96) > 1e-9 || math.Abs(petg-5.08) > 1e-9 {
+		t.Errorf("got PLA %gg, PETG %gg", pla, petg)
+	}
+
+	// the density of the slicer wins over the material
+	settings["filament_density"] = "1.25,1.25"
+	p = _params(t, settings)
+	if p.FilamentUsedWeight[0] != p.FilamentUsedWeight[1] {
+		t.Errorf("got %v", p.FilamentUsedWeight)
+	}
+
+	// unknown materials are PLA
+	delete(settings, "filament_density")
+	settings["filament_type"] = "PLA;Wood"
+	p = _params(t, settings)
+	if p.FilamentUsedWeight[1] != 4*DefaultFilamentDensity {
+		t.Errorf("got %v", p.FilamentUsedWeight)
+	}
+}
+
+func TestFilamentDiameterWeight(t *testing.T) {
+	defer func() { RecomputeFilament = false }()
+	RecomputeFilament = true
+
+	weight := func(diameter string) float64 {
+		p := _params(t, map[string]string{"filament_diameter": diameter})
+		return p.FilamentUsedWeight[0]
+	}
+	thin, thick := weight(""), weight("2.85")
+	if want := thin * (2.85 / 1.75) * (2.85 / 1.75); math.Abs(thick-want) > 1e-9 {
+		t.Errorf("got %gg, want %gg", thick, want)
+	}
+	if both := weight("2.85,2.85"); both != thick {
+		t.Errorf("got %gg, want %gg", both, thick)
+	}
+}
+
+func TestErrAlreadyFixed(t *testing.T) {
+	text := _fixtureText(nil)
+	headers, err := ExtractHeader(_parseGcodes(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := string(bytes.Join(headers, []byte("\n"))) + text
+
+	if _, err := ReadGcodes(strings.NewReader(fixed)); !errors.Is(err, ErrAlreadyFixed) {
+		t.Errorf("ReadGcodes: got %v", err)
+	}
+	if _, err := ParseSlicerParams(_parseGcodes(fixed)); !errors.Is(err, ErrAlreadyFixed) || !errors.Is(err, ErrIsFixed) {
+		t.Errorf("ParseSlicerParams: got %v", err)
+	}
+	if _, err := ReadGcodes(strings.NewReader(text)); errors.Is(err, ErrAlreadyFixed) {
+		t.Error("unfixed file is reported as fixed")
+	}
+	if ErrAlreadyFixed.Error() != "No need to fix again." {
+		t.Errorf("message changed: %q", ErrAlreadyFixed)
+	}
+}
+
+func TestValidateBuildVolume(t *testing.T) {
+	cases := []struct {
+		name                   string
+		model                  string
+		minX, minY, maxX, maxY float64
+		maxZ                   float64
+		warning                string
+	}{
+		{"fits", ModelA150, 10, 10, 150, 150, 100, ""},
+		{"too wide", ModelA150, 0, 0, 170, 150, 100, "print is 170.0mm in X, it exceeds the 160mm build volume of Snapmaker 2.0 A150"},
+		{"too tall", ModelA250, 0, 0, 200, 200, 240, "print is 240.0mm in Z, it exceeds the 235mm build volume of Snapmaker 2.0 A250"},
+		{"offset but fits", ModelA350, 100, 100, 400, 420, 10, ""},
+		{"all axes", ModelJ1, 0, 0, 310, 210, 210, "print is 310.0mm in X, it exceeds the 300mm build volume of Snapmaker J1\nprint is 210.0mm in Y, it exceeds the 200mm build volume of Snapmaker J1\nprint is 210.0mm in Z, it exceeds the 200mm build volume of Snapmaker J1"},
+		{"unknown model", "", 0, 0, 1000, 1000, 1000, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := NewParams()
+			p.Model = c.model
+			p.MinX, p.MinY, p.MaxX, p.MaxY, p.MaxZ = c.minX, c.minY, c.maxX, c.maxY, c.maxZ
+			p.HasBounds = true
+			if got := _warnings(p.validateBuildVolume()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestGcodeProgress(t *testing.T) {
+	body := []string{
+		";LAYER_CHANGE", "G1 Z0.2", "G1 X10 Y10 E0.1",
+		";LAYER_CHANGE", "G1 Z0.4", "G1 X20 Y10 E0.1",
+		";LAYER_CHANGE", "G1 Z0.6", "G1 X20 Y20 E0.1",
+		";LAYER_CHANGE", "G1 Z0.8", "G1 X10 Y20 E0.1",
+	}
+	cases := []struct {
+		name    string
+		body    []string
+		layers  int
+		seconds int
+		want    []string
+	}{
+		{"layers", body, 4, 3600, []string{"M73 P0 R60", "M73 P25 R45", "M73 P50 R30", "M73 P75 R15"}},
+		{"counted layers", body, 0, 600, []string{"M73 P0 R10", "M73 P25 R8", "M73 P50 R5", "M73 P75 R3"}},
+		{"slicer progress", append([]string{"M73 P0 R10"}, body...), 4, 600, []string{"M73 P0 R10"}},
+		{"no layers", []string{"G1 X10 Y10 E0.1"}, 0, 600, nil},
+		{"layer of", []string{
+			";LAYER_CHANGE", "; layer 1 of 4", "G1 Z0.2", "G1 X10 Y10 E0.1",
+			";LAYER_CHANGE", "; layer 2 of 4", "G1 Z0.4", "G1 X20 Y10 E0.1",
+			";LAYER_CHANGE", "; layer 4 of 4", "G1 Z0.8", "G1 X10 Y20 E0.1",
+		}, 10, 600, []string{"M73 P0 R10", "M73 P25 R8", "M73 P75 R3"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gcodes := GcodeProgress(c.layers, c.seconds)(_parseGcodes(strings.Join(c.body, "\n")))
+			var got []string
+			for i, g := range gcodes {
+				if g.Is("M73") {
+					if !strings.Contains(c.name, "slicer") {
+						prev := gcodes[i-1].String()
+						if _, _, ok := parseLayerOf(prev); !isLayerChange(prev) && !ok {
+							t.Errorf("%s is not after a layer change", g)
+						}
+					}
+					got = append(got, g.Format("%c %p"))
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(c.want, "|") {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	if LineProgress(0, 600, false) != nil {
+		t.Error("expect no progress without layers")
+	}
+
+	// a stream knows the layers from the params
+	p, err := ScanParams(strings.NewReader(_fixtureText(map[string]string{"total_layer_number": "4"}, body...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range LineProgress(p.TotalLayers, 600, p.ProgressLayers > 0).Gcodes(_parseGcodes(strings.Join(body, "\n"))) {
+		if g.Is("M73") {
+			got = append(got, g.Format("%c %p"))
+		}
+	}
+	if want := "M73 P0 R10|M73 P25 R8|M73 P50 R5|M73 P75 R3"; strings.Join(got, "|") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProgressLayers(t *testing.T) {
+	body := []string{"; layer 1 of 3", "G1 Z0.2", "; layer 2 of 3", "G1 Z0.4", "; layer 3 of 3", "G1 Z0.6", "; layer 2 of", "; layer x of 3"}
+	body = append(body, _moves(20)...)
+	p := _params(t, nil, body...)
+	if p.ProgressLayers != 3 || p.TotalLayers != 3 {
+		t.Errorf("got %d progress layers, %d total layers", p.ProgressLayers, p.TotalLayers)
+	}
+
+	// the layers reported by the slicer win
+	p = _params(t, map[string]string{"total_layer_number": "5"}, body...)
+	if p.ProgressLayers != 3 || p.TotalLayers != 5 {
+		t.Errorf("got %d progress layers, %d total layers", p.ProgressLayers, p.TotalLayers)
+	}
+}
+
+func TestSelectThumbnail(t *testing.T) {
+	var lines []string
+	for _, size := range []string{"32x32", "600x600", "220x124", "300x300"} {
+		lines = append(lines, "; thumbnail begin "+size+" 12", "; "+base64.StdEncoding.EncodeToString([]byte(size)), "; thumbnail end", ";")
+	}
+	thumbs := parseThumbnails(split_(strings.Join(lines, "\n")))
+	if len(thumbs) != 4 || thumbs[2].Width != 220 || thumbs[2].Height != 124 {
+		t.Fatalf("got %+v", thumbs)
+	}
+
+	cases := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{"largest", 0, 0, "600x600"},
+		{"exact", 220, 124, "220x124"},
+		{"closest", 250, 250, "300x300"},
+		{"small", 16, 16, "32x32"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			thumb, ok := SelectThumbnail(thumbs, c.width, c.height)
+			if img, err := thumb.Decode(); !ok || err != nil || string(img) != c.want {
+				t.Errorf("got %s, want %s", img, c.want)
+			}
+		})
+	}
+	if _, ok := SelectThumbnail(nil, 0, 0); ok {
+		t.Error("selected a thumbnail of none")
+	}
+
+	ThumbnailWidth, ThumbnailHeight = 220, 124
+	defer func() { ThumbnailWidth, ThumbnailHeight = 0, 0 }()
+	lines = append(lines, _moves(20)...)
+	p := _params(t, nil, lines...)
+	if len(p.Thumbnails) != 4 || string(p.Thumbnail) != "data:image/png;base64,"+base64.StdEncoding.EncodeToString([]byte("220x124")) {
+		t.Errorf("got %d thumbnails, selected %s", len(p.Thumbnails), p.Thumbnail)
+	}
+}
+
+func TestJPEGThumbnail(t *testing.T) {
+	lines := []string{
+		"; thumbnail begin 32x32 12", "; png", "; thumbnail end", ";",
+		"; thumbnail_JPG begin 300x300 24", "; /9j/4AAQ", "; SkZJRg==", "; thumbnail_JPG end", ";",
+	}
+	thumbs := parseThumbnails(split_(strings.Join(lines, "\n")))
+	if len(thumbs) != 2 {
+		t.Fatalf("got %d thumbnails", len(thumbs))
+	}
+	if string(thumbs[0].DataURI()) != "data:image/png;base64,png" {
+		t.Errorf("png: got %s", thumbs[0].DataURI())
+	}
+	if string(thumbs[1].DataURI()) != "data:image/jpeg;base64,/9j/4AAQSkZJRg==" || thumbs[1].Width != 300 {
+		t.Errorf("jpeg: got %+v %s", thumbs[1], thumbs[1].DataURI())
+	}
+
+	lines = append(lines, _moves(20)...)
+	p := _params(t, nil, lines...)
+	if !strings.HasPrefix(string(p.Thumbnail), "data:image/jpeg;base64,") {
+		t.Errorf("got %s", p.Thumbnail)
+	}
+
+	// the manifest keeps the jpeg a jpeg
+	m := NewManifest(p, nil)
+	if m.ThumbnailType != "image/jpeg" || ThumbnailExt(p.Thumbnail) != ".jpg" {
+		t.Errorf("got type %q, extension %q", m.ThumbnailType, ThumbnailExt(p.Thumbnail))
+	}
+	img, err := ThumbnailImage([]byte(m.ThumbnailURI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(img, []byte("\xff\xd8\xff")) {
+		t.Errorf("not a jpeg: %q", img)
+	}
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC"
+	lines := []string{
+		"; thumbnail begin 2x2 40", "; " + png[:40], "; " + png[40:], "; thumbnail end", ";",
+		"; thumbnail begin 300x300 12", "; !!corrupted", "; thumbnail end", ";",
+	}
+	thumbs := parseThumbnails(split_(strings.Join(lines, "\n")))
+	if len(thumbs) != 2 {
+		t.Fatalf("got %d thumbnails", len(thumbs))
+	}
+	img, err := thumbs[0].Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(img, []byte("\x89PNG")) {
+		t.Errorf("not a png: %q", img[:8])
+	}
+	if _, err := thumbs[1].Decode(); err == nil {
+		t.Error("corrupted thumbnail decoded")
+	}
+
+	// the larger one is corrupted, the header gets the valid one
+	lines = append(lines, _moves(20)...)
+	p := _params(t, nil, lines...)
+	if len(p.Thumbnails) != 1 || string(p.Thumbnail) != "data:image/png;base64,"+png {
+		t.Errorf("got %d thumbnails, selected %s", len(p.Thumbnails), p.Thumbnail)
+	}
+}
+
+func TestPlaceholderThumbnail(t *testing.T) {
+	p := _params(t, nil)
+	if len(p.Thumbnail) != 0 {
+		t.Fatalf("placeholder without PlaceholderThumbnail: %.40s", p.Thumbnail)
+	}
+
+	PlaceholderThumbnail = true
+	defer func() { PlaceholderThumbnail = false }()
+	p = _params(t, nil)
+	img, err := ThumbnailImage(p.Thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || cfg.Width != PlaceholderSize || cfg.Height != PlaceholderSize {
+		t.Errorf("got %dx%d %s", cfg.Width, cfg.Height, format)
+	}
+
+	// the thumbnail of the slicer wins
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAIAAAACCAYAAABytg0kAAAAEklEQVR4nGP4z8DwHxkzkC4AANnXH+GwABFbAAAAAElFTkSuQmCC"
+	body := []string{"; thumbnail begin 2x2 40", "; " + png, "; thumbnail end"}
+	body = append(body, _moves(20)...)
+	p = _params(t, nil, body...)
+	if string(p.Thumbnail) != "data:image/png;base64,"+png {
+		t.Errorf("got %.40s", p.Thumbnail)
+	}
+}
+
+func TestForceModel(t *testing.T) {
+	cases := []struct {
+		name  string
+		model string
+		want  string
+		err   bool
+	}{
+		{"short", "A250", ModelA250, false},
+		{"lower case", "j1", ModelJ1, false},
+		{"full name", "Snapmaker 2.0 A150", ModelA150, false},
+		{"unknown", "A500", "", true},
+		{"empty", "", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			model, err := ParseModel(c.model)
+			if (err != nil) != c.err || model != c.want {
+				t.Errorf("got %q, %v", model, err)
+			}
+		})
+	}
+
+	// a custom profile the detection does not know
+	settings := map[string]string{"printer_model": "My Printer"}
+	if _, err := ParseSlicerParams(_fixture(settings)); err != ErrInvalidGcode {
+		t.Fatalf("got %v, want %v", err, ErrInvalidGcode)
+	}
+	ForceModel = ModelA250
+	defer func() { ForceModel = "" }()
+	for _, printer := range []string{"My Printer", "Snapmaker A350"} {
+		p := _params(t, map[string]string{"printer_model": printer})
+		if p.Model != ModelA250 {
+			t.Errorf("%s: got %q", printer, p.Model)
+		}
+	}
+}
+
+func TestModelVariants(t *testing.T) {
+	cases := []struct {
+		printer, bed string
+		want         string
+	}{
+		{"Snapmaker A250T", "", ModelA250},
+		{"Snapmaker 2.0 A350T", "", ModelA350},
+		{"Snapmaker F350", "", ModelA350},
+		{"Snapmaker F250", "", ModelA250},
+		{"snapmaker a150", "", ModelA150},
+		{"Snapmaker  J1", "", ModelJ1},
+		{"", "0x0, 320x0, 320 x 350, 0x350", ModelA350},
+		{"", "0X0,230X0,230X250,0X250", ModelA250},
+	}
+	for _, c := range cases {
+		t.Run(c.printer+c.bed, func(t *testing.T) {
+			settings := map[string]string{"printer_model": c.printer, "bed_shape": c.bed}
+			p := _params(t, settings)
+			if p.Model != c.want {
+				t.Errorf("got %q, want %q", p.Model, c.want)
+			}
+		})
+	}
+}
+
+func TestHasBounds(t *testing.T) {
+	p := _params(t, nil)
+	if p.HasBounds {
+		t.Error("bounds without bounds settings")
+	}
+	p.Model = ModelA150
+	if got := _warnings(p.validateBuildVolume()); got != "" {
+		t.Errorf("unknown bounds: got warnings %q", got)
+	}
+
+	// a model at the origin has bounds of 0
+	settings := map[string]string{"min_x": "0", "min_y": "0", "min_z": "0", "max_x": "400", "max_y": "10", "max_z": "10"}
+	p = _params(t, settings)
+	if !p.HasBounds || p.MinX != 0 || p.MaxX != 400 {
+		t.Errorf("got %v (%g)-(%g)", p.HasBounds, p.MinX, p.MaxX)
+	}
+	if got, want := _warnings(p.validateBuildVolume()), "print is 400.0mm in X, it exceeds the 320mm build volume of Snapmaker 2.0 A350"; got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+
+	// the objects give the bounds when the slicer has none
+	body := []string{"; printing object cube", "G1 Z0.2", "G1 X0 Y0", "G1 X20 Y20 E1", "; stop printing object cube"}
+	p = _params(t, nil, append(body, _moves(20)...)...)
+	if !p.HasBounds || p.MinX != 0 || p.MaxX != 20 {
+		t.Errorf("got %v (%g)-(%g)", p.HasBounds, p.MinX, p.MaxX)
+	}
+}
+
+func TestChamberTemperature(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     float64
+	}{
+		{"unset", nil, -1},
+		{"prusa", map[string]string{"chamber_temperature": "45,60"}, 45},
+		{"bbs", map[string]string{"chamber_temp": "50"}, 50},
+		{"not heated", map[string]string{"chamber_temperature": "0,0"}, -1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if got := p.EffectiveChamberTemperature(); got != c.want {
+				t.Errorf("got %g, want %g", got, c.want)
+			}
+		})
+	}
+
+	// both extruders are used, the higher one wins
+	body := []string{"T0", "G1 X10 Y10 E1 F1200", "T1", "G1 X20 Y10 E1 F1200"}
+	body = append(body, _moves(20)...)
+	p := _params(t, map[string]string{"chamber_temperature": "45,60", "filament used [mm]": "2.00, 3.00"}, body...)
+	if got := p.EffectiveChamberTemperature(); got != 60 {
+		t.Errorf("dual: got %g, want 60", got)
+	}
+}
+
+func TestSingleExtruderValues(t *testing.T) {
+	settings := map[string]string{
+		"first_layer_temperature":   "215",
+		"retract_length":            "0.6",
+		"retract_length_toolchange": "12",
+		"nozzle_diameter":           "0.6",
+		"filament used [mm]":        "2.00",
+		"filament used [g]":         "",
+	}
+	p := _params(t, settings)
+	for _, c := range []struct {
+		name string
+		got  []float64
+		want []float64
+	}{
+		{"nozzle temperatures", p.NozzleTemperatures, []float64{215, 0}}, // T1 is unused
+		{"retractions", p.Retractions, []float64{0.6, 0}},
+		{"switch retraction", p.SwitchRetractions, []float64{12, -1}},
+		{"nozzle diameters", p.NozzleDiameters, []float64{0.6, -1}},
+		{"filament used", p.FilamentUsed, []float64{2, 0}},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if p.FilamentUsedWeight[1] != 0 {
+		t.Errorf("filament weight: got %v", p.FilamentUsedWeight)
+	}
+
+	// the dual extruder header pads the second slot
+	header := string(bytes.Join(p.Header(_fixture(settings)), []byte("\n")))
+	for _, want := range []string{";nozzle_1_diameter(mm): 0.0", ";Extruder 1 Switch Retraction Distance: 0.00"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header: missing %q", want)
+		}
+	}
+}
+
+func TestRetractionSpeeds(t *testing.T) {
+	cases := []struct {
+		name            string
+		settings        map[string]string
+		retract, unretr []float64
+	}{
+		{"unset", nil, []float64{-1, -1}, []float64{-1, -1}},
+		{"prusa", map[string]string{"retract_speed": "35,40", "deretract_speed": "0,20"}, []float64{35, 40}, []float64{0, 20}},
+		{"bbs", map[string]string{"retraction_speed": "30", "deretraction_speed": "25"}, []float64{30, -1}, []float64{25, -1}},
+		{"restart speed", map[string]string{"retract_restart_extra_speed": "15"}, []float64{-1, -1}, []float64{15, -1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if !reflect.DeepEqual(p.RetractionSpeeds, c.retract) || !reflect.DeepEqual(p.DeretractionSpeeds, c.unretr) {
+				t.Errorf("got %v %v, want %v %v", p.RetractionSpeeds, p.DeretractionSpeeds, c.retract, c.unretr)
+			}
+		})
+	}
+}
+
+func TestZHop(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		hops     []float64
+		want     float64
+	}{
+		{"unset", nil, []float64{-1, -1}, -1},
+		{"prusa", map[string]string{"retract_lift": "0.4,0.6"}, []float64{0.4, 0.6}, 0.4},
+		{"bbs", map[string]string{"z_hop": "0.2"}, []float64{0.2, -1}, 0.2},
+		{"off", map[string]string{"retract_lift": "0,0"}, []float64{0, 0}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if !reflect.DeepEqual(p.ZHops, c.hops) {
+				t.Errorf("got %v, want %v", p.ZHops, c.hops)
+			}
+			if hop := p.EffectiveZHop(); hop != c.want {
+				t.Errorf("effective: got %g, want %g", hop, c.want)
+			}
+		})
+	}
+}
+
+// _seekCounter counts the passes over a file that start with a seek
+type _seekCounter struct {
+	io.ReadSeeker
+	seeks int
+}
+
+func (r *_seekCounter) Seek(offset int64, whence int) (int64, error) {
+	r.seeks++
+	return r.ReadSeeker.Seek(offset, whence)
+}
+
+func TestStreamedGcode(t *testing.T) {
+	defer func() { BodyChecksum = false }()
+	BodyChecksum = true
+
+	body := []string{"G1 Z0.2 F600", "G1 X10 Y10 E0.5 F1200", "G2 X20 Y10 I5 J0 E0.5", "G1 Z900"}
+	body = append(body, _moves(20)...)
+	text := _fixtureText(nil, body...)
+	modifiers := func(p *slicerParams, err error) ([]LineModifier, error) {
+		return []LineModifier{
+			LineSetOrigin(1, 2, 3),
+			LineLinearizeArcs(0.05),
+			LineEnsureHeat(p.NozzleTemperatures, t.Logf),
+			LineSetAcceleration(1000, 0),
+			LineClampZ(300, t.Logf),
+		}, err
+	}
+
+	gcodes, err := ReadGcodes(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := modifiers(ParseSlicerParams(gcodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range lines {
+		gcodes = m.Gcodes(gcodes)
+	}
+	parsed, err := NewParsedGcode(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := parsed.Write(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &_seekCounter{ReadSeeker: strings.NewReader(text)}
+	streamed, err := NewStreamedGcode(r, modifiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamed.Close()
+	if r.seeks != 2 {
+		t.Errorf("the input is read %d times, want 2", r.seeks)
+	}
+	var got bytes.Buffer
+	if err := streamed.Write(&got); err != nil {
+		t.Fatal(err)
+	}
+	if d := Compare(got.Bytes(), want.Bytes()); d != nil {
+		t.Errorf("streamed output differs: %s", d)
+	}
+	for _, fixed := range []string{"set origin", "clamped Z900", "wait for nozzle temperature", "acceleration"} {
+		if !strings.Contains(got.String(), fixed) {
+			t.Errorf("%q is not fixed", fixed)
+		}
+	}
+	if strings.Contains(got.String(), "\nG2 ") {
+		t.Error("arc is not linearized")
+	}
+
+	params, err := ScanParams(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, _ := ParseSlicerParams(_parseGcodes(text))
+	if !reflect.DeepEqual(params, input) {
+		t.Error("ScanParams differs from ParseSlicerParams")
+	}
+
+	if _, err := NewStreamedGcode(bytes.NewReader(want.Bytes()), modifiers); !errors.Is(err, ErrAlreadyFixed) {
+		t.Errorf("fixed file: got %v, want ErrAlreadyFixed", err)
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	defer func(n int) { MaxLineSize = n }(MaxLineSize)
+
+	data := make([]byte, 96*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	body := []string{
+		fmt.Sprintf("; thumbnail begin 300x300 %d", len(encoded)),
+		"; " + encoded,
+		"; thumbnail end",
+	}
+	body = append(body, _moves(20)...)
+	text := _fixtureText(nil, body...)
+	if len(encoded) <= 64*1024 {
+		t.Fatalf("thumbnail line of %d bytes fits the default buffer", len(encoded))
+	}
+
+	gcodes, err := ReadGcodes(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParseSlicerParams(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Thumbnails) != 1 {
+		t.Fatalf("got %d thumbnails, want 1", len(p.Thumbnails))
+	}
+	if got, err := p.Thumbnails[0].Decode(); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("thumbnail is not intact: %d bytes, %v", len(got), err)
+	}
+
+	d, err := Detect(strings.NewReader(text))
+	if err != nil || d.Slicer != "PrusaSlicer" {
+		t.Errorf("Detect: got %+v, %v", d, err)
+	}
+
+	MaxLineSize = 64 * 1024
+	if _, err := ReadGcodes(strings.NewReader(text)); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("line above MaxLineSize: got %v, want bufio.ErrTooLong", err)
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	defer func(n int) { MaxLineSize = n }(MaxLineSize)
+
+	body := []string{"; " + strings.Repeat("A", 100*1024)}
+	body = append(body, _moves(20)...)
+	text := _fixtureText(nil, body...)
+
+	small := ReadOptions{MaxLineBytes: 64 * 1024}
+	if _, err := ReadGcodesWith(strings.NewReader(text), small); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("ReadGcodesWith: got %v, want bufio.ErrTooLong", err)
+	}
+	if _, err := ScanParamsWith(strings.NewReader(text), small); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("ScanParamsWith: got %v, want bufio.ErrTooLong", err)
+	}
+
+	// the options win over MaxLineSize
+	MaxLineSize = 64 * 1024
+	want, err := ParseSlicerParams(_parseGcodes(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ScanParamsWith(strings.NewReader(text), ReadOptions{MaxLineBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TotalLines != want.TotalLines {
+		t.Errorf("got %d lines, want %d", p.TotalLines, want.TotalLines)
+	}
+
+	// lines of classic Mac OS end in \r
+	cr := ReadOptions{Split: func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}}
+	gcodes, err := ReadGcodesWith(strings.NewReader(strings.ReplaceAll(_fixtureText(nil), "\n", "\r")), cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(gcodes); got != len(_fixture(nil)) {
+		t.Errorf("got %d lines, want %d", got, len(_fixture(nil)))
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	defer func() { PlaceholderThumbnail = false }()
+
+	body := []string{"; thumbnail begin 220x124 12", "; " + base64.StdEncoding.EncodeToString([]byte("220x124")), "; thumbnail end"}
+	body = append(body, _moves(20)...)
+	cases := []struct {
+		name          string
+		gcodes        []*GcodeBlock
+		placeholder   bool
+		width, height int
+	}{
+		{"thumbnail", _fixture(nil, body...), false, 220, 124},
+		{"none", _fixture(nil), false, 0, 0},
+		{"placeholder", _fixture(nil), true, PlaceholderSize, PlaceholderSize},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			PlaceholderThumbnail = c.placeholder
+			p, err := ParseSlicerParams(c.gcodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ThumbnailWidth != c.width || p.ThumbnailHeight != c.height {
+				t.Errorf("got %dx%d, want %dx%d", p.ThumbnailWidth, p.ThumbnailHeight, c.width, c.height)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	defer func() { Logger = nil }()
+
+	var b bytes.Buffer
+	Logger = log.New(&b, "", 0)
+	if _, err := ParseSlicerParams(_fixture(nil)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"printer_model = Snapmaker A350\n", "Model: " + ModelA350 + "\n", "NozzleDiameters: [0.4 0.4]\n"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%q is not logged", want)
+		}
+	}
+	if strings.Contains(b.String(), "Thumbnail: ") || strings.Contains(b.String(), "Thumbnails: ") {
+		t.Error("thumbnail is logged")
+	}
+
+	b.Reset()
+	if _, err := ParseSlicerParams(_fixture(map[string]string{"printer_model": ""})); err == nil {
+		t.Fatal("parsed without a model")
+	}
+	if !strings.Contains(b.String(), "error: "+ErrInvalidGcode.Error()) {
+		t.Errorf("error is not logged: %s", b.String())
+	}
+
+	b.Reset()
+	if _, err := ParseSlicerParamsQuiet(_fixture(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("logged by the quiet parse: %s", b.String())
+	}
+
+	// the input parsed for the modifiers is not logged, the fixed file is
+	streamed, err := NewStreamedGcode(strings.NewReader(_fixtureText(nil)), func(p *slicerParams, err error) ([]LineModifier, error) {
+		return nil, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamed.Close()
+	if n := strings.Count(b.String(), "printer_model = Snapmaker A350\n"); n != 1 {
+		t.Errorf("the setting is logged %d times, want once", n)
+	}
+	if n := strings.Count(b.String(), "Model: "+ModelA350+"\n"); n != 1 {
+		t.Errorf("the params are logged %d times, want once", n)
+	}
+
+	Logger = nil
+	b.Reset()
+	ParseSlicerParams(_fixture(nil))
+	if b.Len() != 0 {
+		t.Errorf("logged without Logger: %s", b.String())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	parsed, err := NewParsedGcode(_fixture(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDryRun(parsed.Params, parsed.Header, []error{errors.New("too hot")})
+	summary, _, _ := strings.Cut(d.String(), "\n")
+	if want := ModelA350 + ", v0, " + ToolheadSingle + ", " + PrintModeDefault + ", nozzle 210/0°C, bed 60°C"; summary != want {
+		t.Errorf("got %q, want %q", summary, want)
+	}
+	if !strings.Contains(d.String(), "Warning: too hot\n;") || !strings.Contains(d.String(), "\n;Header End\n") {
+		t.Errorf("warnings or header are missing:\n%s", d)
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["model"] != ModelA350 || got["gcode_version"] != 0.0 || len(got["header"].([]any)) != len(parsed.Header) {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestValidateIDEXTemperatures(t *testing.T) {
+	cases := []struct {
+		name    string
+		mode    string
+		temps   string
+		used    string
+		warning string
+	}{
+		{"duplication mismatch", "M605 S2", "210,230", "2.00, 2.00", "IDEX Duplication runs both nozzles at one temperature, T0 is 210°C but T1 is 230°C"},
+		{"mirror mismatch", "M605 S3", "230,210", "2.00, 2.00", "IDEX Mirror runs both nozzles at one temperature, T0 is 230°C but T1 is 210°C"},
+		{"duplication same", "M605 S2", "210,210", "2.00, 2.00", ""},
+		{"within tolerance", "M605 S2", "210,210.5", "2.00, 2.00", ""},
+		{"default mode", "M605 S1", "210,230", "2.00, 2.00", ""},
+		{"right unused", "M605 S2", "210,230", "2.00, 0.00", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body := []string{c.mode}
+			body = append(body, _moves(20)...)
+			p := _params(t, map[string]string{"first_layer_temperature": c.temps, "filament used [mm]": c.used}, body...)
+			if got := _warnings(p.validateIDEXTemperatures()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+			if c.warning != "" && !strings.Contains(_warnings(p.Validate()), c.warning) {
+				t.Error("Validate does not report the temperatures")
+			}
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	p := _params(t, map[string]string{
+		"print_settings_id":    "0.20mm QUALITY @Snapmaker",
+		"printer_settings_id":  "Snapmaker A350 - Dual",
+		"filament_settings_id": `"Generic PLA @Snapmaker";"Generic PETG; 2.0"`,
+	})
+	if p.PrintProfile != "0.20mm QUALITY @Snapmaker" || p.PrinterProfile != "Snapmaker A350 - Dual" {
+		t.Errorf("got %q, %q", p.PrintProfile, p.PrinterProfile)
+	}
+	if want := []string{"Generic PLA @Snapmaker", "Generic PETG; 2.0"}; !reflect.DeepEqual(p.FilamentProfiles, want) {
+		t.Errorf("got %q, want %q", p.FilamentProfiles, want)
+	}
+
+	p = _params(t, map[string]string{"print_settings_id": `"0.16mm Optimal"`, "filament_settings_id": "Generic PLA"})
+	if p.PrintProfile != "0.16mm Optimal" || !reflect.DeepEqual(p.FilamentProfiles, []string{"Generic PLA"}) {
+		t.Errorf("got %q, %q", p.PrintProfile, p.FilamentProfiles)
+	}
+	if p, _ = ParseSlicerParams(_fixture(nil)); p.PrintProfile != "" || p.FilamentProfiles != nil {
+		t.Errorf("got %q, %q without profiles", p.PrintProfile, p.FilamentProfiles)
+	}
+}
+
+func TestBrimAndSupport(t *testing.T) {
+	bounds := map[string]string{"min_x": "2", "min_y": "100", "max_x": "100", "max_y": "200"}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		brim     float64
+		support  bool
+		warning  string
+	}{
+		{"none", nil, 0, false, ""},
+		{"prusa", map[string]string{"brim_width": "5", "support_material": "1"}, 5, true, "brim of 5.0mm (-3.0,95.0)-(105.0,205.0) may extend beyond the 320x350 bed, check the bed clearance"},
+		{"prusa off", map[string]string{"brim_width": "0", "support_material": "0"}, 0, false, ""},
+		{"brim in bed", map[string]string{"brim_width": "1"}, 1, false, ""},
+		{"orca", map[string]string{"brim_width": "5", "brim_type": "outer_only", "enable_support": "true"}, 5, true, "brim of 5.0mm (-3.0,95.0)-(105.0,205.0) may extend beyond the 320x350 bed, check the bed clearance"},
+		{"orca no brim", map[string]string{"brim_width": "5", "brim_type": "no_brim", "enable_support": "false"}, 0, false, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := make(map[string]string)
+			for k, v := range bounds {
+				settings[k] = v
+			}
+			for k, v := range c.settings {
+				settings[k] = v
+			}
+			p := _params(t, settings)
+			if p.BrimWidth != c.brim || p.HasSupport != c.support {
+				t.Errorf("got brim %g support %v, want %g %v", p.BrimWidth, p.HasSupport, c.brim, c.support)
+			}
+			if got := _warnings(p.validateBrim()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+
+	cura := _fixture(map[string]string{"printer_model": ""})
+	cura = append(cura, _parseGcodes(`;SETTING_3 {"global_quality": "[values]\nadhesion_type = skirt\nbrim_width = 8\nsupport_enable = True\nmachine_name = Snapmaker A350\n"}`)...)
+	p, _ := ParseSlicerParams(cura)
+	if p.BrimWidth != 0 || !p.HasSupport {
+		t.Errorf("cura: got brim %g support %v", p.BrimWidth, p.HasSupport)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	text := _fixtureText(nil)
+	want, err := ParseSlicerParams(_parseGcodes(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	w := Compress(&compressed, "out.gcode.GZ")
+	io.WriteString(w, text)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"plain.gcode":      []byte(text),
+		"job.gcode.gz":     compressed.Bytes(),
+		"renamed.gcode":    compressed.Bytes(), // gzip by its magic bytes
+		"sub/job.gcode.gz": compressed.Bytes(),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ParseFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(p, want) {
+			t.Errorf("%s: params differ", name)
+		}
+	}
+
+	// a reader that can not seek is peeked
+	r, err := Decompress(io.MultiReader(bytes.NewReader(compressed.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != text {
+		t.Error("stream is not decompressed")
+	}
+	f := bytes.NewReader([]byte(text))
+	if r, _ := Decompress(f); r != io.Reader(f) {
+		t.Error("seekable plain reader is wrapped")
+	}
+
+	var plain bytes.Buffer
+	w = Compress(&plain, "out.gcode")
+	io.WriteString(w, text)
+	w.Close()
+	if plain.String() != text {
+		t.Error("output without .gz is compressed")
+	}
+
+	processed, _, err := MirrorTree(dir, t.TempDir(), func(in, out string) error { return nil })
+	if err != nil || len(processed) != len(files) {
+		t.Errorf("MirrorTree: got %v, %v", processed, err)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	body := []string{
+		"; thumbnail begin 2x1 8", "; " + base64.StdEncoding.EncodeToString([]byte("crlf")), "; thumbnail end",
+		";LAYER_CHANGE", "G1 X10 Y10 E0.1 F1200", ";LAYER_CHANGE",
+	}
+	body = append(body, _moves(20)...)
+	lf := _fixtureText(map[string]string{"printer_notes": "SNAPMAKER_GCODE_V1"}, body...)
+	crlf := strings.ReplaceAll(lf, "\n", "\r\n")
+
+	write := func(text string) (*ParsedGcode, string) {
+		gcodes, err := ReadGcodes(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := NewParsedGcode(GcodeProgress(2, 60)(gcodes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := parsed.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		return parsed, b.String()
+	}
+	want, wantOut := write(lf)
+	got, gotOut := write(crlf)
+	if got.Params.TotalLines != want.Params.TotalLines || !reflect.DeepEqual(got.Params, want.Params) {
+		t.Errorf("got %d lines, want %d, or the params differ", got.Params.TotalLines, want.Params.TotalLines)
+	}
+	if gotOut != wantOut || strings.Contains(gotOut, "\r") {
+		t.Error("output of CRLF input is not the LF output")
+	}
+	if !reflect.DeepEqual(got.LayerIndex(), want.LayerIndex()) {
+		t.Error("layer offsets differ")
+	}
+
+	// a fixed file edited on windows
+	recounted, err := Recount([]byte(strings.ReplaceAll(wantOut, "\n", "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recounted) != wantOut {
+		t.Error("recount of CRLF is not the LF file")
+	}
+}
+
+func TestMaxLayerZ(t *testing.T) {
+	bounds := map[string]string{"min_x": "10", "min_y": "10", "max_x": "100", "max_y": "100", "max_z": "340"}
+	cases := []struct {
+		name    string
+		layerZ  string
+		height  float64
+		warning string
+	}{
+		{"park move above the volume", "200.2", 200.2, ""},
+		{"no max_layer_z", "", 340, "print is 340.0mm in Z, it exceeds the 330mm build volume of Snapmaker 2.0 A350"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := map[string]string{"max_layer_z": c.layerZ}
+			for k, v := range bounds {
+				settings[k] = v
+			}
+			p := _params(t, settings)
+			if p.MaxZ != 340 || p.PrintHeight() != c.height {
+				t.Errorf("got max z %g height %g, want 340 %g", p.MaxZ, p.PrintHeight(), c.height)
+			}
+			if got := _warnings(p.validateBuildVolume()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+}
+
+func TestExtrusionMultipliers(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     []float64
+	}{
+		{"unset", nil, []float64{1, 1}},
+		{"prusa", map[string]string{"extrusion_multiplier": "0.95,1.02"}, []float64{0.95, 1.02}},
+		{"single", map[string]string{"extrusion_multiplier": "0.9"}, []float64{0.9, 1}},
+		{"percent", map[string]string{"extrusion_multiplier": "95%,100%"}, []float64{0.95, 1}},
+		{"bbs", map[string]string{"filament_flow_ratio": "0.98;0.96"}, []float64{0.98, 0.96}},
+		{"cura", map[string]string{"material_flow": "95,105"}, []float64{0.95, 1.05}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if !reflect.DeepEqual(p.ExtrusionMultipliers, c.want) {
+				t.Errorf("got %v, want %v", p.ExtrusionMultipliers, c.want)
+			}
+		})
+	}
+}
+
+func TestGetSetting(t *testing.T) {
+	for _, line := range []string{"; layer_height = 0.2", ";layer_height=0.2", "; layer_height =0.2", "; layer_height= 0.2", ";\tlayer_height\t=\t0.2 "} {
+		if v, ok := getSetting(line, "first_layer_height", "layer_height"); !ok || v != "0.2" {
+			t.Errorf("%q: got %q, %v", line, v, ok)
+		}
+	}
+	for _, line := range []string{"; layer_height_range = 0.2", "; first_layer_height = 0.2", "; layer_height =", "; layer_height: 0.2", "G1 ; layer_height = 0.2", ";"} {
+		if v, ok := getSetting(line, "layer_height"); ok {
+			t.Errorf("%q: got %q", line, v)
+		}
+	}
+
+	lf := _fixtureText(nil)
+	compact := strings.ReplaceAll(strings.ReplaceAll(lf, "; ", ";"), " = ", "=")
+	want, err := ParseSlicerParams(_parseGcodes(lf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseSlicerParams(_parseGcodes(compact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("params of ;key=value differ")
+	}
+}
+
+func TestManyExtruders(t *testing.T) {
+	settings := map[string]string{
+		"filament used [mm]":          "0.00,0.00,3.00,4.00",
+		"filament_type":               "PLA;PETG;ABS;TPU",
+		"nozzle_temperature":          "200,210,220,230",
+		"first_layer_temperature":     "200,210,220,230",
+		"first_layer_bed_temperature": "60,61,62,63",
+		"nozzle_diameter":             "0.4,0.4,0.4,0.4",
+		"retract_length":              "1,2,3,4",
+	}
+	body := []string{"T2"}
+	body = append(body, _moves(10)...)
+	body = append(body, "T3")
+	body = append(body, _moves(10)...)
+	p := _params(t, settings, body...)
+	if !reflect.DeepEqual(p.NozzleTemperatures, []float64{200, 210, 220, 230}) {
+		t.Errorf("nozzle temperatures: got %v", p.NozzleTemperatures)
+	}
+	if len(p.Retractions) != 4 || p.Retractions[3] != 4 {
+		t.Errorf("retractions: got %v", p.Retractions)
+	}
+	// T2 and T3 print on the nozzles of T0 and T1
+	if !p.LeftExtruderUsed || !p.RightExtruderUsed {
+		t.Errorf("used: got %v %v", p.LeftExtruderUsed, p.RightExtruderUsed)
+	}
+	if got := p.AllFilamentUsed(); got < 7 {
+		t.Errorf("all filament used: got %g", got)
+	}
+	if err := p.ValidateTemperatures(); err != nil {
+		t.Error(err)
+	}
+	p.Validate()
+	if header := p.Header(_parseGcodes(_fixtureText(settings, body...))); len(header) == 0 {
+		t.Error("no header")
+	}
+
+	settings["nozzle_temperature"] = "200,210,220,450"
+	settings["first_layer_temperature"] = "200,210,220,450"
+	p = _params(t, settings, body...)
+	if err, want := p.ValidateTemperatures(), "T3 nozzle temperature 450°C is above 350°C, is it 450°F (232°C)?"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestSerialWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewSerialWriter(&b)
+	io.WriteString(w, ";FLAVOR:Marlin\nG28 ; home\n\n  \nM104 S210\nG1 X1")
+	io.WriteString(w, "0 Y10\n;end")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := "N0 M110 N0*125\nN1 G28*18\nN2 M104 S210*100\nN3 G1 X10 Y10*42\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		cmd, sum, _ := strings.Cut(line, "*")
+		if strconv.Itoa(int(serialChecksum([]byte(cmd)))) != sum {
+			t.Errorf("%q: wrong checksum", line)
+		}
+	}
+}
+
+func TestFirstLayerSpeed(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		want     float64
+	}{
+		{"unset", nil, -1},
+		{"prusa", map[string]string{"first_layer_speed": "30"}, 30},
+		{"percent", map[string]string{"first_layer_speed": "50%"}, 40},
+		{"bbs", map[string]string{"initial_layer_speed": "50"}, 50},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if p.FirstLayerSpeed != c.want {
+				t.Errorf("got %g, want %g", p.FirstLayerSpeed, c.want)
+			}
+			if p.PrintSpeedSec != 80 {
+				t.Errorf("print speed: got %g, want 80", p.PrintSpeedSec)
+			}
+		})
+	}
+
+	// the slow first layer stays below the max volumetric speed of the print
+	settings := map[string]string{"filament_max_volumetric_speed": "5,5", "layer_height": "0.2", "extrusion_width": "0.45"}
+	const printFlow = "T0 print flow 7.2mm3/s exceeds the max volumetric speed 5.0mm3/s"
+	for speed, want := range map[string]string{"20": printFlow, "": "T0 first layer flow 7.2mm3/s exceeds the max volumetric speed 5.0mm3/s\n" + printFlow} {
+		settings["first_layer_speed"] = speed
+		p := _params(t, settings)
+		if got := _warnings(p.validateVolumetricFlow()); got != want {
+			t.Errorf("first layer speed %q: got warnings %q, want %q", speed, got, want)
+		}
+	}
+}
+
+func TestReheader(t *testing.T) {
+	defer func() { ForceVersion = -1 }()
+
+	for _, version := range []int{0, 1} {
+		ForceVersion = version
+		gcodes := _fixture(nil)
+		parsed, err := NewParsedGcode(gcodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := parsed.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		fixed := buf.Bytes()
+
+		// an unedited file is kept
+		got, err := Reheader(fixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := Compare(got, fixed); d != nil {
+			t.Errorf("v%d: %s", version, d)
+		}
+
+		// an edited setting is in the new header, the body is kept
+		edited := bytes.Replace(fixed, []byte("; max_print_speed = 80"), []byte("; max_print_speed = 60"), 1)
+		if got, err = Reheader(edited); err != nil {
+			t.Fatal(err)
+		}
+		_, bodyAt, _ := bytes.Cut(edited, []byte(";Header End\n\n"))
+		if !bytes.HasSuffix(got, bodyAt) {
+			t.Errorf("v%d: the body is changed", version)
+		}
+		if version == 0 && !bytes.Contains(got, []byte(";work_speed(mm/minute): 3600\n")) {
+			t.Errorf("v0: the header is not regenerated:\n%s", got[:bytes.Index(got, []byte(";Header End"))])
+		}
+		if bytes.Count(got, []byte(Mark)) != 1 {
+			t.Errorf("v%d: got %d marks", version, bytes.Count(got, []byte(Mark)))
+		}
+	}
+
+	// the header block of another tool is not replaced
+	for _, data := range []string{"G28\n", ";Header Start\n;Header End\n\nG28\n"} {
+		if _, err := Reheader([]byte(data)); !errors.Is(err, ErrNoHeader) {
+			t.Errorf("%q: got %v, want ErrNoHeader", data, err)
+		}
+	}
+}
+
+func TestMaterialFamily(t *testing.T) {
+	for name, want := range map[string]string{
+		"PLA": "PLA", "pla": "PLA", "PLA+": "PLA", "Generic PLA": "PLA", "PLA Basic": "PLA", "PLA-CF": "PLA",
+		"PET": "PETG", "PETG HF": "PETG", "PCTG": "PETG", "ABS+": "ABS", "eSUN ABS": "ABS", "ASA Aero": "ASA",
+		"FLEX": "TPU", "TPU 95A": "TPU", "TPE": "TPU", "PC": "PC", "Bambu PC FR": "PC",
+		"NYLON": "PA", "PA6-CF": "PA", "PAHT-CF": "PA", "PA12": "PA",
+		"Wood": "", "": "", "-": "", "PLACEHOLDER": "",
+	} {
+		if got := materialFamily(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+
+	// the density is of the family, the name of the slicer is kept
+	settings := map[string]string{
+		"filament used [mm]": "1000.00,1000.00", "filament used [g]": "", "filament_density": "",
+		"filament_type": "Generic PETG;PA6-CF", "filament_diameter": "1.75,1.75",
+	}
+	p := _params(t, settings)
+	if !reflect.DeepEqual(p.FilamentTypes, []string{"Generic PETG", "PA6-CF"}) {
+		t.Errorf("filament types: got %v", p.FilamentTypes)
+	}
+	volume := 1000 * math.Pi * 1.75 * 1.75 / 4 / 1000
+	for i, density := range []float64{1.27, 1.14} {
+		if want := volume * density; math.Abs(p.FilamentUsedWeight[i]-want) > 1e-9 {
+			t.Errorf("T%d: got %gg, want %gg", i, p.FilamentUsedWeight[i], want)
+		}
+	}
+}
+
+func TestValidateWipeTower(t *testing.T) {
+	bounds := map[string]string{"min_x": "10", "min_y": "10", "max_x": "100", "max_y": "100"}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		warning  string
+	}{
+		{"no tower keys", map[string]string{"wipe_tower": "1"}, ""},
+		{"disabled", map[string]string{"wipe_tower": "0", "wipe_tower_x": "-50", "wipe_tower_y": "10", "wipe_tower_width": "60"}, ""},
+		{"clear", map[string]string{"wipe_tower": "1", "wipe_tower_x": "200", "wipe_tower_y": "200", "wipe_tower_width": "60"}, ""},
+		{"off the bed", map[string]string{"wipe_tower": "1", "wipe_tower_x": "300", "wipe_tower_y": "200", "wipe_tower_width": "60"}, "wipe tower (300.0,200.0)-(360.0,260.0) extends beyond the 320x350 bed"},
+		{"overlap", map[string]string{"wipe_tower": "1", "wipe_tower_x": "50", "wipe_tower_y": "90", "wipe_tower_width": "60"}, "wipe tower (50.0,90.0)-(110.0,150.0) overlaps \"print\" (10.0,10.0)-(100.0,100.0)"},
+		{"orca", map[string]string{"enable_prime_tower": "1", "wipe_tower_x": "165", "wipe_tower_y": "250", "prime_tower_width": "35"}, ""},
+		{"orca overlap", map[string]string{"enable_prime_tower": "1", "wipe_tower_x": "80", "wipe_tower_y": "80", "prime_tower_width": "35"}, "wipe tower (80.0,80.0)-(115.0,115.0) overlaps \"print\" (10.0,10.0)-(100.0,100.0)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			settings := map[string]string{}
+			for k, v := range bounds {
+				settings[k] = v
+			}
+			for k, v := range c.settings {
+				settings[k] = v
+			}
+			p := _params(t, settings)
+			if got := _warnings(p.validateWipeTower()); got != c.warning {
+				t.Errorf("got warnings %q, want %q", got, c.warning)
+			}
+		})
+	}
+
+	// the objects are checked instead of the bounds of the whole print
+	body := []string{"; printing object left", "G1 Z0.2", "G1 X10 Y10", "G1 X40 Y40 E1", "; stop printing object left",
+		"; printing object right", "G1 X150 Y10", "G1 X180 Y40 E1", "; stop printing object right"}
+	body = append(body, _moves(20)...)
+	settings := map[string]string{"wipe_tower": "1", "wipe_tower_x": "80", "wipe_tower_y": "10", "wipe_tower_width": "40"}
+	p := _params(t, settings, body...)
+	if got := _warnings(p.validateWipeTower()); got != "" {
+		t.Errorf("got warnings %q", got)
+	}
+}
+
+func TestFirstLayerBedTemperature(t *testing.T) {
+	cases := []struct {
+		name              string
+		settings          map[string]string
+		firstLayer, other float64
+	}{
+		{"abs", map[string]string{"first_layer_bed_temperature": "110,110", "bed_temperature": "100,100"}, 110, 100},
+		{"bbs", map[string]string{"first_layer_bed_temperature": "", "hot_plate_temp_initial_layer": "105,105", "hot_plate_temp": "95,95"}, 105, 95},
+		{"first layer only", nil, 60, 60},
+		{"other layers only", map[string]string{"first_layer_bed_temperature": "", "bed_temperature": "70,70"}, 70, 70},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := _params(t, c.settings)
+			if got := p.EffectiveFirstLayerBedTemperature(); got != c.firstLayer {
+				t.Errorf("first layer: got %g, want %g", got, c.firstLayer)
+			}
+			if got := p.EffectiveBedTemperature(); got != c.other {
+				t.Errorf("other layers: got %g, want %g", got, c.other)
+			}
+			// the bed is preheated for the first layer
+			header := string(bytes.Join(p.Header(_fixture(c.settings)), []byte("\n")))
+			if want := fmt.Sprintf(";build_plate_temperature(°C): %.0f\n", c.firstLayer); !strings.Contains(header, want) {
+				t.Errorf("header has no %q", want)
+			}
+		})
+	}
+
+	p := _params(t, map[string]string{"bed_temperature": "230,60"})
+	if err, want := p.ValidateTemperatures(), "T0 bed temperature of the other layers 230°C is above 150°C, is it 230°F (110°C)?"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestSimplify3D(t *testing.T) {
+	body := []string{
+		"; G-Code generated by Simplify3D(R) Version 4.1.2",
+		"; Jan 1, 2024 at 10:00:00 AM",
+		"; Settings Summary",
+		";   processName,Process1",
+		";   extruderDiameter,0.6",
+		";   extruderRetractionDistance,1.2",
+		";   extruderRetractionSpeed,1800",
+		";   layerHeight,0.25",
+		";   printMaterial,PETG",
+		";   filamentDiameters,1.75|1.75|1.75|1.75|1.75|1.75",
+		";   filamentDensities,1.27|1.25|1.25|1.25|1.25|1.25",
+		";   defaultSpeed,3600",
+		";   firstLayerUnderspeed,0.5",
+		";   rapidXYspeed,6000",
+		";   temperatureName,Primary Extruder,Heated Bed",
+		";   temperatureSetpointTemperatures,235,80",
+		";   temperatureHeatedBed,0,1",
+	}
+	body = append(body, _moves(20)...)
+	body = append(body,
+		"; Build Summary",
+		";   Build time: 1 hours 23 minutes",
+		";   Filament length: 5000.2 mm (5.00 m)",
+		";   Plastic volume: 12026.90 mm^3 (12.03 cc)",
+		";   Plastic weight: 15.27 g (0.03 lb)",
+	)
+	settings := map[string]string{}
+	for _, k := range []string{"filament used [mm]", "filament used [g]", "filament_type", "first_layer_temperature", "first_layer_bed_temperature",
+		"nozzle_diameter", "retract_length", "layer_height", "max_print_speed", "estimated printing time (normal mode)"} {
+		settings[k] = ""
+	}
+	// the banner of Simplify3D replaces the one of the fixture
+	p, err := ParseSlicerParams(_fixture(settings, body...)[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int(math.Round(4980 * EstimatedTimeFactor)); p.EstimatedTimeSec != want {
+		t.Errorf("got %ds, want %ds", p.EstimatedTimeSec, want)
+	}
+	if p.NozzleTemperatures[0] != 235 || p.EffectiveFirstLayerBedTemperature() != 80 {
+		t.Errorf("got temperatures %v, bed %v", p.NozzleTemperatures, p.FirstLayerBedTemperatures)
+	}
+	if p.NozzleDiameters[0] != 0.6 || p.Retractions[0] != 1.2 || p.RetractionSpeeds[0] != 30 || p.LayerHeight != 0.25 {
+		t.Errorf("got nozzle %v, retraction %v at %v, layer height %g", p.NozzleDiameters, p.Retractions, p.RetractionSpeeds, p.LayerHeight)
+	}
+	if p.FilamentTypes[0] != "PETG" || p.FilamentUsed[0] != 5000.2 || p.FilamentUsedWeight[0] != 15.27 {
+		t.Errorf("got %v, %vmm, %vg", p.FilamentTypes, p.FilamentUsed, p.FilamentUsedWeight)
+	}
+	if p.PrintSpeedSec != 60 || p.FirstLayerSpeed != 30 || p.Speeds[SpeedTravel] != 100 {
+		t.Errorf("got print speed %g, first layer %g, travel %g", p.PrintSpeedSec, p.FirstLayerSpeed, p.Speeds[SpeedTravel])
+	}
+	if p.FilamentDensities[0] != 1.27 {
+		t.Errorf("got densities %v", p.FilamentDensities)
+	}
+
+	// the comma settings of other slicers are not read
+	body[0] = "; G-Code generated by another slicer"
+	if p, err = ParseSlicerParams(_fixture(settings, body...)[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if p.LayerHeight == 0.25 {
+		t.Error("read the settings of Simplify3D")
+	}
+}
+
+func TestSlicerName(t *testing.T) {
+	defer func() { ForceVersion, SlicerComment = -1, false }()
+
+	cases := []struct {
+		banner, name, version string
+	}{
+		{"; generated by PrusaSlicer 2.7.1+win64 on 2024-01-01 at 00:00:00 UTC", "PrusaSlicer", "2.7.1+win64"},
+		{"; generated by OrcaSlicer 1.9.0 on 2024-01-01 at 00:00:00", "OrcaSlicer", "1.9.0"},
+		{"; generated by SuperSlicer 2.5.59 on 2024-01-01 at 00:00:00 UTC", "SuperSlicer", "2.5.59"},
+		{";Generated with Cura_SteamEngine 5.6.0", "Cura_SteamEngine", "5.6.0"},
+		{"; G-Code generated by Simplify3D(R) Version 4.1.2", "Simplify3D", "4.1.2"},
+		{";Sliced by ideaMaker 4.4.1.7076, 2024-01-01 00:00:00", "ideaMaker", "4.4.1.7076"},
+		{"; generated by Slic3r", "Slic3r", ""},
+		{";FLAVOR:Marlin", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.banner, func(t *testing.T) {
+			body := []string{c.banner}
+			body = append(body, _moves(20)...)
+			// the banner of the case replaces the one of the fixture
+			gcodes := _fixture(nil, body...)[1:]
+			p, err := ParseSlicerParams(gcodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.SlicerName != c.name || p.SlicerVersion != c.version {
+				t.Errorf("got %q %q, want %q %q", p.SlicerName, p.SlicerVersion, c.name, c.version)
+			}
+
+			for version, field := range map[int]string{0: ";slicer: ", 1: ";Slicer:"} {
+				ForceVersion = version
+				for _, SlicerComment = range []bool{false, true} {
+					p, _ := ParseSlicerParams(gcodes)
+					header := p.Header(gcodes)
+					if err := ValidateHeader(version, header); err != nil {
+						t.Error(err)
+					}
+					found := bytes.Contains(bytes.Join(header, []byte("\n")), []byte(field+c.name))
+					if found != (SlicerComment && c.name != "") {
+						t.Errorf("v%d, slicer comment %v: got the credit %v", version, SlicerComment, found)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSwitchRetractions(t *testing.T) {
+	defer func() { ForceVersion = -1 }()
+	ForceVersion = 1
+
+	moves := func(tools ...string) (body []string) {
+		for _, tool := range tools {
+			body = append(body, tool)
+			body = append(body, _moves(10)...)
+		}
+		return
+	}
+	settings := map[string]string{"filament used [mm]": "1.00,1.00", "retract_length_toolchange": "8,12"}
+	gcodes := _fixture(settings, moves("T0", "T1")...)
+	p, err := ParseSlicerParams(gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.SwitchRetractions, []float64{8, 12}) || p.EffectiveSwitchRetraction() != 8 {
+		t.Errorf("got %v, effective %g", p.SwitchRetractions, p.EffectiveSwitchRetraction())
+	}
+	header := string(bytes.Join(p.Header(gcodes), []byte("\n")))
+	for _, want := range []string{";Extruder 0 Switch Retraction Distance:8.00\n", ";Extruder 1 Switch Retraction Distance:12.00\n"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header has no %q", want)
+		}
+	}
+
+	// a single used extruder
+	settings["filament used [mm]"] = "0.00,1.00"
+	p = _params(t, settings, moves("T1")...)
+	if got := p.EffectiveSwitchRetraction(); got != 12 {
+		t.Errorf("T1 only: got %g, want 12", got)
+	}
+
+	// T2 and T3 are the nozzles of T0 and T1, they take their values along
+	settings["filament used [mm]"] = "0.00,0.00,1.00,1.00"
+	settings["retract_length_toolchange"] = "2,4,8,12"
+	gcodes = GcodeReplaceToolNum(_fixture(settings, moves("T2", "T3")...))
+	if p, err = ParseSlicerParams(gcodes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.SwitchRetractions, []float64{8, 12}) {
+		t.Errorf("T2 and T3: got %v, want [8 12]", p.SwitchRetractions)
+	}
+}
+
+func TestSequential(t *testing.T) {
+	byLayer := []string{
+		"G1 Z0.2 F600",
+		"; printing object a", "G1 X10 Y10", "G1 X20 Y20 E1", "; stop printing object a",
+		"; printing object b", "G1 X100 Y10", "G1 X120 Y20 E1", "; stop printing object b",
+		"G1 Z0.4",
+		"; printing object a", "G1 X10 Y10", "G1 X20 Y20 E1", "; stop printing object a",
+		"; printing object b", "G1 X100 Y10", "G1 X120 Y20 E1", "; stop printing object b",
+	}
+	byObject := []string{
+		"G1 Z0.2 F600",
+		"; printing object a", "G1 X10 Y10", "G1 X20 Y20 E1",
+		"G1 Z0.4", "G1 X10 Y10 E1", "; stop printing object a",
+		"G1 Z0.2",
+		"; printing object b", "G1 X100 Y10", "G1 X120 Y20 E1",
+		"G1 Z0.4", "G1 X100 Y10 E1", "; stop printing object b",
+	}
+	cases := []struct {
+		name     string
+		settings map[string]string
+		body     []string
+		want     bool
+	}{
+		{"by layer", nil, byLayer, false},
+		{"by object", nil, byObject, true},
+		{"complete_objects", map[string]string{"complete_objects": "1"}, nil, true},
+		{"print_sequence", map[string]string{"print_sequence": "by object"}, nil, true},
+		{"print_sequence by layer", map[string]string{"print_sequence": "by layer"}, nil, false},
+	}
+	for _, c := range cases {
+		p := _params(t, c.settings, c.body...)
+		if p.IsSequential != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, p.IsSequential, c.want)
+		}
+		want := ""
+		if c.want {
+			want = "objects are printed one by one, verify the clearance of the head between the objects"
+		}
+		if got := _warnings(p.validateSequential()); got != want {
+			t.Errorf("%s: got warnings %q, want %q", c.name, got, want)
+		}
+	}
+}
+
+func TestFanSpeeds(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		fan, min []float64
+		alwaysOn bool
+	}{
+		{"unknown", nil, []float64{-1, -1}, []float64{-1, -1}, false},
+		{"orca", map[string]string{
+			"additional_cooling_fan_speed": "70,70",
+			"close_fan_the_first_x_layers": "1,1",
+			"fan_cooling_layer_time":       "60,30",
+			"fan_max_speed":                "100,80",
+			"fan_min_speed":                "35,20",
+			"overhang_fan_speed":           "100,100",
+			"reduce_fan_stop_start_freq":   "1,1",
+		}, []float64{100, 80}, []float64{35, 20}, false},
+		{"prusa", map[string]string{
+			"bridge_fan_speed": "100,100",
+			"fan_always_on":    "0,1",
+			"max_fan_speed":    "90,90",
+			"min_fan_speed":    "40,40",
+		}, []float64{90, 90}, []float64{40, 40}, true},
+		{"fixed", map[string]string{"fan_speed": "50", "fan_always_on": "0"}, []float64{50, -1}, []float64{-1, -1}, false},
+		// fan_speed follows fan_max_speed in the file
+		{"fixed and max", map[string]string{"fan_max_speed": "100,80", "fan_speed": "50"}, []float64{100, 80}, []float64{-1, -1}, false},
+	}
+	for _, c := range cases {
+		p := _params(t, c.settings)
+		if !reflect.DeepEqual(p.FanSpeeds, c.fan) || !reflect.DeepEqual(p.MinFanSpeeds, c.min) || p.FanAlwaysOn != c.alwaysOn {
+			t.Errorf("%s: got %v %v %v, want %v %v %v", c.name, p.FanSpeeds, p.MinFanSpeeds, p.FanAlwaysOn, c.fan, c.min, c.alwaysOn)
+		}
+	}
+}
+
+func TestValidateLayerHeight(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings map[string]string
+		nozzle   float64
+		want     string
+	}{
+		{"fine", nil, 0.4, ""},
+		{"thick", map[string]string{"nozzle_diameter": "0.2,0.2", "layer_height": "0.3"}, 0.2, "layer height 0.30mm is too thick for the 0.20mm nozzle, at most 0.16mm"},
+		{"thin", map[string]string{"layer_height": "0.03"}, 0.4, "layer height 0.03mm is too thin for the 0.40mm nozzle, at least 0.04mm"},
+		{"unused nozzle", map[string]string{"nozzle_diameter": "0.4,0.2"}, 0.4, ""},
+		{"dual", map[string]string{"nozzle_diameter": "0.4,0.2", "filament used [mm]": "2.00, 1.00"}, 0.2, "layer height 0.20mm is too thick for the 0.20mm nozzle, at most 0.16mm"},
+		{"unknown", map[string]string{"nozzle_diameter": ""}, -1, ""},
+	}
+	for _, c := range cases {
+		p := _params(t, c.settings)
+		if got := p.EffectiveNozzleDiameter(); got != c.nozzle {
+			t.Errorf("%s: got nozzle %g, want %g", c.name, got, c.nozzle)
+		}
+		if got := _warnings(p.validateLayerHeight()); got != c.want {
+			t.Errorf("%s: got warnings %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func BenchmarkParseGcodeBlock(b *testing.B) {
+	code := " G0.1  X1.23 Z.3 E-.004 R Y .333 F500000 ;  comment"
+	b.SetBytes(int64(len(code)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g, err := ParseGcodeBlock(code)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = g.String()
+	}
+}
+
+func BenchmarkGcodeAsType(b *testing.B) {
+	g, err := ParseGcode("E-.004")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var t float32
+	for i := 0; i < b.N; i++ {
+		err = g.AddrAs(&t)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = t
+	}
+}
+
+func BenchmarkToolNum(b *testing.B) {
+	g, err := ParseGcodeBlock("M104 S255 T1 ; tool T2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if t, err := g.GetToolNum(); err == nil {
+			if t != 1 {
+				b.Fatalf("got %d, want %d", t, 1)
+			}
+		} else {
 			b.Fatal(err)
 		}
 	}
 }
+
+func BenchmarkGetSetting(b *testing.B) {
+	lines := []string{"; layer_height = 0.2", ";layer_height=0.2", "G1 X10 Y10 E0.1", "; filament used [mm] = 2.00, 0.00"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			getSetting(line, "first_layer_height", "layer_height")
+		}
+	}
+}
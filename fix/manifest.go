@@ -0,0 +1,178 @@
+package fix
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strings"
+)
+
+// ManifestVersion is bumped on every incompatible change of the manifest schema
+const ManifestVersion = 1
+
+// Manifest is a stable description of a print job for print queues,
+// unlike slicerParams its fields only change with ManifestVersion.
+type Manifest struct {
+	Schema         int                `json:"schema"`
+	Model          string             `json:"model"`
+	Version        int                `json:"gcode_version"`
+	ToolHead       string             `json:"tool_head"`
+	PrintMode      string             `json:"print_mode"`
+	Extruders      []ManifestExtruder `json:"extruders"`
+	EstimatedTime  int                `json:"estimated_time_sec"`
+	FilamentUsed   float64            `json:"filament_used_mm"`
+	FilamentWeight float64            `json:"filament_weight_g"`
+	FilamentWaste  float64            `json:"filament_waste_mm,omitempty"` // ramming and purge of tool changes
+	RammingTime    int                `json:"ramming_time_sec,omitempty"`
+	BoundingBox    ManifestBounds     `json:"bounding_box"`
+	InfillPattern  string             `json:"infill_pattern,omitempty"`
+	SupportPattern string             `json:"support_pattern,omitempty"`
+	TopPattern     string             `json:"top_pattern,omitempty"`
+	BottomPattern  string             `json:"bottom_pattern,omitempty"`
+	SolidPattern   string             `json:"solid_infill_pattern,omitempty"`
+	Resolution     float64            `json:"resolution_mm,omitempty"`
+	Walls          *ManifestWalls     `json:"walls,omitempty"`
+	Interface      *ManifestInterface `json:"support_interface,omitempty"`
+	Lines          int                `json:"lines"`
+	Thumbnail      string             `json:"thumbnail,omitempty"`      // path of the extracted image
+	ThumbnailURI   string             `json:"thumbnail_uri,omitempty"`  // data uri of the image
+	ThumbnailType  string             `json:"thumbnail_type,omitempty"` // mime type of the image
+	Warnings       []string           `json:"warnings"`
+}
+
+type ManifestExtruder struct {
+	Index          int     `json:"index"`
+	Material       string  `json:"material"`
+	NozzleDiameter float64 `json:"nozzle_diameter_mm"`
+	Temperature    float64 `json:"temperature_c"`
+	FilamentUsed   float64 `json:"filament_used_mm"`
+	FilamentWeight float64 `json:"filament_weight_g"`
+}
+
+// ManifestWalls omits the settings the slicer does not report
+type ManifestWalls struct {
+	Generator         string `json:"generator,omitempty"`
+	Loops             *int   `json:"loops,omitempty"`
+	DistributionCount *int   `json:"distribution_count,omitempty"`
+	SeamPosition      string `json:"seam_position,omitempty"`
+}
+
+// ManifestInterface omits the settings the slicer does not report
+type ManifestInterface struct {
+	Layers  *int     `json:"layers,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Spacing *float64 `json:"spacing_mm,omitempty"`
+	Shells  bool     `json:"interface_shells,omitempty"`
+}
+
+type ManifestBounds struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+func NewManifest(p *slicerParams, warnings []error) *Manifest {
+	m := &Manifest{
+		Schema:         ManifestVersion,
+		Model:          p.Model,
+		Version:        p.Version,
+		ToolHead:       p.ToolHead,
+		PrintMode:      p.PrintMode,
+		Extruders:      []ManifestExtruder{},
+		EstimatedTime:  p.EstimatedTimeSec,
+		FilamentUsed:   p.AllFilamentUsed(),
+		FilamentWeight: p.AllFilamentUsedWeight(),
+		RammingTime:    int(math.Round(p.RammingTimeSec())),
+		BoundingBox: ManifestBounds{
+			Min: [3]float64{p.MinX, p.MinY, p.MinZ},
+			Max: [3]float64{p.MaxX, p.MaxY, p.MaxZ},
+		},
+		InfillPattern:  p.InfillPattern,
+		SupportPattern: p.SupportPattern,
+		TopPattern:     p.TopPattern,
+		BottomPattern:  p.BottomPattern,
+		SolidPattern:   p.SolidInfillPattern,
+		Resolution:     p.EffectiveResolution(),
+		Lines:          p.TotalLines,
+		ThumbnailURI:   string(p.Thumbnail),
+		ThumbnailType:  ThumbnailType(p.Thumbnail),
+		Warnings:       []string{},
+	}
+	walls := ManifestWalls{
+		Generator:    p.WallGenerator,
+		SeamPosition: p.SeamPosition,
+	}
+	if loops := p.WallLoops; loops >= 0 {
+		walls.Loops = &loops
+	}
+	if count := p.WallDistributionCount; count >= 0 {
+		walls.DistributionCount = &count
+	}
+	if walls != (ManifestWalls{}) {
+		m.Walls = &walls
+	}
+	support := ManifestInterface{
+		Pattern: p.SupportInterfacePattern,
+		Shells:  p.InterfaceShells,
+	}
+	if layers := p.SupportInterfaceLayers; layers >= 0 {
+		support.Layers = &layers
+	}
+	if spacing := p.SupportInterfaceSpacing; spacing >= 0 {
+		support.Spacing = &spacing
+	}
+	if support != (ManifestInterface{}) {
+		m.Interface = &support
+	}
+	for i := 0; i < 2; i++ {
+		if !p.extruderUsed(i) {
+			continue
+		}
+		m.Extruders = append(m.Extruders, ManifestExtruder{
+			Index:          i,
+			Material:       p.FilamentTypes[i],
+			NozzleDiameter: p.NozzleDiameters[i],
+			Temperature:    p.NozzleTemperatures[i],
+			FilamentUsed:   p.FilamentUsed[i],
+			FilamentWeight: p.FilamentUsedWeight[i],
+		})
+	}
+	for i, waste := range p.RammingWaste() {
+		m.FilamentWaste += waste + p.PurgeWaste()[i]
+	}
+	for _, w := range warnings {
+		m.Warnings = append(m.Warnings, w.Error())
+	}
+	return m
+}
+
+func (m *Manifest) JSON() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// ThumbnailImage returns the decoded image of the data uri thumbnail
+func ThumbnailImage(thumbnail []byte) ([]byte, error) {
+	if i := bytes.IndexByte(thumbnail, ','); i != -1 {
+		thumbnail = thumbnail[i+1:]
+	}
+	return base64.StdEncoding.DecodeString(string(thumbnail))
+}
+
+// ThumbnailType returns the mime type of the data uri thumbnail, empty without one
+func ThumbnailType(thumbnail []byte) string {
+	uri, ok := strings.CutPrefix(string(thumbnail), "data:")
+	if !ok {
+		return ""
+	}
+	typ, _, _ := strings.Cut(uri, ";")
+	return typ
+}
+
+// ThumbnailExt returns the file extension of the data uri thumbnail,
+// .png when the type is unknown as the thumbnails were png only before
+func ThumbnailExt(thumbnail []byte) string {
+	if ext, ok := thumbnailExts[ThumbnailType(thumbnail)]; ok {
+		return ext
+	}
+	return ".png"
+}
@@ -1,59 +1,464 @@
 package fix
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
 	"strings"
 )
 
 var (
-	ErrIsFixed      = errors.New("No need to fix again.")
+	// ErrAlreadyFixed is returned for a file postprocessed by smfix, a batch
+	// skips it
+	ErrAlreadyFixed = errors.New("No need to fix again.")
 	ErrInvalidGcode = errors.New("Invalid G-Code file.")
+	ErrNoPrintable  = errors.New("No printable content, the file may be truncated.")
+
+	// Deprecated: use ErrAlreadyFixed
+	ErrIsFixed = ErrAlreadyFixed
 )
 
+// SlicerParams names the params of ParseSlicerParams for its callers
+type SlicerParams = slicerParams
+
 type slicerParams struct {
-	Version            int    // 0 or 1
-	Model              string // A250/350/400/J1
-	ToolHead           string // ;tool_head
-	LeftExtruderUsed   bool
-	RightExtruderUsed  bool
-	PrintMode          string
-	PrinterNotes       string
-	LayerHeight        float64
-	TotalLayers        int
-	TotalLines         int // without headers
-	EstimatedTimeSec   int // time * 1.07
-	NozzleTemperatures []float64
-	NozzleDiameters    []float64
-	Retractions        []float64
-	SwitchRetraction   []float64
-	BedTemperatures    []float64
-	FilamentTypes      []string
-	FilamentUsed       []float64 // mm
-	FilamentUsedWeight []float64 // len * 1.24g/cm3 * pi * 1.75/2 * 1.75/2
-	PrintSpeedSec      float64   // ;work_speed
-	MinX               float64
-	MinY               float64
-	MinZ               float64
-	MaxX               float64
-	MaxY               float64
-	MaxZ               float64
-	Thumbnail          []byte
+	Version            int       `json:"version"`    // 0 or 1
+	Model              string    `json:"model"`      // A250/350/400/J1
+	IsArtisan          bool      `json:"is_artisan"` // an A400 shipped with the dual extruder
+	ToolHead           string    `json:"tool_head"`  // ;tool_head
+	LeftExtruderUsed   bool      `json:"left_extruder_used"`
+	RightExtruderUsed  bool      `json:"right_extruder_used"`
+	PrintMode          string    `json:"print_mode"`
+	PrinterNotes       string    `json:"printer_notes"`
+	LayerHeight        float64   `json:"layer_height"`
+	TotalLayers        int       `json:"total_layers"`
+	TotalLines         int       `json:"total_lines"`        // without headers
+	EstimatedTimeSec   int       `json:"estimated_time_sec"` // time * EstimatedTimeFactor
+	SlicerTimeSec      int       `json:"slicer_time_sec"`    // time without EstimatedTimeFactor
+	NozzleTemperatures []float64 `json:"nozzle_temperatures"`
+	NozzleDiameters    []float64 `json:"nozzle_diameters"`
+	Retractions        []float64 `json:"retractions"`
+	SwitchRetractions  []float64 `json:"switch_retractions"`
+	BedTemperatures    []float64 `json:"bed_temperatures"`
+	FilamentTypes      []string  `json:"filament_types"`
+	FilamentUsed       []float64 `json:"filament_used"`        // mm
+	FilamentUsedWeight []float64 `json:"filament_used_weight"` // g, of the slicer or by the density of the material
+	FilamentUsedVolume []float64 `json:"filament_used_volume"` // cm3, -1 if unknown
+	PrintSpeedSec      float64   `json:"print_speed_sec"`      // ;work_speed
+	FirstLayerSpeed    float64   `json:"first_layer_speed"`    // mm/s, -1 if unknown
+	MinX               float64   `json:"min_x"`
+	MinY               float64   `json:"min_y"`
+	MinZ               float64   `json:"min_z"`
+	MaxX               float64   `json:"max_x"`
+	MaxY               float64   `json:"max_y"`
+	MaxZ               float64   `json:"max_z"`
+	HasBounds          bool      `json:"has_bounds"` // the bounds above are 0 when unknown
+	Thumbnail          []byte    `json:"thumbnail"`
+
+	AvoidCrossingPerimeters bool               `json:"avoid_crossing_perimeters"` // assumed on unless the slicer says otherwise
+	Thumbnails              []Thumbnail        `json:"thumbnails"`                // all valid sizes embedded by the slicer
+	ChamberTemperatures     []float64          `json:"chamber_temperatures"`      // per filament, -1 if unset
+	FilamentStartGcode      []string           `json:"filament_start_gcode"`      // per-filament custom gcode
+	FilamentEndGcode        []string           `json:"filament_end_gcode"`
+	LineWidth               float64            `json:"line_width"`              // mm, 0 is auto
+	FirstLayerLineWidth     float64            `json:"first_layer_line_width"`  // mm, 0 is auto
+	MaxVolumetricSpeeds     []float64          `json:"max_volumetric_speeds"`   // mm3/s, 0 is unlimited
+	Speeds                  map[string]float64 `json:"speeds"`                  // mm/s by Speed*, only the known ones
+	FlowRampSlope           float64            `json:"flow_ramp_slope"`         // mm3/s2, 0 if the slicer does not ramp the flow
+	FlowRatios              map[string]float64 `json:"flow_ratios"`             // by Speed*, only the known ones
+	FilamentDensities       []float64          `json:"filament_densities"`      // g/cm3, 0 if unknown
+	PeakFilamentSpeeds      []float64          `json:"peak_filament_speeds"`    // mm/s, the fastest extrusion move of each extruder
+	WallGenerator           string             `json:"wall_generator"`          // classic or arachne
+	MinFeatureSize          float64            `json:"min_feature_size"`        // mm, arachne
+	MinBeadWidth            float64            `json:"min_bead_width"`          // mm, arachne
+	MaxPrintHeight          float64            `json:"max_print_height"`        // mm, -1 if unknown
+	MinExtrudingRate        float64            `json:"min_extruding_rate"`      // mm/s, machine limit
+	Accelerations           []float64          `json:"accelerations"`           // mm/s2 by Acceleration*, -1 if unknown
+	Jerk                    []float64          `json:"jerk"`                    // mm/s of x and y, -1 if unknown
+	JunctionDeviation       float64            `json:"junction_deviation"`      // mm, -1 if unknown
+	TravelAcceleration      float64            `json:"travel_acceleration"`     // mm/s2, 0 if unknown
+	WallLoops               int                `json:"wall_loops"`              // -1 if unknown
+	WallDistributionCount   int                `json:"wall_distribution_count"` // -1 if unknown, arachne
+	SeamPosition            string             `json:"seam_position"`
+	InfillPattern           string             `json:"infill_pattern"`            // Pattern*
+	SupportPattern          string             `json:"support_pattern"`           // Pattern*
+	TopPattern              string             `json:"top_pattern"`               // Pattern*
+	SupportInterfaceLayers  int                `json:"support_interface_layers"`  // top interface layers, -1 if unknown
+	SupportInterfacePattern string             `json:"support_interface_pattern"` // Pattern*
+	SupportInterfaceSpacing float64            `json:"support_interface_spacing"` // mm, -1 if unknown, 0 is solid
+	InterfaceShells         bool               `json:"interface_shells"`          // MMU, shells between materials
+	BottomPattern           string             `json:"bottom_pattern"`            // Pattern*
+	SolidInfillPattern      string             `json:"solid_infill_pattern"`      // Pattern*
+	BrimWidth               float64            `json:"brim_width"`                // mm
+	BrimEars                bool               `json:"brim_ears"`
+	BrimEarsDetectionLength float64            `json:"brim_ears_detection_length"` // mm
+	SkirtLoops              int                `json:"skirt_loops"`                // -1 if unknown
+	SkirtHeight             int                `json:"skirt_height"`               // layers, -1 if unknown
+	SkirtDistance           float64            `json:"skirt_distance"`             // mm from the model
+	DraftShield             bool               `json:"draft_shield"`               // the skirt is as tall as the model
+	Resolution              float64            `json:"resolution"`                 // mm, slicing resolution
+	GcodeResolution         float64            `json:"gcode_resolution"`           // mm, max deviation of simplified paths
+	ArcFitting              bool               `json:"arc_fitting"`                // G2/G3 are emitted
+	ArcTolerance            float64            `json:"arc_tolerance"`              // mm, 0 falls back to the gcode resolution
+	ComputedFilamentUsed    []float64          `json:"computed_filament_used"`     // mm, net E of the moves
+	SingleExtruderMM        bool               `json:"single_extruder_mm"`         // MMU, filaments share one nozzle
+	FilamentDiameters       []float64          `json:"filament_diameters"`         // mm
+	RammingTimes            []float64          `json:"ramming_times"`              // sec of one ramming before unloading
+	RammingVolumes          []float64          `json:"ramming_volumes"`            // mm3 of one ramming
+	ToolChanges             []int              `json:"tool_changes"`               // times each extruder is unloaded
+	WipeTower               bool               `json:"wipe_tower"`
+	WipingVolumes           []float64          `json:"wiping_volumes"`      // mm3 purged from extruder i to j at i*2+j
+	MinimalPurge            []float64          `json:"minimal_purge"`       // mm3 purged at least on the wipe tower by each extruder
+	Objects                 []BoundingBox      `json:"objects"`             // extrusions between the object markers of the slicer
+	RetractionSpeeds        []float64          `json:"retraction_speeds"`   // mm/s as reported, Cura and PrusaSlicer both use mm/s
+	DeretractionSpeeds      []float64          `json:"deretraction_speeds"` // mm/s as reported, 0 is the retraction speed
+	ZHops                   []float64          `json:"z_hops"`              // mm lifted on retraction, 0 is off
+	ThumbnailWidth          int                `json:"thumbnail_width"`     // px of Thumbnail, 0 without one
+	ThumbnailHeight         int                `json:"thumbnail_height"`    // px of Thumbnail, 0 without one
+	PrintProfile            string             `json:"print_profile"`       // print_settings_id
+	PrinterProfile          string             `json:"printer_profile"`     // printer_settings_id
+	FilamentProfiles        []string           `json:"filament_profiles"`   // filament_settings_id of each filament
+	HasSupport              bool               `json:"has_support"`
+	MaxLayerZ               float64            `json:"max_layer_z"`           // mm of the top layer, -1 if unknown
+	ExtrusionMultipliers    []float64          `json:"extrusion_multipliers"` // flow of each filament, 1 if unset
+	WipeTowerX              float64            `json:"wipe_tower_x"`          // mm of the front left corner, -1 if unknown
+	WipeTowerY              float64            `json:"wipe_tower_y"`          // mm of the front left corner, -1 if unknown
+	WipeTowerWidth          float64            `json:"wipe_tower_width"`      // mm, -1 if unknown
+	SlicerName              string             `json:"slicer_name"`           // of the banner, e.g. PrusaSlicer
+	SlicerVersion           string             `json:"slicer_version"`
+	IsSequential            bool               `json:"is_sequential"`   // objects are printed one by one
+	ProgressLayers          int                `json:"progress_layers"` // M of the "; layer N of M" comments, 0 without
+	HasProgress             bool               `json:"has_progress"`    // the slicer writes M73
+	FanSpeeds               []float64          `json:"fan_speeds"`      // max % of the cooling fan for each filament, -1 if unknown
+	MinFanSpeeds            []float64          `json:"min_fan_speeds"`  // % the fan slows down to on quick layers, -1 if unknown
+	FanAlwaysOn             bool               `json:"fan_always_on"`
+
+	FirstLayerBedTemperatures []float64 `json:"first_layer_bed_temperatures"` // BedTemperatures is of the other layers
+
+	toolSwitches [2][2]int // from, to
 }
 
 func (p *slicerParams) EffectiveNozzleTemperature() float64 {
 	return p.effective(p.NozzleTemperatures[0], p.NozzleTemperatures[1])
 }
 
+// EffectiveAcceleration is the default acceleration of the slicer, or the
+// lower one of the walls, -1 if unknown
+func (p *slicerParams) EffectiveAcceleration() float64 {
+	if accel := p.Accelerations[AccelerationDefault]; accel > 0 {
+		return accel
+	}
+	accel := -1.0
+	for _, a := range p.Accelerations[AccelerationOuterWall:] {
+		if a > 0 && (accel < 0 || a < accel) {
+			accel = a
+		}
+	}
+	return accel
+}
+
+// JerkGcode is the M205 of the jerk limits, or of the junction deviation if
+// the slicer reports no jerk, Marlin of Snapmaker uses the classic jerk. It is
+// empty if neither is known.
+func (p *slicerParams) JerkGcode() string {
+	if x, y := p.Jerk[0], p.Jerk[1]; x >= 0 || y >= 0 {
+		if x < 0 {
+			x = y
+		}
+		if y < 0 {
+			y = x
+		}
+		return fmt.Sprintf("M205 X%g Y%g", x, y)
+	}
+	if p.JunctionDeviation >= 0 {
+		return fmt.Sprintf("M205 J%g", p.JunctionDeviation)
+	}
+	return ""
+}
+
+// EffectiveSwitchRetraction is the tool change retraction of the first used
+// extruder, for a single value. -1 if unknown.
+func (p *slicerParams) EffectiveSwitchRetraction() float64 {
+	for i, v := range p.SwitchRetractions {
+		if p.extruderUsed(i) {
+			return v
+		}
+	}
+	return -1
+}
+
+// EffectiveNozzleDiameter is the smallest nozzle of the used extruders, -1 if
+// unknown
+func (p *slicerParams) EffectiveNozzleDiameter() float64 {
+	nozzle := -1.0
+	for i, d := range p.NozzleDiameters {
+		if p.extruderUsed(i) && d > 0 && (nozzle < 0 || d < nozzle) {
+			nozzle = d
+		}
+	}
+	return nozzle
+}
+
+// EffectiveZHop is the highest z-hop of the used extruders, -1 if unknown
+func (p *slicerParams) EffectiveZHop() float64 {
+	hop := -1.0
+	for i, h := range p.ZHops {
+		if p.extruderUsed(i) && h > hop {
+			hop = h
+		}
+	}
+	return hop
+}
+
+// EffectiveChamberTemperature is the highest chamber temperature of the used
+// materials, -1 if none is set. 0 means the chamber is not heated.
+func (p *slicerParams) EffectiveChamberTemperature() float64 {
+	temp := -1.0
+	for i, t := range p.ChamberTemperatures {
+		if p.extruderUsed(i) && t > 0 && t > temp {
+			temp = t
+		}
+	}
+	return temp
+}
+
+// EffectiveBedTemperature is shared by both extruders, the higher one of the
+// used materials is chosen for the adhesion of both.
 func (p *slicerParams) EffectiveBedTemperature() float64 {
-	return p.effective(p.BedTemperatures[0], p.BedTemperatures[1])
+	return p.effectiveBed(p.BedTemperatures)
+}
+
+// EffectiveFirstLayerBedTemperature is EffectiveBedTemperature of the first
+// layer, the bed is preheated to it
+func (p *slicerParams) EffectiveFirstLayerBedTemperature() float64 {
+	return p.effectiveBed(p.FirstLayerBedTemperatures)
+}
+
+func (p *slicerParams) effectiveBed(temps []float64) float64 {
+	temp := -1.0
+	for i := 0; i < 2; i++ {
+		if p.extruderUsed(i) && temps[i] > temp {
+			temp = temps[i]
+		}
+	}
+	if temp < 0 {
+		return p.effective(temps[0], temps[1])
+	}
+	return temp
 }
 
 func (p *slicerParams) AllFilamentUsed() float64 {
-	return p.FilamentUsed[0] + p.FilamentUsed[1]
+	return sumPositive(p.FilamentUsed)
 }
 
 func (p *slicerParams) AllFilamentUsedWeight() float64 {
-	return p.FilamentUsedWeight[0] + p.FilamentUsedWeight[1]
+	return sumPositive(p.FilamentUsedWeight)
+}
+
+// nozzleUsed reports whether a tool on nozzle i extrudes, the tools above T1
+// share the nozzles as GcodeReplaceToolNum maps them
+func (p *slicerParams) nozzleUsed(i int) bool {
+	for j, used := range p.FilamentUsed {
+		if j%2 == i && used > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIDEX reports whether both nozzles move independently, the idle nozzle
+// parks beside the bed and the active one may cross its print.
+func (p *slicerParams) IsIDEX() bool {
+	return p.Model == ModelJ1 || p.PrintMode != PrintModeDefault
+}
+
+// HasFilamentGcode reports whether any extruder has a per-filament start or end gcode
+func (p *slicerParams) HasFilamentGcode() bool {
+	for _, hooks := range [][]string{p.FilamentStartGcode, p.FilamentEndGcode} {
+		for _, g := range hooks {
+			if strings.TrimSpace(g) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EffectiveFirstLayerLineWidth falls back to the general line width when the
+// first layer has no specific one
+func (p *slicerParams) EffectiveFirstLayerLineWidth() float64 {
+	if p.FirstLayerLineWidth > 0 {
+		return p.FirstLayerLineWidth
+	}
+	return p.LineWidth
+}
+
+// EffectiveFirstLayerSpeed falls back to the print speed when the first layer
+// speed is unknown
+func (p *slicerParams) EffectiveFirstLayerSpeed() float64 {
+	if p.FirstLayerSpeed > 0 {
+		return p.FirstLayerSpeed
+	}
+	return p.PrintSpeedSec
+}
+
+// PrintHeight is the height of the top layer, MaxZ may include a final z-hop
+// or park move
+func (p *slicerParams) PrintHeight() float64 {
+	if p.MaxLayerZ > 0 {
+		return p.MaxLayerZ
+	}
+	return p.MaxZ
+}
+
+// SafeMaxZ is the max print height of the profile, or the build volume of the
+// model, 0 if neither is known
+func (p *slicerParams) SafeMaxZ() float64 {
+	if p.MaxPrintHeight > 0 {
+		return p.MaxPrintHeight
+	}
+	return buildVolumes[p.Model].Z
+}
+
+// FilamentWeight is the weight in g of length mm of filament of extruder i,
+// the flow ratios, of the first layer too, are applied by the slicer to the
+// E of the moves already.
+func (p *slicerParams) FilamentWeight(i int, length float64) float64 {
+	d := p.FilamentDiameters[i]
+	return length * math.Pi * d * d / 4 * p.filamentDensity(i) / 1000
+}
+
+// filamentDensity is the g/cm3 of extruder i, the slicer's or the typical one
+// of its material, DefaultFilamentDensity if both are unknown
+func (p *slicerParams) filamentDensity(i int) float64 {
+	if i < len(p.FilamentDensities) && p.FilamentDensities[i] > 0 {
+		return p.FilamentDensities[i]
+	}
+	if i < len(p.FilamentTypes) {
+		if density, ok := materialDensities[materialFamily(p.FilamentTypes[i])]; ok {
+			return density
+		}
+	}
+	return DefaultFilamentDensity
+}
+
+// PeakVolumetricFlow is the flow of the fastest extrusion move of extruder i
+func (p *slicerParams) PeakVolumetricFlow(i int) float64 {
+	d := p.FilamentDiameters[i]
+	return p.PeakFilamentSpeeds[i] * math.Pi * d * d / 4
+}
+
+// ChangesTools reports whether an extruder is unloaded for another one
+func (p *slicerParams) ChangesTools() bool {
+	for _, n := range p.ToolChanges {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RammingTimeSec is the time spent ramming before the tool changes of a MMU
+func (p *slicerParams) RammingTimeSec() (sec float64) {
+	if !p.SingleExtruderMM {
+		return 0
+	}
+	for i, n := range p.ToolChanges {
+		sec += float64(n) * p.RammingTimes[i]
+	}
+	return
+}
+
+// RammingWaste is the filament in mm pushed out by ramming of each extruder of a MMU
+func (p *slicerParams) RammingWaste() []float64 {
+	waste := []float64{0, 0}
+	if !p.SingleExtruderMM {
+		return waste
+	}
+	for i, n := range p.ToolChanges {
+		if d := p.FilamentDiameters[i]; d > 0 {
+			waste[i] = float64(n) * p.RammingVolumes[i] / (math.Pi * d * d / 4)
+		}
+	}
+	return waste
+}
+
+// PurgeWaste is the filament in mm purged into the wipe tower by each extruder
+// when it is loaded, at least the minimal purge of the extruder.
+func (p *slicerParams) PurgeWaste() []float64 {
+	waste := []float64{0, 0}
+	if !p.WipeTower {
+		return waste
+	}
+	for from := range p.toolSwitches {
+		for to, n := range p.toolSwitches[from] {
+			d := p.FilamentDiameters[to]
+			if n == 0 || d <= 0 {
+				continue
+			}
+			volume := 0.0
+			if i := from*2 + to; i < len(p.WipingVolumes) {
+				volume = p.WipingVolumes[i]
+			}
+			volume = math.Max(volume, p.MinimalPurge[to])
+			waste[to] += float64(n) * volume / (math.Pi * d * d / 4)
+		}
+	}
+	return waste
+}
+
+// EffectiveResolution is the granularity of the moves, OrcaSlicer only has resolution
+func (p *slicerParams) EffectiveResolution() float64 {
+	if p.GcodeResolution > 0 {
+		return p.GcodeResolution
+	}
+	return p.Resolution
+}
+
+// EffectiveArcTolerance is the max deviation of the arcs fitted by the slicer
+func (p *slicerParams) EffectiveArcTolerance() float64 {
+	if p.ArcTolerance > 0 {
+		return p.ArcTolerance
+	}
+	return p.EffectiveResolution()
+}
+
+// SkirtLayers is the number of layers from the first one the skirt is printed on
+func (p *slicerParams) SkirtLayers() int {
+	if p.SkirtLoops == 0 {
+		return 0
+	}
+	layers := p.SkirtHeight
+	if layers < 1 {
+		layers = 1
+	}
+	if p.TotalLayers > 0 && (p.DraftShield || layers > p.TotalLayers) {
+		layers = p.TotalLayers
+	}
+	return layers
+}
+
+// FootprintBounds returns the bounds on the bed, brim ears are placed at the
+// sharp corners of the model and reach the full brim width beyond them,
+// the skirt loops are printed around them.
+func (p *slicerParams) FootprintBounds() (minX, minY, maxX, maxY float64) {
+	minX, minY, maxX, maxY = p.MinX, p.MinY, p.MaxX, p.MaxY
+	margin := 0.0
+	if p.BrimEars && p.BrimWidth > 0 {
+		margin += p.BrimWidth
+	}
+	if p.SkirtLoops > 0 {
+		width := p.EffectiveFirstLayerLineWidth()
+		if width <= 0 {
+			width = p.NozzleDiameters[0]
+		}
+		margin += p.SkirtDistance + float64(p.SkirtLoops)*width
+	}
+	return minX - margin, minY - margin, maxX + margin, maxY + margin
 }
 
 func (p *slicerParams) effective(x, y float64) float64 {
@@ -67,6 +472,7 @@ func NewParams() *slicerParams {
 	return &slicerParams{
 		Version:            0,
 		Model:              "",
+		IsArtisan:          false,
 		ToolHead:           ToolheadSingle,
 		PrintMode:          PrintModeDefault,
 		LeftExtruderUsed:   false,
@@ -76,29 +482,369 @@ func NewParams() *slicerParams {
 		TotalLayers:        0,
 		TotalLines:         0,
 		EstimatedTimeSec:   0,
+		SlicerTimeSec:      0,
 		NozzleTemperatures: []float64{-1, -1},
 		NozzleDiameters:    []float64{-1, -1},
 		Retractions:        []float64{-1, -1},
-		SwitchRetraction:   []float64{-1, -1},
+		SwitchRetractions:  []float64{-1, -1},
 		BedTemperatures:    []float64{-1, -1},
 		FilamentTypes:      []string{"", ""},
 		FilamentUsed:       []float64{-1, -1},
 		FilamentUsedWeight: []float64{-1, -1},
+		FilamentUsedVolume: []float64{-1, -1},
 		PrintSpeedSec:      0,
+		FirstLayerSpeed:    -1,
 		MinX:               0,
 		MinY:               0,
 		MinZ:               0,
 		MaxX:               0,
 		MaxY:               0,
 		MaxZ:               0,
+		HasBounds:          false,
 		Thumbnail:          []byte{},
+
+		AvoidCrossingPerimeters: true,
+		ChamberTemperatures:     []float64{-1, -1},
+		FilamentStartGcode:      []string{"", ""},
+		FilamentEndGcode:        []string{"", ""},
+		LineWidth:               0,
+		FirstLayerLineWidth:     0,
+		Speeds:                  map[string]float64{},
+		FlowRampSlope:           0,
+		FlowRatios:              map[string]float64{},
+		FilamentDensities:       []float64{0, 0},
+		PeakFilamentSpeeds:      []float64{0, 0},
+		MaxVolumetricSpeeds:     []float64{-1, -1},
+		WallGenerator:           "",
+		MinFeatureSize:          0,
+		MinBeadWidth:            0,
+		MaxPrintHeight:          -1,
+		MinExtrudingRate:        0,
+		Accelerations:           []float64{-1, -1, -1},
+		Jerk:                    []float64{-1, -1},
+		JunctionDeviation:       -1,
+		TravelAcceleration:      0,
+		WallLoops:               -1,
+		WallDistributionCount:   -1,
+		SeamPosition:            "",
+		InfillPattern:           "",
+		SupportPattern:          "",
+		TopPattern:              "",
+		SupportInterfaceLayers:  -1,
+		SupportInterfacePattern: "",
+		SupportInterfaceSpacing: -1,
+		InterfaceShells:         false,
+		BottomPattern:           "",
+		SolidInfillPattern:      "",
+		BrimWidth:               0,
+		BrimEars:                false,
+		BrimEarsDetectionLength: 0,
+		SkirtLoops:              -1,
+		SkirtHeight:             -1,
+		SkirtDistance:           0,
+		DraftShield:             false,
+		Resolution:              0,
+		GcodeResolution:         0,
+		ArcFitting:              false,
+		ArcTolerance:            0,
+		ComputedFilamentUsed:    []float64{0, 0},
+		SingleExtruderMM:        false,
+		FilamentDiameters:       []float64{DefaultFilamentDiameter, DefaultFilamentDiameter},
+		RammingTimes:            []float64{0, 0},
+		RammingVolumes:          []float64{0, 0},
+		ToolChanges:             []int{0, 0},
+		WipeTower:               false,
+		WipingVolumes:           []float64{0, 0, 0, 0},
+		MinimalPurge:            []float64{0, 0},
+		Objects:                 []BoundingBox{},
+		RetractionSpeeds:        []float64{-1, -1},
+		DeretractionSpeeds:      []float64{-1, -1},
+		ZHops:                   []float64{-1, -1},
+		MaxLayerZ:               -1,
+		ExtrusionMultipliers:    []float64{1, 1},
+		WipeTowerX:              -1,
+		WipeTowerY:              -1,
+		WipeTowerWidth:          -1,
+		FanSpeeds:               []float64{-1, -1},
+		MinFanSpeeds:            []float64{-1, -1},
+
+		FirstLayerBedTemperatures: []float64{-1, -1},
 	}
 
 }
 
 var Params = NewParams()
 
-func ParseParams(gcodes []*GcodeBlock) error {
+// MarshalJSON writes the thumbnail as its data URI
+func (p slicerParams) MarshalJSON() ([]byte, error) {
+	type params slicerParams
+	return json.Marshal(struct {
+		*params
+		Thumbnail string `json:"thumbnail"`
+	}{(*params)(&p), string(p.Thumbnail)})
+}
+
+// ReadParams parses the gcodes of r like ParseSlicerParams
+func ReadParams(r io.Reader) (*slicerParams, error) {
+	gcodes, err := ReadGcodes(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSlicerParams(gcodes)
+}
+
+// RecomputeFilament replaces the filament used reported by the slicer with the
+// computed one, the computed value is always used when the slicer reports nothing.
+var RecomputeFilament = false
+
+// ThumbnailWidth and ThumbnailHeight select the thumbnail closest to the size
+// for the header, 0 selects the largest one
+var (
+	ThumbnailWidth  = 0
+	ThumbnailHeight = 0
+)
+
+// PlaceholderThumbnail adds a placeholder thumbnail to a file without one,
+// the touchscreen shows a blank tile otherwise
+var PlaceholderThumbnail = false
+
+// Logger logs each setting matched while parsing and the parsed params, nil
+// is silent
+var Logger *log.Logger
+
+// debugf logs to Logger when it is set
+func debugf(format string, v ...any) {
+	if Logger != nil {
+		Logger.Printf(format, v...)
+	}
+}
+
+// logParams logs the fields of p to Logger, the thumbnails are left out
+func logParams(p *slicerParams, err error) {
+	if Logger == nil {
+		return
+	}
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() || f.Name == "Thumbnail" || f.Name == "Thumbnails" {
+			continue
+		}
+		Logger.Printf("%s: %v", f.Name, v.Field(i).Interface())
+	}
+	if err != nil {
+		Logger.Printf("error: %s", err)
+	}
+}
+
+// BoundingBox is the extent of the extrusions of an object
+type BoundingBox struct {
+	Name string     `json:"name"`
+	Min  [3]float64 `json:"min"`
+	Max  [3]float64 `json:"max"`
+}
+
+func (b *BoundingBox) add(x, y, z float64) {
+	for i, v := range [3]float64{x, y, z} {
+		b.Min[i] = math.Min(b.Min[i], v)
+		b.Max[i] = math.Max(b.Max[i], v)
+	}
+}
+
+// extrusionCounter sums the net E of each tool, retractions and
+// de-retractions cancel each other out.
+type extrusionCounter struct {
+	relative bool
+	tool     int
+	selected bool
+	lastE    float64
+	used     []float64
+	unloads  []int
+	switches [2][2]int
+	x, y, z  float64
+	feedrate float64   // mm/min
+	peak     []float64 // mm/s of filament
+	objects  []BoundingBox
+	object   int     // index in objects, -1 outside of an object
+	topZ     float64 // mm of the highest extrusion in an object
+	complete bool    // an object went down to a Z below topZ, objects are printed one by one
+}
+
+// startObject continues the bounding box of a name, objects are printed by layer
+func (c *extrusionCounter) startObject(name string) {
+	for i := range c.objects {
+		if c.objects[i].Name == name {
+			c.object = i
+			return
+		}
+	}
+	inf := math.Inf(1)
+	c.objects = append(c.objects, BoundingBox{Name: name, Min: [3]float64{inf, inf, inf}, Max: [3]float64{-inf, -inf, -inf}})
+	c.object = len(c.objects) - 1
+}
+
+func (c *extrusionCounter) feed(g *GcodeBlock) {
+	cmd := g.Cmd()
+	switch cmd.Word() {
+	case 'T':
+		var t int
+		if err := cmd.AddrAs(&t); err == nil && t >= 0 {
+			t %= len(c.used)
+			if c.selected && t != c.tool {
+				c.unloads[c.tool]++
+				c.switches[c.tool][t]++
+			}
+			c.tool, c.selected = t, true
+		}
+	case 'M':
+		switch cmd.Addr() {
+		case "82":
+			c.relative = false
+		case "83":
+			c.relative = true
+		}
+	case 'G':
+		switch cmd.Addr() {
+		case "0", "1", "2", "3":
+			var x, y, z, f, e float32
+			if g.GetParam('F', &f) == nil {
+				c.feedrate = float64(f)
+			}
+			if g.GetParam('Z', &z) == nil {
+				c.z = float64(z)
+			}
+			fromX, fromY := c.x, c.y
+			dist := 0.0
+			if g.GetParam('X', &x) == nil {
+				dist, c.x = math.Abs(float64(x)-c.x), float64(x)
+			}
+			if g.GetParam('Y', &y) == nil {
+				dist, c.y = math.Hypot(dist, float64(y)-c.y), float64(y)
+			}
+			if err := g.GetParam('E', &e); err != nil {
+				return
+			}
+			de := float64(e)
+			if !c.relative {
+				de -= c.lastE
+			}
+			c.used[c.tool] += de
+			if de > 0 && c.object >= 0 {
+				// by layer the Z of the objects only goes up
+				if c.z < c.topZ-0.01 {
+					c.complete = true
+				}
+				c.topZ = math.Max(c.topZ, c.z)
+				c.objects[c.object].add(fromX, fromY, c.z)
+				c.objects[c.object].add(c.x, c.y, c.z)
+			}
+			if !c.relative {
+				c.lastE = float64(e)
+			}
+			// arcs are longer than the chord, their speed is overestimated
+			if de > 0 && dist > 0 && c.feedrate > 0 {
+				c.peak[c.tool] = math.Max(c.peak[c.tool], de/dist*c.feedrate/60)
+			}
+		case "92":
+			var e float32
+			if err := g.GetParam('E', &e); err == nil {
+				c.lastE = float64(e)
+			}
+		}
+	}
+}
+
+// AllowJ1V0 keeps the detected version for J1 instead of forcing v1,
+// the stock J1 firmware rejects v0 files.
+var AllowJ1V0 = false
+
+// ForceVersion overrides the detected G-code version when it is 0 or 1, it
+// wins over the printer notes. J1 and IDEX still require v1, Validate warns.
+var ForceVersion = -1
+
+// ForceModel overrides the detected printer model when it is not empty, it is
+// one of the Model constants
+var ForceModel = ""
+
+// modelNames are the short names of the Model constants for ParseModel
+var modelNames = []struct{ name, model string }{
+	{"A150", ModelA150},
+	{"A250", ModelA250},
+	{"A350", ModelA350},
+	{"A400", ModelA400},
+	{"J1", ModelJ1},
+}
+
+// ParseModel returns the Model constant of a short name like "A350" or of the
+// full model name, case-insensitively
+func ParseModel(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	names := make([]string, 0, len(modelNames))
+	for _, m := range modelNames {
+		if strings.EqualFold(name, m.name) || strings.EqualFold(name, m.model) {
+			return m.model, nil
+		}
+		names = append(names, m.name)
+	}
+	return "", fmt.Errorf("unknown model %q, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// ParseParams parses the gcodes into Params, for the CLI
+func ParseParams(gcodes []*GcodeBlock) (err error) {
+	Params, err = ParseSlicerParams(gcodes)
+	return
+}
+
+// ParseSlicerParams parses the settings of the slicer and scans the moves of
+// gcodes, the parameters are returned with the error as far as they are parsed.
+func ParseSlicerParams(gcodes []*GcodeBlock) (*slicerParams, error) {
+	return parseSlicerParams(gcodes, false)
+}
+
+// ParseSlicerParamsQuiet is ParseSlicerParams without logging to Logger, for
+// the params of an input that is parsed again once it is fixed
+func ParseSlicerParamsQuiet(gcodes []*GcodeBlock) (*slicerParams, error) {
+	return parseSlicerParams(gcodes, true)
+}
+
+func parseSlicerParams(gcodes []*GcodeBlock, quiet bool) (*slicerParams, error) {
+	s := newParamsScanner(quiet)
+	for _, gcode := range gcodes {
+		if err := s.feed(gcode); err != nil {
+			return s.p, err
+		}
+	}
+	return s.finish()
+}
+
+// paramsScanner parses the params one line at a time, so a file can be parsed
+// without keeping it in memory. finish processes the params after the last line.
+type paramsScanner struct {
+	p      *slicerParams
+	feed   func(gcode *GcodeBlock) error
+	finish func() (*slicerParams, error)
+	quiet  bool // nothing is logged to Logger
+}
+
+// getSetting is getSetting, a quiet scanner does not log the setting
+func (s *paramsScanner) getSetting(line string, key ...string) (string, bool) {
+	if s.quiet {
+		_, v, ok := lookupSetting(line, key...)
+		return v, ok
+	}
+	return getSetting(line, key...)
+}
+
+// getS3DSetting is getS3DSetting, a quiet scanner does not log the setting
+func (s *paramsScanner) getS3DSetting(line string, key ...string) (string, bool) {
+	if s.quiet {
+		_, v, ok := lookupS3DSetting(line, key...)
+		return v, ok
+	}
+	return getS3DSetting(line, key...)
+}
+
+func newParamsScanner(quiet bool) *paramsScanner {
 	var (
 		thumbnail_bytes [][]byte
 		thumbnail_start = false
@@ -109,200 +855,657 @@ func ParseParams(gcodes []*GcodeBlock) error {
 
 		retract_len          = []float64{-1, -1}
 		filament_retract_len = []float64{-1, -1}
+
+		line_width             string
+		first_layer_line_width string
+		min_feature_size       string
+		min_bead_width         string
+		arc_tolerance          string
+		speeds                 = map[string]string{}
+
+		printable       bool
+		weight_reported bool
+		no_brim         bool
+		s3d_temps       []float64 // temperatureSetpointTemperatures of the controllers
+		s3d_heated_bed  []string  // a controller of temperatureHeatedBed heats the bed
+		fan_speed       []float64 // a fixed speed, FanSpeeds without a max
+		extrusion       = extrusionCounter{used: []float64{0, 0}, unloads: []int{0, 0}, peak: []float64{0, 0}, object: -1}
+		trailing        []*GcodeBlock // the lines of curaSetting at the end
+
+		p = NewParams()
 	)
+	s := &paramsScanner{p: p, quiet: quiet}
 
-	//////// scan
-	Params = NewParams()
-	for _, gcode := range gcodes {
-		Params.TotalLines++
+	s.feed = func(gcode *GcodeBlock) error {
+		p.TotalLines++
+
+		if !printable && (gcode.Is("G0") || gcode.Is("G1") || gcode.Is("G2") || gcode.Is("G3")) {
+			printable = true
+		}
+		if gcode.Is("M73") {
+			p.HasProgress = true
+		}
+		extrusion.feed(gcode)
 
 		line := gcode.String()
+		// the settings of Cura close the file, they are decoded at finish
+		if strings.HasPrefix(line, curaSetting) {
+			trailing = append(trailing, gcode)
+		} else {
+			trailing = nil
+		}
 		if len(line) < 1 {
-			continue
+			return nil
+		}
+
+		if p.SlicerName == "" && line[0] == ';' && p.TotalLines <= generatorLines {
+			if name, version, ok := parseGenerator(line); ok {
+				p.SlicerName, p.SlicerVersion = name, version
+			}
 		}
 
 		if strings.HasPrefix(line, "; Postprocessed by smfix") {
-			return ErrIsFixed
+			return ErrAlreadyFixed
 		} else if strings.HasPrefix(line, "; generated by ") {
-			Params.TotalLines = 1 // reset at first line
+			p.TotalLines = 1 // reset at first line
 		} else if strings.HasPrefix(line, "; SNAPMAKER_GCODE_V1") {
-			Params.Version = 1
+			p.Version = 1
 		} else if strings.HasPrefix(line, "M605 S2") {
-			Params.PrintMode = PrintModeDuplication
+			p.PrintMode = PrintModeDuplication
 		} else if strings.HasPrefix(line, "M605 S3") {
-			Params.PrintMode = PrintModeMirror
+			p.PrintMode = PrintModeMirror
 		} else if strings.HasPrefix(line, "M605 S4") {
-			Params.PrintMode = PrintModeBackup
-		} else if strings.HasPrefix(line, "; thumbnail begin ") {
+			p.PrintMode = PrintModeBackup
+		} else if name, ok := strings.CutPrefix(line, "; printing object "); ok {
+			extrusion.startObject(name)
+		} else if strings.HasPrefix(line, "; stop printing object ") {
+			extrusion.object = -1
+		} else if _, m, ok := parseLayerOf(line); ok {
+			p.ProgressLayers = m
+		} else if isThumbnailBegin(line) {
 			thumbnail_start = true
-		} else if strings.HasPrefix(line, "; thumbnail end") {
+		} else if isThumbnailEnd(line) {
 			thumbnail_bytes = append(thumbnail_bytes, []byte(line))
 			thumbnail_start = false
-		} else if v, ok := getSetting(line, "filament used [mm]"); ok {
-			Params.FilamentUsed = splitFloat(v)
-		} else if v, ok := getSetting(line, "filament used [g]"); ok {
-			Params.FilamentUsedWeight = splitFloat(v)
-		} else if v, ok := getSetting(line, "estimated printing time (normal mode)"); ok {
-			Params.EstimatedTimeSec = convertEstimatedTime(v)
-		} else if v, ok := getSetting(line, "filament_type"); ok {
-			Params.FilamentTypes = split(v)
-		} else if v, ok := getSetting(line, "total_layer_number", "total layers count" /* bbs*/); ok {
+		} else if v, ok := s.getSetting(line, "filament used [mm]"); ok {
+			p.FilamentUsed = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "filament used [g]"); ok {
+			p.FilamentUsedWeight = splitFloat(v)
+			weight_reported = true
+		} else if v, ok := s.getSetting(line, "filament used [cm3]"); ok {
+			p.FilamentUsedVolume = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "estimated printing time (normal mode)", "estimated printing time (silent mode)"); ok && (p.SlicerTimeSec == 0 || strings.Contains(line, "(normal mode)")) {
+			p.SlicerTimeSec = convertEstimatedTime(v)
+		} else if v, ok := strings.CutPrefix(line, "; Estimated Build Time:" /*kisslicer*/); ok && p.SlicerTimeSec == 0 {
+			p.SlicerTimeSec = convertEstimatedTime(v)
+		} else if p.SlicerName == "Simplify3D" && strings.HasPrefix(line, ";   ") {
+			// the settings of Simplify3D are ";   key,value", mm/min speeds
+			if v, ok := s.getS3DSetting(line, "extruderDiameter"); ok {
+				p.NozzleDiameters = splitFloat(v)
+			} else if v, ok := s.getS3DSetting(line, "extruderRetractionDistance"); ok {
+				retract_len = splitFloat(v)
+			} else if v, ok := s.getS3DSetting(line, "extruderRetractionSpeed"); ok {
+				p.RetractionSpeeds = splitFloat(v)
+				for i, speed := range p.RetractionSpeeds {
+					p.RetractionSpeeds[i] = speed / 60
+				}
+			} else if v, ok := s.getS3DSetting(line, "layerHeight"); ok {
+				p.LayerHeight = parseFloat(v)
+			} else if v, ok := s.getS3DSetting(line, "defaultSpeed"); ok {
+				p.PrintSpeedSec = parseFloat(v) / 60
+			} else if v, ok := s.getS3DSetting(line, "firstLayerUnderspeed"); ok {
+				speeds[SpeedFirstLayer] = fmt.Sprintf("%g%%", parseFloat(v)*100)
+			} else if v, ok := s.getS3DSetting(line, "rapidXYspeed"); ok {
+				speeds[SpeedTravel] = fmt.Sprint(parseFloat(v) / 60)
+			} else if v, ok := s.getS3DSetting(line, "printMaterial"); ok {
+				p.FilamentTypes = split(v)
+			} else if v, ok := s.getS3DSetting(line, "filamentDiameters"); ok {
+				p.FilamentDiameters = splitFloat(strings.ReplaceAll(v, "|", ","))
+			} else if v, ok := s.getS3DSetting(line, "filamentDensities"); ok {
+				p.FilamentDensities = splitFloat(strings.ReplaceAll(v, "|", ","))
+			} else if v, ok := s.getS3DSetting(line, "temperatureSetpointTemperatures"); ok {
+				s3d_temps = splitFloat(v)
+			} else if v, ok := s.getS3DSetting(line, "temperatureHeatedBed"); ok {
+				s3d_heated_bed = split(v)
+			} else if v, ok := s.getS3DSetting(line, "extruderTemp"); ok {
+				p.NozzleTemperatures = splitFloat(v)
+			} else if v, ok := s.getS3DSetting(line, "bedTemperature"); ok {
+				p.FirstLayerBedTemperatures = splitFloat(v)
+			} else if v, ok := s.getS3DSetting(line, "Build time"); ok {
+				p.SlicerTimeSec = parseBuildTime(v)
+			} else if v, ok := s.getS3DSetting(line, "Filament length"); ok {
+				p.FilamentUsed[0] = parseFloat(strings.Fields(v)[0])
+			} else if v, ok := s.getS3DSetting(line, "Plastic weight"); ok {
+				p.FilamentUsedWeight[0] = parseFloat(strings.Fields(v)[0])
+				weight_reported = true
+			}
+		} else if v, ok := s.getSetting(line, "destring_length" /*kisslicer*/); ok {
+			// one extruder
+			retract_len = []float64{parseFloat(v), parseFloat(v)}
+		} else if v, ok := s.getSetting(line, "temperature_C" /*kisslicer*/); ok && p.NozzleTemperatures[0] == -1 {
+			p.NozzleTemperatures = []float64{parseFloat(v), parseFloat(v)}
+		} else if v, ok := s.getSetting(line, "filament_type"); ok {
+			p.FilamentTypes = split(v)
+		} else if v, ok := s.getSetting(line, "total_layer_number", "total layers count" /* bbs*/); ok {
 			if layers, err := ParseInt([]byte(v)); err == nil { // ignore errors
-				Params.TotalLayers = int(layers)
+				p.TotalLayers = int(layers)
 			}
-		} else if v, ok := getSetting(line, "filament_retract_length", "filament_retraction_length" /*bbs*/); ok {
+		} else if v, ok := s.getSetting(line, "filament_retract_length", "filament_retraction_length" /*bbs*/); ok {
 			filament_retract_len = splitFloat(v)
-		} else if v, ok := getSetting(line, "retract_length", "retraction_length" /*bbs*/); ok {
+		} else if v, ok := s.getSetting(line, "retract_length", "retraction_length" /*bbs*/); ok {
 			retract_len = splitFloat(v)
-		} else if v, ok := getSetting(line, "retract_length_toolchange"); ok {
-			Params.SwitchRetraction = splitFloat(v)
-		} else if v, ok := getSetting(line, "nozzle_diameter"); ok {
-			Params.NozzleDiameters = splitFloat(v)
-		} else if v, ok := getSetting(line, "layer_height", "first_layer_height"); ok && Params.LayerHeight == 0 {
-			Params.LayerHeight = parseFloat(v)
-		} else if v, ok := getSetting(line, "printer_notes"); ok {
-			Params.PrinterNotes = v
-		} else if v, ok := getSetting(line, "max_print_speed", "outer_wall_speed" /*bbs*/); ok && Params.PrintSpeedSec == 0 {
-			Params.PrintSpeedSec = parseFloat(v)
-		} else if v, ok := getSetting(line, "first_layer_temperature", "nozzle_temperature_initial_layer" /*bbs*/); ok && Params.NozzleTemperatures[0] == -1 {
-			Params.NozzleTemperatures = splitFloat(v)
-		} else if v, ok := getSetting(line, "first_layer_bed_temperature", "hot_plate_temp_initial_layer" /*bbs*/); ok && Params.BedTemperatures[0] == -1 {
-			Params.BedTemperatures = splitFloat(v)
-		} else if v, ok := getSetting(line, "min_x"); ok {
-			Params.MinX = parseFloat(v)
-		} else if v, ok := getSetting(line, "min_y"); ok {
-			Params.MinY = parseFloat(v)
-		} else if v, ok := getSetting(line, "min_z"); ok {
-			Params.MinZ = parseFloat(v)
-		} else if v, ok := getSetting(line, "max_x"); ok {
-			Params.MaxX = parseFloat(v)
-		} else if v, ok := getSetting(line, "max_y"); ok {
-			Params.MaxY = parseFloat(v)
-		} else if v, ok := getSetting(line, "max_z"); ok {
-			Params.MaxZ = parseFloat(v)
-		} else if v, ok := getSetting(line, "printer_model"); ok {
+		} else if v, ok := s.getSetting(line, "retract_speed", "retraction_speed" /*bbs*/); ok {
+			p.RetractionSpeeds = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "deretract_speed", "deretraction_speed" /*bbs*/, "retract_restart_extra_speed"); ok {
+			p.DeretractionSpeeds = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "retract_lift", "z_hop" /*bbs*/); ok {
+			p.ZHops = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "max_fan_speed", "fan_max_speed" /*bbs*/); ok {
+			p.FanSpeeds = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "fan_speed"); ok {
+			fan_speed = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "min_fan_speed", "fan_min_speed" /*bbs*/); ok {
+			p.MinFanSpeeds = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "fan_always_on"); ok {
+			// one value for each filament
+			for _, on := range split(v) {
+				p.FanAlwaysOn = p.FanAlwaysOn || parseBool(on)
+			}
+		} else if v, ok := s.getSetting(line, "retract_length_toolchange"); ok {
+			p.SwitchRetractions = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "nozzle_diameter"); ok {
+			p.NozzleDiameters = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "layer_height", "first_layer_height"); ok && p.LayerHeight == 0 {
+			p.LayerHeight = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "printer_notes"); ok {
+			p.PrinterNotes = v
+		} else if v, ok := s.getSetting(line, "print_settings_id"); ok {
+			p.PrintProfile = splitNames(v)[0]
+		} else if v, ok := s.getSetting(line, "printer_settings_id"); ok {
+			p.PrinterProfile = splitNames(v)[0]
+		} else if v, ok := s.getSetting(line, "filament_settings_id"); ok {
+			p.FilamentProfiles = splitNames(v)
+		} else if v, ok := s.getSetting(line, "max_print_speed"); ok && p.PrintSpeedSec == 0 {
+			p.PrintSpeedSec = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "outer_wall_speed" /*bbs*/); ok {
+			speeds[SpeedExternalPerimeter] = v
+			if p.PrintSpeedSec == 0 {
+				p.PrintSpeedSec = parseFloat(v)
+			}
+		} else if v, ok := s.getSetting(line, "external_perimeter_speed"); ok {
+			speeds[SpeedExternalPerimeter] = v
+		} else if v, ok := s.getSetting(line, "perimeter_speed", "inner_wall_speed" /*bbs*/); ok {
+			speeds[SpeedPerimeter] = v
+		} else if v, ok := s.getSetting(line, "infill_speed", "sparse_infill_speed" /*bbs*/); ok {
+			speeds[SpeedSparseInfill] = v
+		} else if v, ok := s.getSetting(line, "solid_infill_speed", "internal_solid_infill_speed" /*bbs*/); ok {
+			speeds[SpeedSolidInfill] = v
+		} else if v, ok := s.getSetting(line, "top_solid_infill_speed", "top_surface_speed" /*bbs*/); ok {
+			speeds[SpeedTopSolidInfill] = v
+		} else if v, ok := s.getSetting(line, "bridge_speed"); ok {
+			speeds[SpeedBridge] = v
+		} else if v, ok := s.getSetting(line, "support_material_speed", "support_speed" /*bbs*/); ok {
+			speeds[SpeedSupport] = v
+		} else if v, ok := s.getSetting(line, "first_layer_speed", "initial_layer_speed" /*bbs*/); ok {
+			speeds[SpeedFirstLayer] = v
+		} else if v, ok := s.getSetting(line, "travel_speed"); ok {
+			speeds[SpeedTravel] = v
+		} else if v, ok := s.getSetting(line, "gap_fill_speed", "gap_infill_speed" /*bbs*/); ok {
+			speeds[SpeedGapFill] = v
+		} else if v, ok := s.getSetting(line, "extrusion_multiplier", "filament_flow_ratio" /*bbs*/); ok {
+			p.ExtrusionMultipliers = splitRatio(v, false)
+		} else if v, ok := s.getSetting(line, "material_flow" /*cura*/); ok {
+			p.ExtrusionMultipliers = splitRatio(v, true)
+		} else if v, ok := s.getSetting(line, "bridge_flow_ratio", "bridge_flow" /*bbs*/); ok {
+			p.FlowRatios[SpeedBridge] = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "first_layer_flow_ratio", "initial_layer_flow_ratio" /*bbs*/); ok {
+			p.FlowRatios[SpeedFirstLayer] = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "filament_density"); ok {
+			p.FilamentDensities = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "first_layer_temperature", "nozzle_temperature_initial_layer" /*bbs*/); ok && p.NozzleTemperatures[0] == -1 {
+			p.NozzleTemperatures = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "first_layer_bed_temperature", "hot_plate_temp_initial_layer" /*bbs*/); ok && p.FirstLayerBedTemperatures[0] == -1 {
+			p.FirstLayerBedTemperatures = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "bed_temperature", "hot_plate_temp" /*bbs*/); ok && p.BedTemperatures[0] == -1 {
+			p.BedTemperatures = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "chamber_temperature", "chamber_temp" /*bbs*/); ok {
+			p.ChamberTemperatures = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "min_x"); ok {
+			p.MinX, p.HasBounds = parseFloat(v), true
+		} else if v, ok := s.getSetting(line, "min_y"); ok {
+			p.MinY, p.HasBounds = parseFloat(v), true
+		} else if v, ok := s.getSetting(line, "min_z"); ok {
+			p.MinZ, p.HasBounds = parseFloat(v), true
+		} else if v, ok := s.getSetting(line, "max_x"); ok {
+			p.MaxX, p.HasBounds = parseFloat(v), true
+		} else if v, ok := s.getSetting(line, "max_y"); ok {
+			p.MaxY, p.HasBounds = parseFloat(v), true
+		} else if v, ok := s.getSetting(line, "max_z"); ok {
+			p.MaxZ, p.HasBounds = parseFloat(v), true
+		} else if v, ok := s.getSetting(line, "max_layer_z"); ok {
+			p.MaxLayerZ = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "avoid_crossing_perimeters", "reduce_crossing_wall" /*bbs*/); ok {
+			p.AvoidCrossingPerimeters = parseBool(v)
+		} else if v, ok := s.getSetting(line, "single_extruder_multi_material"); ok {
+			p.SingleExtruderMM = parseBool(v)
+		} else if v, ok := s.getSetting(line, "filament_diameter"); ok {
+			p.FilamentDiameters = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "wipe_tower", "enable_prime_tower" /*bbs*/); ok {
+			p.WipeTower = parseBool(v)
+		} else if v, ok := s.getSetting(line, "complete_objects"); ok {
+			p.IsSequential = p.IsSequential || parseBool(v)
+		} else if v, ok := s.getSetting(line, "print_sequence" /*bbs, cura*/); ok {
+			p.IsSequential = p.IsSequential || v == "by object" || v == "one_at_a_time"
+		} else if v, ok := s.getSetting(line, "wipe_tower_x"); ok {
+			p.WipeTowerX = splitFloat(v)[0]
+		} else if v, ok := s.getSetting(line, "wipe_tower_y"); ok {
+			p.WipeTowerY = splitFloat(v)[0]
+		} else if v, ok := s.getSetting(line, "wipe_tower_width", "prime_tower_width" /*bbs*/); ok {
+			p.WipeTowerWidth = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "wiping_volumes_matrix", "flush_volumes_matrix" /*bbs*/); ok {
+			if volumes := splitFloat(v); len(volumes) >= 4 {
+				p.WipingVolumes = volumes[:4]
+			}
+		} else if v, ok := s.getSetting(line, "filament_minimal_purge_on_wipe_tower"); ok {
+			p.MinimalPurge = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "filament_ramming_parameters"); ok {
+			for i, r := range splitQuoted(v) {
+				if i < len(p.RammingTimes) {
+					p.RammingTimes[i], p.RammingVolumes[i] = parseRamming(r)
+				}
+			}
+		} else if v, ok := s.getSetting(line, "filament_start_gcode"); ok {
+			p.FilamentStartGcode = splitQuoted(v)
+		} else if v, ok := s.getSetting(line, "filament_end_gcode"); ok {
+			p.FilamentEndGcode = splitQuoted(v)
+		} else if v, ok := s.getSetting(line, "first_layer_extrusion_width", "initial_layer_line_width" /*bbs*/); ok {
+			first_layer_line_width = v
+		} else if v, ok := s.getSetting(line, "extrusion_width", "line_width" /*bbs*/); ok {
+			line_width = v
+		} else if v, ok := s.getSetting(line, "perimeter_generator", "wall_generator" /*bbs*/); ok {
+			p.WallGenerator = strings.ToLower(v)
+		} else if v, ok := s.getSetting(line, "skirts", "skirt_loops" /*bbs*/); ok {
+			p.SkirtLoops = int(parseFloat(v))
+		} else if v, ok := s.getSetting(line, "skirt_height"); ok {
+			p.SkirtHeight = int(parseFloat(v))
+		} else if v, ok := s.getSetting(line, "skirt_distance"); ok {
+			p.SkirtDistance = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "draft_shield"); ok {
+			p.DraftShield = v != "disabled" && v != "limited" && parseBool(v)
+		} else if v, ok := s.getSetting(line, "machine_max_jerk_x"); ok {
+			// normal and silent mode
+			if x := splitFloat(v); len(x) > 0 {
+				p.Jerk[0] = x[0]
+			}
+		} else if v, ok := s.getSetting(line, "machine_max_jerk_y"); ok {
+			if y := splitFloat(v); len(y) > 0 {
+				p.Jerk[1] = y[0]
+			}
+		} else if v, ok := s.getSetting(line, "machine_max_junction_deviation"); ok {
+			if j := splitFloat(v); len(j) > 0 {
+				p.JunctionDeviation = j[0]
+			}
+		} else if v, ok := s.getSetting(line, "machine_min_extruding_rate"); ok {
+			p.MinExtrudingRate = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "default_acceleration"); ok {
+			p.Accelerations[AccelerationDefault] = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "outer_wall_acceleration"); ok {
+			p.Accelerations[AccelerationOuterWall] = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "inner_wall_acceleration"); ok {
+			p.Accelerations[AccelerationInnerWall] = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "travel_acceleration"); ok {
+			p.TravelAcceleration = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "max_print_height", "printable_height" /*bbs*/); ok {
+			p.MaxPrintHeight = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "perimeters", "wall_loops" /*bbs*/); ok {
+			p.WallLoops = int(parseFloat(v))
+		} else if v, ok := s.getSetting(line, "wall_distribution_count"); ok {
+			p.WallDistributionCount = int(parseFloat(v))
+		} else if v, ok := s.getSetting(line, "seam_position"); ok {
+			p.SeamPosition = strings.ToLower(v)
+		} else if v, ok := s.getSetting(line, "min_feature_size"); ok {
+			min_feature_size = v
+		} else if v, ok := s.getSetting(line, "min_bead_width"); ok {
+			min_bead_width = v
+		} else if v, ok := s.getSetting(line, "max_volumetric_extrusion_rate_slope_positive", "max_volumetric_extrusion_rate_slope"); ok {
+			p.FlowRampSlope = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "filament_max_volumetric_speed"); ok {
+			p.MaxVolumetricSpeeds = splitFloat(v)
+		} else if v, ok := s.getSetting(line, "fill_pattern", "sparse_infill_pattern" /*bbs*/); ok {
+			p.InfillPattern = normalizePattern(v)
+		} else if v, ok := s.getSetting(line, "support_material_pattern", "support_base_pattern" /*bbs*/); ok {
+			p.SupportPattern = normalizePattern(v)
+		} else if v, ok := s.getSetting(line, "support_material_interface_layers", "support_interface_top_layers" /*bbs*/); ok {
+			p.SupportInterfaceLayers = int(parseFloat(v))
+		} else if v, ok := s.getSetting(line, "support_material_interface_pattern", "support_interface_pattern" /*bbs*/); ok {
+			p.SupportInterfacePattern = normalizePattern(v)
+		} else if v, ok := s.getSetting(line, "support_material_interface_spacing", "support_interface_spacing" /*bbs*/); ok {
+			p.SupportInterfaceSpacing = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "interface_shells"); ok {
+			p.InterfaceShells = parseBool(v)
+		} else if v, ok := s.getSetting(line, "top_fill_pattern", "top_surface_pattern" /*bbs*/); ok {
+			p.TopPattern = normalizePattern(v)
+		} else if v, ok := s.getSetting(line, "bottom_fill_pattern", "bottom_surface_pattern" /*bbs*/); ok {
+			p.BottomPattern = normalizePattern(v)
+		} else if v, ok := s.getSetting(line, "solid_fill_pattern", "internal_solid_infill_pattern" /*bbs*/); ok {
+			p.SolidInfillPattern = normalizePattern(v)
+		} else if v, ok := s.getSetting(line, "brim_width"); ok {
+			p.BrimWidth = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "brim_ears"); ok {
+			p.BrimEars = parseBool(v)
+		} else if v, ok := s.getSetting(line, "brim_type" /*bbs*/); ok {
+			switch v {
+			case "brim_ears":
+				p.BrimEars = true
+			case "no_brim", "none", "skirt", "raft": // the last ones are the adhesion_type of Cura
+				no_brim = true
+			}
+		} else if v, ok := s.getSetting(line, "support_material", "enable_support" /*bbs*/); ok {
+			p.HasSupport = parseBool(v)
+		} else if v, ok := s.getSetting(line, "brim_ears_detection_length"); ok {
+			p.BrimEarsDetectionLength = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "resolution"); ok {
+			p.Resolution = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "gcode_resolution"); ok {
+			p.GcodeResolution = parseFloat(v)
+		} else if v, ok := s.getSetting(line, "enable_arc_fitting" /*bbs*/); ok {
+			p.ArcFitting = parseBool(v)
+		} else if v, ok := s.getSetting(line, "arc_fitting"); ok {
+			p.ArcFitting = v != "disabled" && parseBool(v)
+		} else if v, ok := s.getSetting(line, "arc_fitting_tolerance"); ok {
+			arc_tolerance = v
+		} else if v, ok := s.getSetting(line, "printer_model"); ok {
 			model = v
-		} else if v, ok := getSetting(line, "bed_shape"); ok {
+		} else if v, ok := s.getSetting(line, "bed_shape"); ok {
 			bed_shape = v
-			// } else if v, ok := getSetting(line, "compatible_printers_condition_cummulative", "print_compatible_printers" /*bbs*/); ok {
+			// } else if v, ok := s.getSetting(line, "compatible_printers_condition_cummulative", "print_compatible_printers" /*bbs*/); ok {
 			// 	printers_condition = v
 		}
 
 		if thumbnail_start {
 			thumbnail_bytes = append(thumbnail_bytes, []byte(line))
 		}
+		return nil
 	}
 
-	//////// process params
-	if len(thumbnail_bytes) > 0 {
-		Params.Thumbnail = convertThumbnail(thumbnail_bytes)
-	}
+	finish := func() (*slicerParams, error) {
+		// the settings of Cura are scanned after the gcodes
+		cura := curaSettings(trailing)
+		for _, gcode := range cura {
+			s.feed(gcode)
+		}
 
-	Params.Retractions = retract_len
-	// use filament_retract_len overwrite retract_len
-	if filament_retract_len[0] > 0 {
-		Params.Retractions[0] = filament_retract_len[0]
-	}
-	if filament_retract_len[1] > 0 {
-		Params.Retractions[1] = filament_retract_len[1]
-	}
+		// the temperature controllers of Simplify3D heat a nozzle or the bed
+		if p.NozzleTemperatures[0] == -1 && len(s3d_temps) > 0 {
+			var nozzles, beds []float64
+			for i, t := range s3d_temps {
+				if i < len(s3d_heated_bed) && s3d_heated_bed[i] == "1" {
+					beds = append(beds, t)
+				} else {
+					nozzles = append(nozzles, t)
+				}
+			}
+			for len(nozzles) < 2 {
+				nozzles = append(nozzles, -1)
+			}
+			p.NozzleTemperatures = nozzles
+			if len(beds) > 0 && p.FirstLayerBedTemperatures[0] == -1 {
+				p.FirstLayerBedTemperatures = []float64{beds[0], beds[0]}
+			}
+		}
 
-	if Params.FilamentUsed[0] > 0 {
-		Params.LeftExtruderUsed = true
-	} else {
-		// reset T0
-		Params.FilamentTypes[0] = "-"
-		Params.NozzleTemperatures[0] = 0
-		Params.BedTemperatures[0] = -1
-		Params.Retractions[0] = 0
-	}
+		//////// process params
+		p.TotalLines -= len(cura)
 
-	if Params.FilamentUsed[1] > 0 {
-		Params.RightExtruderUsed = true
-	} else {
-		// reset T1
-		Params.FilamentTypes[1] = "-"
-		Params.NozzleTemperatures[1] = 0
-		Params.BedTemperatures[1] = -1
-		Params.Retractions[1] = 0
-	}
+		if len(thumbnail_bytes) > 0 {
+			// a corrupted thumbnail would show a broken image
+			for _, t := range parseThumbnails(thumbnail_bytes) {
+				if _, err := t.Decode(); err == nil {
+					p.Thumbnails = append(p.Thumbnails, t)
+				}
+			}
+			if t, ok := SelectThumbnail(p.Thumbnails, ThumbnailWidth, ThumbnailHeight); ok {
+				p.Thumbnail = t.DataURI()
+				p.ThumbnailWidth, p.ThumbnailHeight = t.Width, t.Height
+			}
+		}
+		if len(p.Thumbnail) == 0 && PlaceholderThumbnail {
+			t := placeholderThumbnail()
+			p.Thumbnail = t.DataURI()
+			p.ThumbnailWidth, p.ThumbnailHeight = t.Width, t.Height
+		}
+
+		// brim_width is kept when the brim is turned off by its type
+		if no_brim {
+			p.BrimWidth = 0
+		}
+
+		// widths may be a percentage of the nozzle diameter
+		p.LineWidth = parseWidth(line_width, p.NozzleDiameters[0])
+		p.FirstLayerLineWidth = parseWidth(first_layer_line_width, p.NozzleDiameters[0])
+		p.MinFeatureSize = parseWidth(min_feature_size, p.NozzleDiameters[0])
+		p.MinBeadWidth = parseWidth(min_bead_width, p.NozzleDiameters[0])
+		p.ArcTolerance = parseWidth(arc_tolerance, p.NozzleDiameters[0])
+		p.Speeds = resolveSpeeds(speeds)
+		if v, ok := p.Speeds[SpeedFirstLayer]; ok {
+			p.FirstLayerSpeed = v
+		} else if v := speeds[SpeedFirstLayer]; strings.HasSuffix(v, "%") && p.PrintSpeedSec > 0 {
+			// a percentage of PrusaSlicer scales the speeds of the first layer
+			p.FirstLayerSpeed = p.PrintSpeedSec * parseFloat(strings.TrimSuffix(v, "%")) / 100
+		}
 
-	{
-		if Params.LeftExtruderUsed && Params.RightExtruderUsed {
-			Params.ToolHead = ToolheadDual
+		if p.FanSpeeds[0] == -1 && fan_speed != nil {
+			p.FanSpeeds = fan_speed
 		}
 
-		if Params.ToolHead == ToolheadSingle {
-			if strings.Contains(model, " Dual") || strings.Contains(Params.PrinterNotes, "_DUAL") {
-				Params.ToolHead = ToolheadDual
+		p.Retractions = retract_len
+		// use filament_retract_len overwrite retract_len
+		if filament_retract_len[0] > 0 {
+			p.Retractions[0] = filament_retract_len[0]
+		}
+		if filament_retract_len[1] > 0 {
+			p.Retractions[1] = filament_retract_len[1]
+		}
+
+		// a single extruder profile reports one diameter
+		for len(p.FilamentDiameters) < 2 {
+			p.FilamentDiameters = append(p.FilamentDiameters, DefaultFilamentDiameter)
+		}
+		for i, d := range p.FilamentDiameters {
+			if d <= 0 {
+				p.FilamentDiameters[i] = DefaultFilamentDiameter
+			}
+		}
+		p.ComputedFilamentUsed = extrusion.used
+		p.ToolChanges = extrusion.unloads
+		p.PeakFilamentSpeeds = extrusion.peak
+		p.toolSwitches = extrusion.switches
+		p.IsSequential = p.IsSequential || extrusion.complete
+		if p.TotalLayers == 0 {
+			p.TotalLayers = p.ProgressLayers
+		}
+		for _, o := range extrusion.objects {
+			// a marker without extrusions has no bounds
+			if o.Min[0] <= o.Max[0] {
+				p.Objects = append(p.Objects, o)
+			}
+		}
+		if len(p.Objects) > 0 {
+			// the bounds of the slicer cover every object
+			union := BoundingBox{Min: [3]float64{p.MinX, p.MinY, p.MinZ}, Max: [3]float64{p.MaxX, p.MaxY, p.MaxZ}}
+			if !p.HasBounds {
+				union = p.Objects[0]
+			}
+			for _, o := range p.Objects {
+				union.add(o.Min[0], o.Min[1], o.Min[2])
+				union.add(o.Max[0], o.Max[1], o.Max[2])
+			}
+			p.MinX, p.MinY, p.MinZ = union.Min[0], union.Min[1], union.Min[2]
+			p.MaxX, p.MaxY, p.MaxZ = union.Max[0], union.Max[1], union.Max[2]
+			p.HasBounds = true
+		}
+		// the touchscreen shows the corrected time, the header of V1 the one of the slicer
+		ramming := int(math.Round(p.RammingTimeSec()))
+		p.EstimatedTimeSec = int(math.Round(float64(p.SlicerTimeSec)*EstimatedTimeFactor)) + ramming
+		p.SlicerTimeSec += ramming
+		for i, used := range extrusion.used {
+			if i < len(p.FilamentUsed) && (RecomputeFilament || p.FilamentUsed[i] < 0) {
+				p.FilamentUsed[i] = used
+				if i < len(p.FilamentUsedWeight) {
+					p.FilamentUsedWeight[i] = p.FilamentWeight(i, used)
+				}
+			} else if i < len(p.FilamentUsedWeight) && p.FilamentUsedWeight[i] < 0 {
+				// the slicer reported the weight of fewer extruders than the length
+				p.FilamentUsedWeight[i] = p.FilamentWeight(i, p.FilamentUsed[i])
+			}
+		}
+		// the volume of the slicer does not depend on the filament diameter
+		for i, volume := range p.FilamentUsedVolume {
+			if i < len(p.FilamentUsedWeight) && volume >= 0 && !weight_reported && !RecomputeFilament {
+				p.FilamentUsedWeight[i] = volume * p.filamentDensity(i)
 			}
 		}
 
-	}
+		// a slicer reporting the bed temperature of some layers uses it for all
+		if p.FirstLayerBedTemperatures[0] == -1 {
+			p.FirstLayerBedTemperatures = append([]float64{}, p.BedTemperatures...)
+		} else if p.BedTemperatures[0] == -1 {
+			p.BedTemperatures = append([]float64{}, p.FirstLayerBedTemperatures...)
+		}
 
-	if Params.PrintMode == PrintModeMirror || Params.PrintMode == PrintModeDuplication {
-		// is IDEX
-		Params.Version = 1
-		Params.Model = ModelJ1
-	}
+		if p.nozzleUsed(0) {
+			p.LeftExtruderUsed = true
+		} else {
+			// reset T0
+			p.FilamentTypes[0] = "-"
+			p.NozzleTemperatures[0] = 0
+			p.BedTemperatures[0] = -1
+			p.FirstLayerBedTemperatures[0] = -1
+			p.Retractions[0] = 0
+		}
 
-	// overwrite slicer version
-	if strings.Contains(Params.PrinterNotes, "SNAPMAKER_GCODE_V1") {
-		Params.Version = 1
-	} else if strings.Contains(Params.PrinterNotes, "SNAPMAKER_GCODE_V0") {
-		Params.Version = 0
-	}
+		if p.nozzleUsed(1) {
+			p.RightExtruderUsed = true
+		} else {
+			// reset T1
+			p.FilamentTypes[1] = "-"
+			p.NozzleTemperatures[1] = 0
+			p.BedTemperatures[1] = -1
+			p.FirstLayerBedTemperatures[1] = -1
+			p.Retractions[1] = 0
+		}
 
-	{
-		// printer model && slicer version
-		var models = map[string]string{
-			"A150":    ModelA150,
-			"160x160": ModelA150,
+		{
+			p.IsArtisan = strings.Contains(model, "Artisan")
 
-			"A250":    ModelA250,
-			"230x250": ModelA250,
-			"220x235": ModelA250, // dual + qskit
+			if p.LeftExtruderUsed && p.RightExtruderUsed {
+				p.ToolHead = ToolheadDual
+			}
+
+			if p.ToolHead == ToolheadSingle {
+				// the toolhead of Artisan is dual even if one extruder is used
+				if strings.Contains(model, " Dual") || strings.Contains(p.PrinterNotes, "_DUAL") || p.IsArtisan {
+					p.ToolHead = ToolheadDual
+				}
+			}
 
-			"A350":    ModelA350,
-			"320x350": ModelA350,
-			"310x350": ModelA350, // dual
-			"320x335": ModelA350, // qskit
-			"310x335": ModelA350, // dual + qskit
+		}
 
-			"A400":    ModelA400,
-			"Artisan": ModelA400,
-			"400x400": ModelA400,
+		if p.PrintMode == PrintModeMirror || p.PrintMode == PrintModeDuplication {
+			// is IDEX
+			if !AllowJ1V0 {
+				p.Version = 1
+			}
+			p.Model = ModelJ1
+		}
 
-			"J1":      ModelJ1,
-			"312x200": ModelJ1,
-			"324x200": ModelJ1,
-			"300x200": ModelJ1,
+		// overwrite slicer version
+		if strings.Contains(p.PrinterNotes, "SNAPMAKER_GCODE_V1") {
+			p.Version = 1
+		} else if strings.Contains(p.PrinterNotes, "SNAPMAKER_GCODE_V0") {
+			p.Version = 0
 		}
-		for k, v := range models {
-			if strings.Contains(model, k) {
-				Params.Model = v
-				break
+
+		{
+			// printer model && slicer version
+			var models = map[string]string{
+				"A150":    ModelA150,
+				"160x160": ModelA150,
+
+				"A250":    ModelA250,
+				"A250T":   ModelA250,
+				"F250":    ModelA250, // linear modules
+				"230x250": ModelA250,
+				"220x235": ModelA250, // dual + qskit
+
+				"A350":    ModelA350,
+				"A350T":   ModelA350,
+				"F350":    ModelA350,
+				"320x350": ModelA350,
+				"310x350": ModelA350, // dual
+				"320x335": ModelA350, // qskit
+				"310x335": ModelA350, // dual + qskit
+
+				"A400":    ModelA400,
+				"Artisan": ModelA400,
+				"400x400": ModelA400,
+
+				"J1":      ModelJ1,
+				"312x200": ModelJ1,
+				"324x200": ModelJ1,
+				"300x200": ModelJ1,
+			}
+			// "Snapmaker 2.0 a350t" and "320 x 350" match too
+			normalize := func(s string) string {
+				return strings.ToUpper(strings.Join(strings.Fields(s), ""))
 			}
-			/*
-				if strings.Contains(printers_condition, k) {
-					Params.Model = v
+			model, bed_shape := normalize(model), normalize(bed_shape)
+			for k, v := range models {
+				k = normalize(k)
+				if strings.Contains(model, k) {
+					p.Model = v
 					break
 				}
-			*/
-			if strings.Contains(bed_shape, k) {
-				Params.Model = v
-				break
+				/*
+					if strings.Contains(printers_condition, k) {
+						p.Model = v
+						break
+					}
+				*/
+				if strings.Contains(bed_shape, k) {
+					p.Model = v
+					break
+				}
+			}
+			if ForceModel != "" {
+				p.Model = ForceModel
+			}
+			if p.Model == ModelJ1 && !AllowJ1V0 {
+				// but J1 only support v1
+				p.Version = 1
 			}
 		}
-		if Params.Model == ModelJ1 {
-			// but J1 only support v1
-			Params.Version = 1
+
+		if ForceVersion == 0 || ForceVersion == 1 {
+			p.Version = ForceVersion
 		}
-	}
 
-	if Params.TotalLines < 20 || Params.Model == "" || (Params.NozzleTemperatures[0] == -1 && Params.NozzleTemperatures[1] == -1) {
-		return ErrInvalidGcode
-	}
+		// the model and the version are resolved for Detect
+		if !printable {
+			return p, ErrNoPrintable
+		}
+		if p.TotalLines < 20 || p.Model == "" || (p.NozzleTemperatures[0] == -1 && p.NozzleTemperatures[1] == -1) {
+			return p, ErrInvalidGcode
+		}
 
-	return nil
+		return p, nil
+	}
+	s.finish = func() (*slicerParams, error) {
+		p, err := finish()
+		if !s.quiet {
+			logParams(p, err)
+		}
+		return p, err
+	}
+	return s
 }
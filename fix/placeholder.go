@@ -0,0 +1,72 @@
+package fix
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+)
+
+// PlaceholderSize is the width and height of the placeholder thumbnail, the
+// size of the thumbnails of Luban
+const PlaceholderSize = 300
+
+var placeholder struct {
+	once  sync.Once
+	thumb Thumbnail
+}
+
+// placeholderThumbnail returns a png of a cube for a file without a thumbnail
+func placeholderThumbnail() Thumbnail {
+	placeholder.once.Do(func() {
+		img := image.NewNRGBA(image.Rect(0, 0, PlaceholderSize, PlaceholderSize))
+		var (
+			background = color.NRGBA{0x2b, 0x2b, 0x2b, 0xff}
+			faces      = [3]color.NRGBA{
+				{0x9a, 0xc9, 0xf0, 0xff}, // top
+				{0x3d, 0x8b, 0xd0, 0xff}, // left
+				{0x1f, 0x5f, 0x99, 0xff}, // right
+			}
+			c    = float64(PlaceholderSize) / 2
+			edge = float64(PlaceholderSize) / 3
+		)
+		for y := 0; y < PlaceholderSize; y++ {
+			for x := 0; x < PlaceholderSize; x++ {
+				img.SetNRGBA(x, y, background)
+				if face := cubeFace(float64(x)-c, float64(y)-c, edge); face >= 0 {
+					img.SetNRGBA(x, y, faces[face])
+				}
+			}
+		}
+		var b bytes.Buffer
+		png.Encode(&b, img)
+		placeholder.thumb = Thumbnail{
+			Width:  PlaceholderSize,
+			Height: PlaceholderSize,
+			Type:   "image/png",
+			Data:   []byte(base64.StdEncoding.EncodeToString(b.Bytes())),
+		}
+	})
+	return placeholder.thumb
+}
+
+// cubeFace returns the visible face of an isometric cube centered at 0,0 at
+// x,y: 0 top, 1 left, 2 right, -1 outside
+func cubeFace(x, y, edge float64) int {
+	// the edges of the isometric projection are 30° from the horizontal
+	const cos30, sin30, tan30 = 0.8660254, 0.5, 0.5773503
+	// solve x,y = u*(cos30, sin30) + v*(-cos30, sin30) for the top face
+	u := (x/cos30 + y/sin30) / 2
+	v := (y/sin30 - x/cos30) / 2
+	switch {
+	case u >= -edge && u <= 0 && v >= -edge && v <= 0:
+		return 0
+	case x < 0 && x >= -edge*cos30 && y-x*tan30 >= 0 && y-x*tan30 <= edge:
+		return 1
+	case x >= 0 && x <= edge*cos30 && y+x*tan30 >= 0 && y+x*tan30 <= edge:
+		return 2
+	}
+	return -1
+}
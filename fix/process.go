@@ -0,0 +1,592 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxLineSize is the longest line that is read, some slicers write a thumbnail
+// or their settings on a single line
+var MaxLineSize = 16 << 20
+
+// ReadOptions configure how the lines of a file are scanned, the zero value
+// reads as ReadGcodes does
+type ReadOptions struct {
+	// MaxLineBytes is the longest line that is read, 0 is MaxLineSize. A
+	// longer line fails the read with bufio.ErrTooLong.
+	MaxLineBytes int
+	// Split splits the lines, nil is bufio.ScanLines which drops the \r of CRLF
+	Split bufio.SplitFunc
+}
+
+// newScanner scans the lines of r as o configures
+func newScanner(r io.Reader, o ReadOptions) *bufio.Scanner {
+	max := o.MaxLineBytes
+	if max <= 0 {
+		max = MaxLineSize
+	}
+	size := 64 * 1024
+	if size > max {
+		size = max
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, size), max)
+	if o.Split != nil {
+		sc.Split(o.Split)
+	}
+	return sc
+}
+
+// ReadGcodes parses all lines of r, G4 S0 is dropped. CRLF line endings are
+// read as LF, the output always ends lines with \n as Snapmaker expects.
+func ReadGcodes(r io.Reader) ([]*GcodeBlock, error) {
+	return ReadGcodesWith(r, ReadOptions{})
+}
+
+// ReadGcodesWith is ReadGcodes with the lines scanned as o configures
+func ReadGcodesWith(r io.Reader, o ReadOptions) ([]*GcodeBlock, error) {
+	gcodes := []*GcodeBlock{}
+	err := readLines(r, o, func(g *GcodeBlock) error {
+		gcodes = append(gcodes, g)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gcodes, nil
+}
+
+// readLines parses the lines of r one at a time as ReadGcodes does, fn is
+// called for each gcode and an error of fn stops the reading.
+func readLines(r io.Reader, o ReadOptions, fn func(g *GcodeBlock) error) error {
+	sc := newScanner(r, o)
+	for sc.Scan() {
+		line := sc.Text()
+
+		if strings.HasPrefix(line, "; Postprocessed by smfix") {
+			return ErrAlreadyFixed
+		}
+
+		g, err := ParseGcodeBlock(line)
+		if err == nil {
+			// ignore G4 S0
+			if g.Is("G4") {
+				var s int
+				if err := g.GetParam('S', &s); err == nil && s == 0 {
+					continue
+				}
+			}
+
+			if err := fn(g); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != ErrEmptyString {
+			return fmt.Errorf("parse gcode error: %w", err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read input error: %w", err)
+	}
+	return nil
+}
+
+// WriteGcodes writes the headers followed by the gcodes, lines end with \n
+func WriteGcodes(w io.Writer, headers [][]byte, gcodes []*GcodeBlock) error {
+	bufWriter := bufio.NewWriterSize(w, 64*1024)
+
+	if _, err := bufWriter.Write(bytes.Join(headers, []byte("\n"))); err != nil {
+		return err
+	}
+	for _, gcode := range gcodes {
+		if _, err := bufWriter.WriteString(gcode.String() + "\n"); err != nil {
+			return err
+		}
+	}
+	return bufWriter.Flush()
+}
+
+// ParsedGcode is the fixed file split into its blocks, Thumbnail and Layers
+// are slices of Body.
+type ParsedGcode struct {
+	Params    *slicerParams   // parsed from Body
+	Header    [][]byte        // ";Header Start" to ";Header End", generated from Params
+	Thumbnail []*GcodeBlock   // "; thumbnail begin" to "; thumbnail end" of the slicer
+	Body      []*GcodeBlock   // the gcodes following the header
+	Layers    [][]*GcodeBlock // from each layer change to the next one
+}
+
+// NewParsedGcode parses the modified gcodes for their header and indexes the
+// layers, Params of the package is kept as it is.
+func NewParsedGcode(gcodes []*GcodeBlock) (*ParsedGcode, error) {
+	params, err := ParseSlicerParams(gcodes)
+	if err != nil {
+		return nil, err
+	}
+	p := &ParsedGcode{
+		Params: params,
+		Header: params.Header(gcodes),
+		Body:   gcodes,
+	}
+
+	thumbStart, layerStart := -1, -1
+	for i, g := range gcodes {
+		if !g.IsComment() {
+			continue
+		}
+		switch comment := g.Comment(); {
+		case isThumbnailBegin(comment) && p.Thumbnail == nil:
+			thumbStart = i
+		case isThumbnailEnd(comment) && thumbStart != -1 && p.Thumbnail == nil:
+			p.Thumbnail = gcodes[thumbStart : i+1]
+		case isLayerChange(comment):
+			if layerStart != -1 {
+				p.Layers = append(p.Layers, gcodes[layerStart:i])
+			}
+			layerStart = i
+		}
+	}
+	if layerStart != -1 {
+		p.Layers = append(p.Layers, gcodes[layerStart:])
+	}
+	return p, nil
+}
+
+// Write writes the file as WriteGcodes does
+func (p *ParsedGcode) Write(w io.Writer) error {
+	return WriteGcodes(w, p.Header, p.Body)
+}
+
+// LayerInfo locates a layer of ParsedGcode.Layers
+type LayerInfo struct {
+	Line     int   // index of the layer change in Body
+	Offset   int64 // bytes from the start of the written file
+	Z        float64
+	Features []FeatureRegion
+}
+
+// FeatureRegion is where the slicer starts a feature, e.g. "External perimeter"
+type FeatureRegion struct {
+	Type   string
+	Line   int // index in Body
+	Offset int64
+}
+
+// LayerIndex locates the layers and their features in the written file,
+// Z is the height the slicer reports, or of the first move of the layer.
+func (p *ParsedGcode) LayerIndex() []LayerInfo {
+	var (
+		index  = make([]LayerInfo, 0, len(p.Layers))
+		offset = int64(len(bytes.Join(p.Header, []byte("\n"))))
+		line   = 0
+	)
+	for _, layer := range p.Layers {
+		// the layers are contiguous slices of Body
+		for ; line < len(p.Body) && p.Body[line] != layer[0]; line++ {
+			offset += int64(len(p.Body[line].String())) + 1
+		}
+		info := LayerInfo{Line: line, Offset: offset, Z: -1}
+		for _, g := range layer {
+			comment := strings.TrimSpace(strings.TrimLeft(g.Comment(), ";"))
+			switch {
+			case !g.IsComment():
+				var z float32
+				if info.Z < 0 && (g.Is("G0") || g.Is("G1")) && g.GetParam('Z', &z) == nil {
+					info.Z = float64(z)
+				}
+			case strings.HasPrefix(comment, "Z:"):
+				info.Z = parseFloat(strings.TrimSpace(comment[2:]))
+			case strings.HasPrefix(comment, "Z_HEIGHT:"):
+				info.Z = parseFloat(strings.TrimSpace(comment[9:]))
+			case strings.HasPrefix(comment, "TYPE:"):
+				info.Features = append(info.Features, FeatureRegion{strings.TrimSpace(comment[5:]), line, offset})
+			case strings.HasPrefix(comment, "FEATURE:"):
+				info.Features = append(info.Features, FeatureRegion{strings.TrimSpace(comment[8:]), line, offset})
+			}
+			offset += int64(len(g.String())) + 1
+			line++
+		}
+		index = append(index, info)
+	}
+	return index
+}
+
+// ErrNoHeader is returned for a file without a header of smfix
+var ErrNoHeader = errors.New("No header found, the file is not fixed.")
+
+// findHeaderBounds returns the index of ";Header Start" and ";Header End"
+func findHeaderBounds(lines [][]byte) (start, end int, ok bool) {
+	start = -1
+	for i, line := range lines {
+		line = bytes.TrimSpace(line)
+		if start == -1 && bytes.Equal(line, []byte(";Header Start")) {
+			start = i
+		} else if start != -1 && bytes.Equal(line, []byte(";Header End")) {
+			return start, i, true
+		}
+	}
+	return -1, -1, false
+}
+
+// Recount updates the line count and the checksum in the header of a fixed
+// file to its edited body, the rest of the file is kept as is but CRLF line
+// endings of an editor are turned into \n. The count keeps the offset to the
+// body of headerV0 and headerV1.
+func Recount(data []byte) ([]byte, error) {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	lines := bytes.Split(data, []byte("\n"))
+	start, end, ok := findHeaderBounds(lines)
+	if !ok {
+		return nil, ErrNoHeader
+	}
+
+	// the header of version v has its own thumbnail, Luban comments may add another
+	var (
+		field   = []byte(";file_total_lines: ")
+		thumb   = []byte(";thumbnail:")
+		offset  = 0
+		headers = end - start + 2 // with the mark before ";Header Start"
+		body    = 0
+		at      = -1
+	)
+	for i := start; i <= end; i++ {
+		if bytes.Equal(bytes.TrimSpace(lines[i]), []byte(";Version:1")) {
+			field, thumb, offset = []byte(";Lines:"), []byte(";Thumbnail:"), 1
+		}
+	}
+	for i := start; i <= end; i++ {
+		if bytes.HasPrefix(lines[i], thumb) {
+			headers--
+		}
+	}
+	for i := start; i <= end; i++ {
+		if bytes.HasPrefix(lines[i], field) {
+			at = i
+		}
+	}
+	if at == -1 {
+		return nil, fmt.Errorf("header field %q not found", bytes.TrimSpace(field))
+	}
+	for _, line := range lines[end+1:] {
+		if len(bytes.TrimSpace(line)) > 0 {
+			body++
+		}
+	}
+
+	lines[at] = append(append([]byte{}, field...), strconv.Itoa(body+headers+offset)...)
+
+	// a checksum of BodyChecksum no longer matches the edited body
+	bodyStart := end + 1
+	if bodyStart < len(lines) && len(lines[bodyStart]) == 0 {
+		bodyStart++
+	}
+	for _, prefix := range [][]byte{[]byte(";checksum_crc32: "), []byte(";Checksum CRC32:")} {
+		for i := start; i <= end; i++ {
+			if bytes.HasPrefix(lines[i], prefix) {
+				sum := crc32.ChecksumIEEE(bytes.Join(lines[bodyStart:], []byte("\n")))
+				lines[i] = append(append([]byte{}, prefix...), fmt.Sprintf("%08x", sum)...)
+			}
+		}
+	}
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// Reheader regenerates the header of a fixed file from its body, e.g. after
+// its thumbnail or model name was edited. The header is the block from Mark to
+// ";Header End" and its blank line, the body is kept as is.
+func Reheader(data []byte) ([]byte, error) {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	lines := bytes.Split(data, []byte("\n"))
+	start, end, ok := findHeaderBounds(lines)
+	if !ok || start == 0 || string(bytes.TrimSpace(lines[start-1])) != Mark {
+		return nil, ErrNoHeader
+	}
+	bodyStart := end + 1
+	if bodyStart < len(lines) && len(lines[bodyStart]) == 0 {
+		bodyStart++
+	}
+	body := bytes.Join(lines[bodyStart:], []byte("\n"))
+
+	gcodes, err := ReadGcodes(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	params, err := ParseSlicerParams(gcodes)
+	if err != nil {
+		return nil, err
+	}
+	output := bytes.Join(lines[:start-1], []byte("\n"))
+	if len(output) > 0 {
+		output = append(output, '\n')
+	}
+	output = append(output, bytes.Join(params.Header(gcodes), []byte("\n"))...)
+	return append(output, body...), nil
+}
+
+// Difference is the first differing line of two fixed files
+type Difference struct {
+	Line    int    // 1-based
+	Section string // header, thumbnail or body
+	Got     string
+	Want    string
+}
+
+func (d *Difference) String() string {
+	return fmt.Sprintf("line %d differs in the %s:\n  got:  %.120s\n  want: %.120s", d.Line, d.Section, d.Got, d.Want)
+}
+
+// Compare returns the first difference of a fixed file to a reference, nil
+// if they are equal. A missing line is reported as empty.
+func Compare(got, want []byte) *Difference {
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	gotLines := bytes.Split(got, []byte("\n"))
+	wantLines := bytes.Split(want, []byte("\n"))
+	_, end, hasHeader := findHeaderBounds(gotLines)
+
+	inThumbnail := false
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+
+		lower := bytes.ToLower(g)
+		if isThumbnailBegin(string(g)) {
+			inThumbnail = true
+		}
+		if !bytes.Equal(g, w) {
+			d := &Difference{Line: i + 1, Section: "body", Got: string(g), Want: string(w)}
+			switch {
+			case inThumbnail || bytes.HasPrefix(lower, []byte(";thumbnail:")):
+				d.Section = "thumbnail"
+			case hasHeader && i <= end:
+				d.Section = "header"
+			}
+			return d
+		}
+		if isThumbnailEnd(string(g)) {
+			inThumbnail = false
+		}
+	}
+	return nil
+}
+
+// FixResult describes what the fix changed in a file
+type FixResult struct {
+	Version        int
+	Model          string
+	PrintMode      string
+	Thumbnail      string // "300x300 png", empty if the file has none
+	Added          int    // lines, a changed line counts as removed and added
+	Removed        int
+	Fixes          map[string]int  // "(Fixed: ...)" comments by kind
+	Temperatures   map[int]float64 // nozzle of the used extruders
+	BedTemperature float64
+	Warnings       []error
+}
+
+// NewFixResult compares the lines of the input to the fixed file
+func NewFixResult(original []string, parsed *ParsedGcode, warnings []error) *FixResult {
+	p := parsed.Params
+	r := &FixResult{
+		Version:        p.Version,
+		Model:          p.Model,
+		PrintMode:      p.PrintMode,
+		Fixes:          map[string]int{},
+		Temperatures:   map[int]float64{},
+		BedTemperature: p.EffectiveFirstLayerBedTemperature(),
+		Warnings:       warnings,
+	}
+	if len(parsed.Thumbnail) > 0 {
+		format := "image"
+		if typ, ok := strings.CutPrefix(ThumbnailType(p.Thumbnail), "image/"); ok {
+			format = typ
+		}
+		_, begin, _ := strings.Cut(parsed.Thumbnail[0].Comment(), " begin ")
+		size := strings.Fields(begin)
+		if len(size) > 0 {
+			r.Thumbnail = size[0] + " " + format
+		} else {
+			r.Thumbnail = format
+		}
+	} else if len(p.Thumbnail) > 0 {
+		r.Thumbnail = fmt.Sprintf("%dx%d png placeholder", PlaceholderSize, PlaceholderSize)
+	}
+	for i, temp := range p.NozzleTemperatures {
+		if p.extruderUsed(i) {
+			r.Temperatures[i] = temp
+		}
+	}
+
+	lines := make(map[string]int, len(original))
+	for _, line := range original {
+		lines[line]++
+	}
+	for _, g := range parsed.Body {
+		line := g.String()
+		if lines[line] > 0 {
+			lines[line]--
+		} else {
+			r.Added++
+		}
+		if _, fixed, ok := strings.Cut(g.Comment(), "(Fixed: "); ok {
+			kind, _, _ := strings.Cut(strings.TrimSuffix(fixed, ")"), ":")
+			r.Fixes[kind]++
+		}
+	}
+	for _, n := range lines {
+		r.Removed += n
+	}
+	return r
+}
+
+// Explain describes the result for a user
+func (r *FixResult) Explain() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "header: version %d for %s, %s mode\n", r.Version, r.Model, r.PrintMode)
+	if r.Thumbnail != "" {
+		fmt.Fprintf(&b, "thumbnail: %s, added to the header\n", r.Thumbnail)
+	} else {
+		fmt.Fprintf(&b, "thumbnail: none\n")
+	}
+	fmt.Fprintf(&b, "lines: %d added, %d removed\n", r.Added, r.Removed)
+	tools := make([]int, 0, len(r.Temperatures))
+	for i := range r.Temperatures {
+		tools = append(tools, i)
+	}
+	sort.Ints(tools)
+	for _, i := range tools {
+		fmt.Fprintf(&b, "temperature: T%d %.0f°C\n", i, r.Temperatures[i])
+	}
+	fmt.Fprintf(&b, "temperature: bed %.0f°C\n", r.BedTemperature)
+
+	kinds := make([]string, 0, len(r.Fixes))
+	for kind := range r.Fixes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "fixed: %s (%d)\n", kind, r.Fixes[kind])
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "warning: %s\n", w)
+	}
+	return b.String()
+}
+
+// MirrorTree calls fn for every .gcode or .gcode.gz file under root with the same relative
+// path under outDir, directories are created as needed. Files whose output is
+// newer than the input, or fn returns ErrAlreadyFixed, are skipped.
+func MirrorTree(root, outDir string, fn func(in, out string) error) (processed, skipped []string, err error) {
+	var errs []error
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isGcodeFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(outDir, rel)
+
+		if inInfo, err := d.Info(); err == nil {
+			if outInfo, err := os.Stat(out); err == nil && !outInfo.ModTime().Before(inInfo.ModTime()) {
+				skipped = append(skipped, path)
+				return nil
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		switch err := fn(path, out); {
+		case errors.Is(err, ErrAlreadyFixed):
+			skipped = append(skipped, path)
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		default:
+			processed = append(processed, path)
+		}
+		return nil
+	})
+	if err == nil {
+		err = errors.Join(errs...)
+	}
+	return
+}
+
+// BatchResult is the outcome of ProcessDir, the paths are in walk order
+type BatchResult struct {
+	Fixed   []string
+	Skipped []string // fn returned ErrAlreadyFixed
+	Failed  []error  // prefixed with the path
+}
+
+func (r *BatchResult) String() string {
+	return fmt.Sprintf("%d fixed, %d skipped, %d failed", len(r.Fixed), len(r.Skipped), len(r.Failed))
+}
+
+// Err joins the errors of the failed files, nil if none failed
+func (r *BatchResult) Err() error {
+	return errors.Join(r.Failed...)
+}
+
+// ProcessDir calls fn for every .gcode or .gcode.gz file under dir in
+// parallel, the files are fixed in place by fn. fn must parse with
+// ParseSlicerParams or NewParsedGcode, ParseParams and ExtractHeader write the
+// global Params. The package options such as ForceModel or Logger are shared
+// by the files and must not change while it runs. The error is of walking dir
+// only, the errors of the files are in the result.
+func ProcessDir(dir string, fn func(path string) error) (*BatchResult, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isGcodeFile(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(paths))
+	GoInParallelAndWait(func(wi, wn int) {
+		for i := wi; i < len(paths); i += wn {
+			errs[i] = fn(paths[i])
+		}
+	})
+
+	r := &BatchResult{}
+	for i, path := range paths {
+		switch err := errs[i]; {
+		case errors.Is(err, ErrAlreadyFixed):
+			r.Skipped = append(r.Skipped, path)
+		case err != nil:
+			r.Failed = append(r.Failed, fmt.Errorf("%s: %w", path, err))
+		default:
+			r.Fixed = append(r.Fixed, path)
+		}
+	}
+	return r, nil
+}
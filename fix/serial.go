@@ -0,0 +1,79 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// SerialWriter frames the gcode written to it for a serial sender, each
+// command line is numbered and ends in the checksum Marlin expects. Comments
+// and blank lines are dropped, they are not sent over serial.
+type SerialWriter struct {
+	w       io.Writer
+	bw      *bufio.Writer
+	n       int
+	pending []byte
+}
+
+// NewSerialWriter starts the framed output with M110 to reset the line number
+// of the firmware
+func NewSerialWriter(w io.Writer) *SerialWriter {
+	s := &SerialWriter{w: w, bw: bufio.NewWriterSize(w, 64*1024)}
+	s.frame([]byte("M110 N0"))
+	return s
+}
+
+func (s *SerialWriter) Write(b []byte) (int, error) {
+	s.pending = append(s.pending, b...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
+			break
+		}
+		s.line(s.pending[:i])
+		s.pending = s.pending[i+1:]
+	}
+	// keep the partial line from growing the buffer forever
+	s.pending = append(s.pending[:0:0], s.pending...)
+	return len(b), nil
+}
+
+// Close frames the last unterminated line and closes w if it is a Closer
+func (s *SerialWriter) Close() error {
+	s.line(s.pending)
+	s.pending = nil
+	if err := s.bw.Flush(); err != nil {
+		return err
+	}
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// line frames the command of line, if any
+func (s *SerialWriter) line(line []byte) {
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	if line = bytes.TrimSpace(line); len(line) > 0 {
+		s.frame(line)
+	}
+}
+
+func (s *SerialWriter) frame(cmd []byte) {
+	framed := append(append([]byte("N"+strconv.Itoa(s.n)+" "), cmd...), '*')
+	framed = strconv.AppendInt(framed, int64(serialChecksum(framed[:len(framed)-1])), 10)
+	s.bw.Write(append(framed, '\n'))
+	s.n++
+}
+
+// serialChecksum is the XOR of the bytes of a line before its '*'
+func serialChecksum(line []byte) (sum byte) {
+	for _, c := range line {
+		sum ^= c
+	}
+	return
+}
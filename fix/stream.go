@@ -0,0 +1,159 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// LineModifier is a GcodeModifier that modifies one line at a time, it returns
+// the lines replacing g. A LineModifier keeps its state between the lines, a
+// new one is needed for each pass over a file.
+type LineModifier func(g *GcodeBlock) []*GcodeBlock
+
+// Gcodes applies m to each of gcodes, a nil m keeps them as they are
+func (m LineModifier) Gcodes(gcodes []*GcodeBlock) []*GcodeBlock {
+	if m == nil {
+		return gcodes
+	}
+	output := make([]*GcodeBlock, 0, len(gcodes))
+	for _, g := range gcodes {
+		output = append(output, m(g)...)
+	}
+	return output
+}
+
+// applyLines passes g through the modifiers in order and fn through the lines
+// they return
+func applyLines(modifiers []LineModifier, g *GcodeBlock, fn func(g *GcodeBlock) error) error {
+	lines := []*GcodeBlock{g}
+	for _, m := range modifiers {
+		if m == nil {
+			continue
+		}
+		next := make([]*GcodeBlock, 0, len(lines))
+		for _, l := range lines {
+			next = append(next, m(l)...)
+		}
+		lines = next
+	}
+	for _, l := range lines {
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanParams is ParseSlicerParams of the lines of r, the file is not kept in
+// memory. A read error returns nil params.
+func ScanParams(r io.Reader) (*slicerParams, error) {
+	return ScanParamsWith(r, ReadOptions{})
+}
+
+// ScanParamsWith is ScanParams with the lines scanned as o configures
+func ScanParamsWith(r io.Reader, o ReadOptions) (*slicerParams, error) {
+	return scanParams(r, o, false)
+}
+
+func scanParams(r io.Reader, o ReadOptions, quiet bool) (*slicerParams, error) {
+	s := newParamsScanner(quiet)
+	if err := readLines(r, o, s.feed); err != nil {
+		return nil, err
+	}
+	return s.finish()
+}
+
+// StreamedGcode is a fixed file whose body waits in a temporary file to be
+// written after the header
+type StreamedGcode struct {
+	Params *slicerParams // parsed from the modified body
+	Header [][]byte      // generated from Params
+
+	body *os.File
+}
+
+// StreamModifiers makes the line modifiers of a file from the params of its
+// input, err is the one of ScanParams
+type StreamModifiers func(p *slicerParams, err error) ([]LineModifier, error)
+
+// NewStreamedGcode fixes r one line at a time without keeping the file in
+// memory. r is read twice: ScanParams reads it for modifiers, then the lines
+// modified by them are parsed for the header and kept in a temporary file
+// until Close. Only the second parse is logged to Logger. The memory is bounded by the longest line and the thumbnails,
+// each pass keeps all of the embedded thumbnails.
+func NewStreamedGcode(r io.ReadSeeker, modifiers StreamModifiers) (*StreamedGcode, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	params, err := scanParams(r, ReadOptions{}, true)
+	if params == nil {
+		return nil, err
+	}
+	lines, err := modifiers(params, err)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	body, err := os.CreateTemp("", "smfix-*.gcode")
+	if err != nil {
+		return nil, err
+	}
+	s := &StreamedGcode{body: body}
+	var (
+		scanner   = newParamsScanner(false)
+		sum       = crc32.NewIEEE()
+		bufWriter = bufio.NewWriterSize(body, 64*1024)
+	)
+	err = readLines(r, ReadOptions{}, func(g *GcodeBlock) error {
+		return applyLines(lines, g, func(g *GcodeBlock) error {
+			line := g.String() + "\n"
+			if BodyChecksum {
+				io.WriteString(sum, line)
+			}
+			if _, err := bufWriter.WriteString(line); err != nil {
+				return err
+			}
+			return scanner.feed(g)
+		})
+	})
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	if err == nil {
+		s.Params, err = scanner.finish()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Header = s.Params.header(sum.Sum32())
+	return s, nil
+}
+
+// Write writes the file as WriteGcodes does
+func (s *StreamedGcode) Write(w io.Writer) error {
+	bufWriter := bufio.NewWriterSize(w, 64*1024)
+
+	if _, err := bufWriter.Write(bytes.Join(s.Header, []byte("\n"))); err != nil {
+		return err
+	}
+	if _, err := s.body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(bufWriter, s.body); err != nil {
+		return err
+	}
+	return bufWriter.Flush()
+}
+
+// Close removes the temporary file of the body
+func (s *StreamedGcode) Close() error {
+	s.body.Close()
+	return os.Remove(s.body.Name())
+}
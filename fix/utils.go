@@ -2,12 +2,16 @@ package fix
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"math"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 )
 
 var (
@@ -30,16 +34,210 @@ func split(s string) []string {
 	return x
 }
 
+// splitNames splits the names of profiles, several are quoted as "PLA";"PETG"
+// and a single one may be unquoted with spaces
+func splitNames(s string) []string {
+	if strings.HasPrefix(s, `"`) {
+		return splitQuoted(s)
+	}
+	return []string{s}
+}
+
+// splitQuoted splits a list of quoted custom gcode, e.g. "M104 S200\nG92 E0";"",
+// escaped newlines are restored.
+func splitQuoted(s string) []string {
+	var (
+		x       []string
+		sb      strings.Builder
+		quoted  bool
+		escaped bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			switch c {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+			default:
+				sb.WriteByte(c)
+			}
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ';' || c == ','):
+			x = append(x, sb.String())
+			sb.Reset()
+		case quoted || c != ' ':
+			sb.WriteByte(c)
+		}
+	}
+	x = append(x, sb.String())
+	if len(x) == 1 {
+		x = append(x, "")
+	}
+	return x
+}
+
+// filamentGcodeBlocks collects the commands of each per-filament custom gcode,
+// they are not written by the slicer itself and must be kept as they are.
+func filamentGcodeBlocks(gcodes []*GcodeBlock) (blocks [][]string) {
+	for _, gcode := range gcodes {
+		if !gcode.IsComment() {
+			continue
+		}
+		v, ok := getSetting(gcode.Comment(), "filament_start_gcode", "filament_end_gcode")
+		if !ok {
+			continue
+		}
+		for _, hook := range splitQuoted(v) {
+			var block []string
+			for _, line := range strings.Split(hook, "\n") {
+				if g, err := ParseGcodeBlock(line); err == nil && !g.IsComment() {
+					block = append(block, g.Format("%c %p"))
+				}
+			}
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	return
+}
+
+// matchGcodeBlock is the number of commands of the longest block the commands
+// of gcodes start with, comments are skipped. 0 if none matches.
+func matchGcodeBlock(gcodes []*GcodeBlock, blocks [][]string) (n int) {
+	for _, block := range blocks {
+		i := 0
+		for _, gcode := range gcodes {
+			if i == len(block) {
+				break
+			}
+			if gcode.IsComment() {
+				continue
+			}
+			if gcode.Format("%c %p") != block[i] {
+				break
+			}
+			i++
+		}
+		if i == len(block) && i > n {
+			n = i
+		}
+	}
+	return
+}
+
+// splitFloat splits the values of each extruder, a slot the slicer did not
+// report, e.g. the second one of a single extruder profile, is -1
 func splitFloat(s string) []float64 {
 	var x []float64
 	for _, v := range split(s) {
+		if v == "" {
+			x = append(x, -1)
+			continue
+		}
 		f, _ := strconv.ParseFloat(v, 64)
 		x = append(x, f)
 	}
 	return x
 }
 
-func convertThumbnail(gcodes [][]byte) []byte {
+// materialFamily is the base material of a filament type in materialDensities,
+// e.g. PLA of "Generic PLA" or "PLA Basic", "" if unknown. FilamentTypes keep
+// the name of the slicer.
+func materialFamily(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	family := func(name string) (string, bool) {
+		if _, ok := materialDensities[name]; ok {
+			return name, true
+		}
+		base, ok := materialAliases[name]
+		return base, ok
+	}
+	if base, ok := family(s); ok {
+		return base
+	}
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if base, ok := family(word); ok {
+			return base
+		}
+	}
+	return ""
+}
+
+// sumPositive sums the values of each extruder, skipping the unreported -1
+func sumPositive(x []float64) (sum float64) {
+	for _, v := range x {
+		if v > 0 {
+			sum += v
+		}
+	}
+	return
+}
+
+// splitRatio splits the ratios of each extruder, a value with a % suffix, or
+// any value of a percent setting, is a percentage. A slot the slicer did not
+// report is 1.
+func splitRatio(s string, percent bool) []float64 {
+	var x []float64
+	for _, v := range split(s) {
+		if v == "" {
+			x = append(x, 1)
+			continue
+		}
+		v, isPercent := strings.CutSuffix(v, "%")
+		f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if percent || isPercent {
+			f /= 100
+		}
+		x = append(x, f)
+	}
+	return x
+}
+
+// Thumbnail is an image embedded by the slicer, Data is its base64 text
+type Thumbnail struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Type   string `json:"type"` // mime type
+	Data   []byte `json:"-"`
+}
+
+// Decode returns the image bytes, an error if the base64 is corrupted
+func (t Thumbnail) Decode() ([]byte, error) {
+	img, err := base64.StdEncoding.DecodeString(string(t.Data))
+	if err != nil {
+		return nil, fmt.Errorf("corrupted %dx%d thumbnail: %w", t.Width, t.Height, err)
+	}
+	return img, nil
+}
+
+// DataURI returns the thumbnail as the header embeds it
+func (t Thumbnail) DataURI() []byte {
+	return append([]byte("data:"+t.Type+";base64,"), t.Data...)
+}
+
+// isThumbnailBegin matches the begin marker of a png or jpeg thumbnail
+func isThumbnailBegin(line string) bool {
+	line = strings.ToLower(line)
+	return strings.HasPrefix(line, "; thumbnail begin ") || strings.HasPrefix(line, "; thumbnail_jpg begin ")
+}
+
+func isThumbnailEnd(line string) bool {
+	line = strings.ToLower(line)
+	return strings.HasPrefix(line, "; thumbnail end") || strings.HasPrefix(line, "; thumbnail_jpg end")
+}
+
+// parseThumbnails returns the thumbnails in the order of the file
+func parseThumbnails(gcodes [][]byte) (thumbs []Thumbnail) {
 	comments := bytes.NewBuffer([]byte{})
 	for _, line := range gcodes {
 		if len(line) > 0 && line[0] == ';' {
@@ -47,20 +245,54 @@ func convertThumbnail(gcodes [][]byte) []byte {
 			comments.WriteRune('\n')
 		}
 	}
-	matches := reThumb.FindAllSubmatch(comments.Bytes(), -1)
-	if matches != nil {
-		none := []byte(nil)
-		data := matches[len(matches)-1][1]
+	none := []byte(nil)
+	for _, m := range reThumb.FindAllSubmatch(comments.Bytes(), -1) {
+		w, _ := strconv.Atoi(string(m[2]))
+		h, _ := strconv.Atoi(string(m[3]))
+		data := m[4]
 		data = bytes.ReplaceAll(data, []byte("\r\n"), none)
 		data = bytes.ReplaceAll(data, []byte("\n"), none)
 		data = bytes.ReplaceAll(data, []byte("; "), none)
-		b := []byte("data:image/png;base64,")
-		return append(b, data...)
+		thumbs = append(thumbs, Thumbnail{Width: w, Height: h, Type: thumbnailTypes[string(m[1])], Data: data})
 	}
-	return nil
+	return
+}
+
+// SelectThumbnail picks the thumbnail closest to width x height, or the
+// largest one when the size is 0. On a tie the later one in the file wins.
+func SelectThumbnail(thumbs []Thumbnail, width, height int) (Thumbnail, bool) {
+	best := -1
+	for i, t := range thumbs {
+		if best == -1 || thumbnailCloser(t, thumbs[best], width, height) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return Thumbnail{}, false
+	}
+	return thumbs[best], true
+}
+
+func thumbnailCloser(a, b Thumbnail, width, height int) bool {
+	if width <= 0 || height <= 0 {
+		return a.Width*a.Height >= b.Width*b.Height
+	}
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	da := abs(a.Width-width) + abs(a.Height-height)
+	db := abs(b.Width-width) + abs(b.Height-height)
+	return da < db || da == db && a.Width*a.Height >= b.Width*b.Height
 }
 
 func convertEstimatedTime(s string) int {
+	// KISSlicer: 1.23 minutes
+	if m, ok := strings.CutSuffix(strings.TrimSpace(s), "minutes"); ok {
+		return int(math.Round(parseFloat(strings.TrimSpace(m)) * 60))
+	}
 	// est := s[strings.Index(s, "= ")+2:] // 2d 12h 8m 58s
 	est := strings.ReplaceAll(s, " ", "")
 	t := map[byte]int{'d': 0, 'h': 0, 'm': 0, 's': 0}
@@ -82,6 +314,65 @@ func parseFloat(s string) float64 {
 	return f
 }
 
+// parseWidth converts an extrusion width, which may be a percentage of the nozzle diameter, to mm
+func parseWidth(s string, nozzle float64) float64 {
+	if strings.HasSuffix(s, "%") {
+		if nozzle <= 0 {
+			return 0
+		}
+		return parseFloat(strings.TrimSuffix(s, "%")) / 100 * nozzle
+	}
+	return parseFloat(s)
+}
+
+// patternAliases maps the names used by the slicers to a Pattern* value
+var patternAliases = map[string]string{
+	"rectilinear":        PatternRectilinear,
+	"rectilinear-grid":   PatternGrid,
+	"alignedrectilinear": PatternAlignedRect,
+	"grid":               PatternGrid,
+	"triangles":          PatternTriangles,
+	"stars":              PatternStars,
+	"tri-hexagon":        PatternStars,
+	"cubic":              PatternCubic,
+	"line":               PatternLine,
+	"lines":              PatternLine,
+	"concentric":         PatternConcentric,
+	"honeycomb":          PatternHoneycomb,
+	"3dhoneycomb":        PatternHoneycomb3D,
+	"gyroid":             PatternGyroid,
+	"hilbertcurve":       PatternHilbert,
+	"archimedeanchords":  PatternArchimedean,
+	"octagramspiral":     PatternOctagramSpiral,
+	"adaptivecubic":      PatternAdaptiveCubic,
+	"supportcubic":       PatternSupportCubic,
+	"lightning":          PatternLightning,
+	"zigzag":             PatternZigZag,
+	"zig-zag":            PatternZigZag,
+	"monotonic":          PatternMonotonic,
+	"monotonicline":      PatternMonotonicLine,
+	"default":            PatternDefault,
+}
+
+// normalizePattern returns the Pattern* value of a slicer pattern name,
+// unknown names are kept in lower case.
+func normalizePattern(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if p, ok := patternAliases[s]; ok {
+		return p
+	}
+	return s
+}
+
+// parseBool treats 0, false and empty values as off
+func parseBool(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "0", "false", "off", "no", "none":
+		return false
+	}
+	return true
+}
+
 func ParseInt(b []byte) (int64, error) {
 	if v, ok, overflow := _parseInt(b); !ok {
 		if overflow {
@@ -94,21 +385,101 @@ func ParseInt(b []byte) (int64, error) {
 }
 
 func getSetting(s string, key ...string) (v string, ok bool) {
-	strlen := len(s)
-	if strlen > 5 && s[0] == ';' {
-		for _, p := range key {
-			if strlen < len(p)+4 {
-				continue
-			}
-			prefix := "; " + p + " ="
-			if strings.HasPrefix(s, prefix) {
-				if v := strings.TrimSpace(s[len(prefix):]); v != "" {
-					return v, true
-				}
-			}
+	k, v, ok := lookupSetting(s, key...)
+	if ok && Logger != nil { // the arguments of debugf allocate in the hot loop
+		debugf("%s = %s", k, v)
+	}
+	return v, ok
+}
+
+// lookupSetting is getSetting without logging, k is the matched key
+func lookupSetting(s string, key ...string) (k, v string, ok bool) {
+	if len(s) < 3 || s[0] != ';' {
+		return "", "", false
+	}
+	// ";key=value" and "; key =value" are read as "; key = value"
+	rest := strings.TrimLeft(s[1:], " \t")
+	for _, k := range key {
+		if !strings.HasPrefix(rest, k) {
+			continue
+		}
+		after := strings.TrimLeft(rest[len(k):], " \t")
+		if len(after) == 0 || after[0] != '=' {
+			continue
+		}
+		if v := strings.TrimSpace(after[1:]); v != "" {
+			return k, v, true
+		}
+	}
+	return "", "", false
+}
+
+// getSetting of the settings of Simplify3D, ";   key,value", and of its build
+// summary, ";   Build time: 1 hours 23 minutes"
+func getS3DSetting(s string, key ...string) (v string, ok bool) {
+	k, v, ok := lookupS3DSetting(s, key...)
+	if ok && Logger != nil {
+		debugf("%s = %s", k, v)
+	}
+	return v, ok
+}
+
+// lookupS3DSetting is getS3DSetting without logging, k is the matched key
+func lookupS3DSetting(s string, key ...string) (k, v string, ok bool) {
+	if len(s) < 3 || s[0] != ';' {
+		return "", "", false
+	}
+	rest := strings.TrimLeft(s[1:], " \t")
+	for _, k := range key {
+		after, found := strings.CutPrefix(rest, k)
+		if !found || len(after) == 0 || after[0] != ',' && after[0] != ':' {
+			continue
+		}
+		if v := strings.TrimSpace(after[1:]); v != "" {
+			return k, v, true
 		}
 	}
-	return "", false
+	return "", "", false
+}
+
+// parseBuildTime converts "1 hours 23 minutes" of Simplify3D to seconds
+func parseBuildTime(s string) (sec int) {
+	fields := strings.Fields(s)
+	for i := 0; i+1 < len(fields); i += 2 {
+		n := parseFloat(fields[i])
+		switch unit := strings.ToLower(fields[i+1]); {
+		case strings.HasPrefix(unit, "day"):
+			sec += int(n * 86400)
+		case strings.HasPrefix(unit, "hour"):
+			sec += int(n * 3600)
+		case strings.HasPrefix(unit, "minute"):
+			sec += int(n * 60)
+		case strings.HasPrefix(unit, "second"):
+			sec += int(n)
+		}
+	}
+	return
+}
+
+// parseLayerOf parses the "; layer N of M" progress comment of a slicer, N
+// counts from 1
+func parseLayerOf(line string) (n, m int, ok bool) {
+	v, ok := strings.CutPrefix(line, "; layer ")
+	if !ok {
+		return
+	}
+	a, b, ok := strings.Cut(v, " of ")
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(a))
+	if err != nil {
+		return 0, 0, false
+	}
+	if m, err = strconv.Atoi(strings.TrimSpace(b)); err != nil || m <= 0 {
+		return 0, 0, false
+	}
+	return n, m, true
 }
 
 func GoInParallelAndWait(work func(wi, wn int)) {
@@ -233,3 +604,53 @@ func _parseInt(bytes []byte) (v int64, ok bool, overflow bool) {
 		return int64(n), true, false
 	}
 }
+
+// parseRamming reads the duration and volume of filament_ramming_parameters,
+// e.g. "120 100 6.6 6.8 7.2| 0.05 6.6 0.45 6.8": the line width and step
+// multipliers in %, then the volumetric speeds in mm3/s for every 0.25s.
+func parseRamming(s string) (sec, volume float64) {
+	if i := strings.IndexByte(s, '|'); i != -1 {
+		s = s[:i]
+	}
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return 0, 0
+	}
+	for _, f := range fields[2:] {
+		speed, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, 0
+		}
+		sec += 0.25
+		volume += speed * 0.25
+	}
+	return
+}
+
+// speedBases are the speeds a percentage of PrusaSlicer refers to
+var speedBases = []struct{ speed, base string }{
+	{SpeedExternalPerimeter, SpeedPerimeter},
+	{SpeedSolidInfill, SpeedSparseInfill},
+	{SpeedTopSolidInfill, SpeedSolidInfill},
+}
+
+// resolveSpeeds converts the speed settings to mm/s, a percentage without a
+// known base and 0 (auto) are left out.
+func resolveSpeeds(settings map[string]string) map[string]float64 {
+	speeds := make(map[string]float64, len(settings))
+	for k, v := range settings {
+		if !strings.HasSuffix(v, "%") {
+			if f := parseFloat(v); f > 0 {
+				speeds[k] = f
+			}
+		}
+	}
+	for _, b := range speedBases {
+		v, ok := settings[b.speed]
+		base, known := speeds[b.base]
+		if ok && known && strings.HasSuffix(v, "%") {
+			speeds[b.speed] = base * parseFloat(strings.TrimSuffix(v, "%")) / 100
+		}
+	}
+	return speeds
+}
@@ -0,0 +1,437 @@
+package fix
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type valueRange struct {
+	Min float64
+	Max float64
+}
+
+func (r valueRange) Contains(v float64) bool {
+	return v >= r.Min && v <= r.Max
+}
+
+type buildVolume struct {
+	X, Y, Z float64
+}
+
+var buildVolumes = map[string]buildVolume{
+	ModelA150: {160, 160, 145},
+	ModelA250: {230, 250, 235},
+	ModelA350: {320, 350, 330},
+	ModelA400: {400, 400, 400},
+	ModelJ1:   {300, 200, 200},
+}
+
+// ValidateOrigin checks a work origin for GcodeSetOrigin, only the Snapmaker 2.0
+// firmware keeps a work origin, J1 homes to its own origin.
+func (p *slicerParams) ValidateOrigin(x, y, z float64) error {
+	if p.Model == ModelJ1 || p.Model == "" {
+		return fmt.Errorf("setting the origin is not supported on %q", p.Model)
+	}
+	vol, ok := buildVolumes[p.Model]
+	if !ok {
+		return fmt.Errorf("unknown build volume of %q", p.Model)
+	}
+	if x < 0 || x > vol.X || y < 0 || y > vol.Y || z < 0 || z > vol.Z {
+		return fmt.Errorf("origin %g,%g,%g is out of the %.0fx%.0fx%.0f build volume of %s", x, y, z, vol.X, vol.Y, vol.Z, p.Model)
+	}
+	return nil
+}
+
+// ValidateMaterials fails when a used extruder loads a material not in allowed,
+// materials are matched case-insensitively.
+func (p *slicerParams) ValidateMaterials(allowed []string) error {
+	for i, material := range p.FilamentTypes {
+		if !p.extruderUsed(i) {
+			continue
+		}
+		ok := false
+		for _, a := range allowed {
+			if strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(material)) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("T%d material %q is not allowed, allowed materials: %s", i, material, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// no Snapmaker heats above these, higher values are likely in Fahrenheit. The
+// header of the firmware is checked against them too.
+const (
+	maxNozzleTemperature = 350
+	maxBedTemperature    = 150
+)
+
+// ValidateTemperatures fails on temperatures no Snapmaker reaches, the
+// firmware takes Celsius only and a Fahrenheit value would overheat.
+func (p *slicerParams) ValidateTemperatures() error {
+	var errs []error
+	check := func(name string, v, max float64) {
+		if v > max {
+			errs = append(errs, fmt.Errorf("%s %.0f°C is above %d°C, is it %.0f°F (%.0f°C)?", name, v, int(max), v, (v-32)*5/9))
+		}
+	}
+	for i, temp := range p.NozzleTemperatures {
+		if !p.extruderUsed(i) {
+			continue
+		}
+		check(fmt.Sprintf("T%d nozzle temperature", i), temp, maxNozzleTemperature)
+		if i < len(p.FirstLayerBedTemperatures) {
+			check(fmt.Sprintf("T%d bed temperature", i), p.FirstLayerBedTemperatures[i], maxBedTemperature)
+		}
+		if i < len(p.BedTemperatures) && (i >= len(p.FirstLayerBedTemperatures) || p.BedTemperatures[i] != p.FirstLayerBedTemperatures[i]) {
+			check(fmt.Sprintf("T%d bed temperature of the other layers", i), p.BedTemperatures[i], maxBedTemperature)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// files above this are slow to transfer and to load on the touchscreen
+const largeFileLines = 2000000
+
+// ValidateArcTolerance checks the tolerance of GcodeLinearizeArcs against the
+// tolerance the slicer fitted the arcs with.
+func (p *slicerParams) ValidateArcTolerance(tolerance float64) error {
+	if fitted := p.EffectiveArcTolerance(); p.ArcFitting && fitted > 0 && tolerance > fitted {
+		return fmt.Errorf("arcs were fitted at %gmm, linearizing at %gmm loses detail", fitted, tolerance)
+	}
+	return nil
+}
+
+type retractionLimits struct {
+	Retraction       valueRange
+	SwitchRetraction valueRange
+}
+
+// all Snapmaker toolheads are direct drive, long retractions grind the filament
+var retractionRanges = map[string]map[string]retractionLimits{
+	ModelA150: {
+		ToolheadSingle: {valueRange{0, 4}, valueRange{0, 20}},
+		ToolheadDual:   {valueRange{0, 2}, valueRange{0, 20}},
+	},
+	ModelA250: {
+		ToolheadSingle: {valueRange{0, 4}, valueRange{0, 20}},
+		ToolheadDual:   {valueRange{0, 2}, valueRange{0, 20}},
+	},
+	ModelA350: {
+		ToolheadSingle: {valueRange{0, 4}, valueRange{0, 20}},
+		ToolheadDual:   {valueRange{0, 2}, valueRange{0, 20}},
+	},
+	ModelA400: {
+		ToolheadSingle: {valueRange{0, 3}, valueRange{0, 20}},
+		ToolheadDual:   {valueRange{0, 2}, valueRange{0, 20}},
+	},
+	ModelJ1: {
+		ToolheadSingle: {valueRange{0, 2}, valueRange{0, 20}},
+		ToolheadDual:   {valueRange{0, 2}, valueRange{0, 20}},
+	},
+}
+
+// Validate checks the parsed params against the limits of the detected model,
+// the result is advisory and never stops the fix.
+func (p *slicerParams) Validate() (warnings []error) {
+	warnings = append(warnings, p.validateRetractions()...)
+	warnings = append(warnings, p.validateIDEXTravel()...)
+	warnings = append(warnings, p.validateIDEXTemperatures()...)
+	warnings = append(warnings, p.validateVersion()...)
+	warnings = append(warnings, p.validateFilamentGcode()...)
+	warnings = append(warnings, p.validateVolumetricFlow()...)
+	warnings = append(warnings, p.validateThinFeatures()...)
+	warnings = append(warnings, p.validateLayerHeight()...)
+	warnings = append(warnings, p.validateBrimEars()...)
+	warnings = append(warnings, p.validateBrim()...)
+	warnings = append(warnings, p.validateWipeTower()...)
+	warnings = append(warnings, p.validateBuildVolume()...)
+	warnings = append(warnings, p.validateObjects()...)
+	warnings = append(warnings, p.validateSequential()...)
+	warnings = append(warnings, p.validateResolution()...)
+	warnings = append(warnings, p.validateFilamentUsed()...)
+	return
+}
+
+// extruderUsed reports whether tool i extrudes, T0 and T1 stand for their
+// nozzles
+func (p *slicerParams) extruderUsed(i int) bool {
+	switch i {
+	case 0:
+		return p.LeftExtruderUsed
+	case 1:
+		return p.RightExtruderUsed
+	}
+	return i < len(p.FilamentUsed) && p.FilamentUsed[i] > 0
+}
+
+func (p *slicerParams) validateRetractions() (warnings []error) {
+	limits, ok := retractionRanges[p.Model][p.ToolHead]
+	if !ok {
+		return
+	}
+	for i := range p.Retractions {
+		if !p.extruderUsed(i) {
+			continue
+		}
+		if v := p.Retractions[i]; v >= 0 && !limits.Retraction.Contains(v) {
+			warnings = append(warnings, fmt.Errorf("T%d retraction %.2fmm is out of range %.1f-%.1fmm for %s", i, v, limits.Retraction.Min, limits.Retraction.Max, p.Model))
+		}
+	}
+	for i := range p.SwitchRetractions {
+		if !p.extruderUsed(i) {
+			continue
+		}
+		if v := p.SwitchRetractions[i]; v >= 0 && !limits.SwitchRetraction.Contains(v) {
+			warnings = append(warnings, fmt.Errorf("T%d switch retraction %.2fmm is out of range %.1f-%.1fmm for %s", i, v, limits.SwitchRetraction.Min, limits.SwitchRetraction.Max, p.Model))
+		}
+	}
+	return
+}
+
+func (p *slicerParams) validateIDEXTravel() (warnings []error) {
+	if p.IsIDEX() && !p.AvoidCrossingPerimeters {
+		warnings = append(warnings, fmt.Errorf("avoid crossing perimeters is disabled, travel moves of %s may knock over the print of the idle nozzle", p.PrintMode))
+	}
+	return
+}
+
+// nozzle temperatures of mirror and duplication closer than this are the same
+const idexTemperatureTolerance = 1.0
+
+func (p *slicerParams) validateIDEXTemperatures() (warnings []error) {
+	if p.PrintMode != PrintModeMirror && p.PrintMode != PrintModeDuplication {
+		return
+	}
+	left, right := p.NozzleTemperatures[0], p.NozzleTemperatures[1]
+	if left > 0 && right > 0 && math.Abs(left-right) > idexTemperatureTolerance {
+		warnings = append(warnings, fmt.Errorf("%s runs both nozzles at one temperature, T0 is %.0f°C but T1 is %.0f°C", p.PrintMode, left, right))
+	}
+	return
+}
+
+func (p *slicerParams) validateVersion() (warnings []error) {
+	if p.Version == 0 && p.IsIDEX() {
+		warnings = append(warnings, fmt.Errorf("%s only supports G-code v1, the printer may reject a v0 header", ModelJ1))
+	}
+	return
+}
+
+func (p *slicerParams) validateFilamentGcode() (warnings []error) {
+	if !p.LeftExtruderUsed || !p.RightExtruderUsed {
+		return
+	}
+	for i, hooks := range [][]string{p.FilamentStartGcode, p.FilamentEndGcode} {
+		name := [...]string{"filament_start_gcode", "filament_end_gcode"}[i]
+		for t, hook := range hooks {
+			for _, line := range strings.Split(hook, "\n") {
+				if g, err := ParseGcodeBlock(line); err == nil && (g.Is("M104") || g.Is("M109")) {
+					warnings = append(warnings, fmt.Errorf("%s of T%d sets temperature (%s), it runs at every tool change and may override pre-heat or shutoff", name, t, g.Format("%c %p")))
+				}
+			}
+		}
+	}
+	return
+}
+
+// validateVolumetricFlow estimates the flow with the print speed, the first
+// layer uses its own (usually wider) line width for adhesion. When the slicer
+// ramps the flow the nominal speed is not reached, the moves are checked instead.
+func (p *slicerParams) validateVolumetricFlow() (warnings []error) {
+	if p.FlowRampSlope > 0 {
+		for i, max := range p.MaxVolumetricSpeeds {
+			if !p.extruderUsed(i) || max <= 0 {
+				continue
+			}
+			// 5% for the rounding of E and F
+			if flow := p.PeakVolumetricFlow(i); flow > max*1.05 {
+				warnings = append(warnings, fmt.Errorf("T%d peak flow %.1fmm3/s exceeds the max volumetric speed %.1fmm3/s", i, flow, max))
+			}
+		}
+		return
+	}
+	if p.LayerHeight <= 0 || p.PrintSpeedSec <= 0 {
+		return
+	}
+	layers := []struct {
+		name  string
+		width float64
+		speed float64
+	}{
+		{"first layer", p.EffectiveFirstLayerLineWidth(), p.EffectiveFirstLayerSpeed()},
+		{"print", p.LineWidth, p.PrintSpeedSec},
+	}
+	for i, max := range p.MaxVolumetricSpeeds {
+		if !p.extruderUsed(i) || max <= 0 {
+			continue
+		}
+		for _, l := range layers {
+			if l.width <= 0 {
+				continue
+			}
+			if flow := l.width * p.LayerHeight * l.speed; flow > max {
+				warnings = append(warnings, fmt.Errorf("T%d %s flow %.1fmm3/s exceeds the max volumetric speed %.1fmm3/s", i, l.name, flow, max))
+			}
+		}
+	}
+	return
+}
+
+func (p *slicerParams) validateBrimEars() (warnings []error) {
+	vol, ok := buildVolumes[p.Model]
+	if !ok || !p.BrimEars || !p.HasBounds || p.MaxX <= p.MinX || p.MaxY <= p.MinY {
+		return
+	}
+	minX, minY, maxX, maxY := p.FootprintBounds()
+	if minX < 0 || minY < 0 || maxX > vol.X || maxY > vol.Y {
+		warnings = append(warnings, fmt.Errorf("brim ears (%.1f,%.1f)-(%.1f,%.1f) may extend beyond the %.0fx%.0f bed", minX, minY, maxX, maxY, vol.X, vol.Y))
+	}
+	return
+}
+
+// validateBrim checks the clearance of a full brim, the ears are checked by
+// validateBrimEars
+func (p *slicerParams) validateBrim() (warnings []error) {
+	vol, ok := buildVolumes[p.Model]
+	if !ok || p.BrimEars || p.BrimWidth <= 0 || !p.HasBounds || p.MaxX <= p.MinX || p.MaxY <= p.MinY {
+		return
+	}
+	minX, minY, maxX, maxY := p.FootprintBounds()
+	minX, minY, maxX, maxY = minX-p.BrimWidth, minY-p.BrimWidth, maxX+p.BrimWidth, maxY+p.BrimWidth
+	if minX < 0 || minY < 0 || maxX > vol.X || maxY > vol.Y {
+		warnings = append(warnings, fmt.Errorf("brim of %.1fmm (%.1f,%.1f)-(%.1f,%.1f) may extend beyond the %.0fx%.0f bed, check the bed clearance", p.BrimWidth, minX, minY, maxX, maxY, vol.X, vol.Y))
+	}
+	return
+}
+
+// validateWipeTower checks the wipe tower is on the bed and clear of the
+// objects, the nozzle parked by IDEX must reach it too. The depth is not
+// reported, the tower is taken as square.
+func (p *slicerParams) validateWipeTower() (warnings []error) {
+	vol, ok := buildVolumes[p.Model]
+	if !ok || !p.WipeTower || p.WipeTowerWidth <= 0 || p.WipeTowerX == -1 || p.WipeTowerY == -1 {
+		return
+	}
+	minX, minY := p.WipeTowerX, p.WipeTowerY
+	maxX, maxY := minX+p.WipeTowerWidth, minY+p.WipeTowerWidth
+	if minX < 0 || minY < 0 || maxX > vol.X || maxY > vol.Y {
+		warnings = append(warnings, fmt.Errorf("wipe tower (%.1f,%.1f)-(%.1f,%.1f) extends beyond the %.0fx%.0f bed", minX, minY, maxX, maxY, vol.X, vol.Y))
+	}
+	objects := p.Objects
+	if len(objects) == 0 && p.HasBounds {
+		objects = []BoundingBox{{Name: "print", Min: [3]float64{p.MinX, p.MinY, p.MinZ}, Max: [3]float64{p.MaxX, p.MaxY, p.MaxZ}}}
+	}
+	for _, o := range objects {
+		if minX < o.Max[0] && o.Min[0] < maxX && minY < o.Max[1] && o.Min[1] < maxY {
+			warnings = append(warnings, fmt.Errorf("wipe tower (%.1f,%.1f)-(%.1f,%.1f) overlaps %q (%.1f,%.1f)-(%.1f,%.1f)", minX, minY, maxX, maxY, o.Name, o.Min[0], o.Min[1], o.Max[0], o.Max[1]))
+		}
+	}
+	return
+}
+
+// validateBuildVolume checks the size of the whole print per axis, a print
+// larger than the build volume fails however it is placed
+func (p *slicerParams) validateBuildVolume() (warnings []error) {
+	vol, ok := buildVolumes[p.Model]
+	if !ok || !p.HasBounds {
+		return
+	}
+	axes := []struct {
+		name      string
+		size, max float64
+	}{
+		{"X", p.MaxX - p.MinX, vol.X},
+		{"Y", p.MaxY - p.MinY, vol.Y},
+		{"Z", p.PrintHeight(), vol.Z},
+	}
+	for _, a := range axes {
+		if a.size > a.max {
+			warnings = append(warnings, fmt.Errorf("print is %.1fmm in %s, it exceeds the %.0fmm build volume of %s", a.size, a.name, a.max, p.Model))
+		}
+	}
+	return
+}
+
+// validateObjects checks each object against the build volume, an object of
+// sequential printing must fit on its own
+func (p *slicerParams) validateObjects() (warnings []error) {
+	vol, ok := buildVolumes[p.Model]
+	if !ok {
+		return
+	}
+	for _, o := range p.Objects {
+		if o.Min[0] < 0 || o.Min[1] < 0 || o.Max[0] > vol.X || o.Max[1] > vol.Y || o.Max[2] > vol.Z {
+			warnings = append(warnings, fmt.Errorf("object %q (%.1f,%.1f,%.1f)-(%.1f,%.1f,%.1f) exceeds the %.0fx%.0fx%.0f build volume of %s",
+				o.Name, o.Min[0], o.Min[1], o.Min[2], o.Max[0], o.Max[1], o.Max[2], vol.X, vol.Y, vol.Z, p.Model))
+		}
+	}
+	return
+}
+
+// validateSequential reminds that the gantry may hit a printed object when the
+// objects are printed one by one
+func (p *slicerParams) validateSequential() (warnings []error) {
+	if p.IsSequential {
+		warnings = append(warnings, fmt.Errorf("objects are printed one by one, verify the clearance of the head between the objects"))
+	}
+	return
+}
+
+func (p *slicerParams) validateResolution() (warnings []error) {
+	if r := p.EffectiveResolution(); p.TotalLines > largeFileLines && r > 0 && r < 0.01 {
+		warnings = append(warnings, fmt.Errorf("%d lines with %gmm gcode resolution, a coarser resolution makes a smaller file", p.TotalLines, r))
+	}
+	return
+}
+
+// validateFilamentUsed compares the filament used reported by the slicer with the moves
+func (p *slicerParams) validateFilamentUsed() (warnings []error) {
+	for i, computed := range p.ComputedFilamentUsed {
+		if i >= len(p.FilamentUsed) || p.FilamentUsed[i] < 0 {
+			continue
+		}
+		reported := p.FilamentUsed[i]
+		if diff := math.Abs(reported - computed); diff > 1 && diff > reported*0.05 {
+			warnings = append(warnings, fmt.Errorf("T%d filament used %.2fmm differs from %.2fmm extruded by the moves", i, reported, computed))
+		}
+	}
+	return
+}
+
+// validateLayerHeight checks the layer height against the nozzle, a layer
+// thicker than 80% of the nozzle does not bond and a layer under 10% of it
+// is most likely a profile of another nozzle
+func (p *slicerParams) validateLayerHeight() (warnings []error) {
+	nozzle := p.EffectiveNozzleDiameter()
+	if p.LayerHeight <= 0 || nozzle <= 0 {
+		return
+	}
+	if p.LayerHeight > nozzle*0.8 {
+		warnings = append(warnings, fmt.Errorf("layer height %.2fmm is too thick for the %.2fmm nozzle, at most %.2fmm", p.LayerHeight, nozzle, nozzle*0.8))
+	} else if p.LayerHeight < nozzle*0.1 {
+		warnings = append(warnings, fmt.Errorf("layer height %.2fmm is too thin for the %.2fmm nozzle, at least %.2fmm", p.LayerHeight, nozzle, nozzle*0.1))
+	}
+	return
+}
+
+// validateThinFeatures checks the arachne limits, beads much thinner than the
+// nozzle can not build up pressure and under-extrude.
+func (p *slicerParams) validateThinFeatures() (warnings []error) {
+	nozzle := p.NozzleDiameters[0]
+	if p.WallGenerator != "arachne" || nozzle <= 0 {
+		return
+	}
+	if p.MinFeatureSize > 0 && p.MinFeatureSize < nozzle*0.1 {
+		warnings = append(warnings, fmt.Errorf("min feature size %.3fmm is too small for the %.1fmm nozzle", p.MinFeatureSize, nozzle))
+	}
+	if p.MinBeadWidth > 0 && p.MinBeadWidth < nozzle*0.5 {
+		warnings = append(warnings, fmt.Errorf("min bead width %.3fmm is too thin for the %.1fmm nozzle, thin features may under-extrude", p.MinBeadWidth, nozzle))
+	}
+	return
+}
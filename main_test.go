@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// _gcode is a minimal sliced file
+func _gcode() string {
+	lines := []string{"; generated by PrusaSlicer 2.7.1 on 2024-01-01 at 00:00:00 UTC", "G28", "G90", "M83", "M104 S210", "M109 S210", "T0"}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, "G1 X10 Y10 E0.1 F1200")
+	}
+	lines = append(lines,
+		"; filament used [mm] = 2.00",
+		"; filament_type = PLA",
+		"; first_layer_temperature = 210",
+		"; first_layer_bed_temperature = 60",
+		"; nozzle_diameter = 0.4",
+		"; layer_height = 0.2",
+		"; printer_model = Snapmaker A350",
+		"; estimated printing time (normal mode) = 1h 2m 3s",
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// _stdio runs fn with stdin read from in, it returns what fn writes to stdout
+func _stdio(t *testing.T, in *os.File, fn func() error) (string, error) {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdin, stdout *os.File) { os.Stdin, os.Stdout = stdin, stdout }(os.Stdin, os.Stdout)
+	os.Stdin, os.Stdout = in, out
+
+	err = fn()
+	data, readErr := os.ReadFile(out.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(data), err
+}
+
+func TestStdioOutput(t *testing.T) {
+	defer func() { outDir, writeManifest, explain, compareWith = "", false, false, "" }()
+
+	cases := []struct {
+		name          string
+		input, output string
+		set           func()
+		want          string
+		wantErr       string
+	}{
+		{"stdin to stdout", stdio, "", nil, stdio, ""},
+		{"stdin to file", stdio, "out.gcode", nil, "out.gcode", ""},
+		{"file in place", "in.gcode", "", nil, "", ""},
+		{"out-dir", stdio, "", func() { outDir = "out" }, "", "-out-dir needs an input file, it can not be used with stdin"},
+		{"manifest", "in.gcode", stdio, func() { writeManifest = true }, "", "-manifest, -explain and -compare-with need an output file, they can not be used with stdout"},
+		{"explain", stdio, "", func() { explain = true }, "", "-manifest, -explain and -compare-with need an output file, they can not be used with stdout"},
+		{"compare-with", stdio, stdio, func() { compareWith = "ref.gcode" }, "", "-manifest, -explain and -compare-with need an output file, they can not be used with stdout"},
+		{"manifest of a file", stdio, "out.gcode", func() { writeManifest = true }, "out.gcode", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			outDir, writeManifest, explain, compareWith = "", false, false, ""
+			if c.set != nil {
+				c.set()
+			}
+			got, err := stdioOutput(c.input, c.output)
+			if c.wantErr != "" {
+				if err == nil || err.Error() != c.wantErr {
+					t.Errorf("got %v, want %q", err, c.wantErr)
+				}
+			} else if err != nil || got != c.want {
+				t.Errorf("got %q, %v, want %q", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestStdio(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.gcode")
+	if err := os.WriteFile(input, []byte(_gcode()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fixed := filepath.Join(dir, "fixed.gcode")
+	if err := process(input, fixed); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, run := range map[string]func(input, output string) error{"process": process, "stream": processStream} {
+		t.Run(name, func(t *testing.T) {
+			in, err := os.Open(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer in.Close()
+			got, err := _stdio(t, in, func() error { return run(stdio, stdio) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("stdout differs from the output file:\n%s", got)
+			}
+		})
+	}
+
+	// a pipe can not be read twice
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		io.Copy(w, strings.NewReader(_gcode()))
+		w.Close()
+	}()
+	got, err := _stdio(t, r, func() error { return processStream(stdio, stdio) })
+	if err == nil || !strings.HasPrefix(err.Error(), "-stream reads the input twice, stdin is not seekable, it can be redirected from a file: ") {
+		t.Errorf("got %v, want stdin is not seekable", err)
+	}
+	if got != "" {
+		t.Errorf("got output %q", got)
+	}
+
+	// the pipe is read once without -stream
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		io.Copy(w, strings.NewReader(_gcode()))
+		w.Close()
+	}()
+	got, err = _stdio(t, r, func() error { return process(stdio, stdio) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("stdout differs from the output file:\n%s", got)
+	}
+}
@@ -1,54 +1,151 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/macdylan/SMFix/fix"
 )
 
 var (
-	OutputPath       string
-	noTrim           bool
-	noShutoff        bool
-	noPreheat        bool
-	noReinforceTower bool
-	noReplaceTool    bool
+	OutputPath        string
+	noTrim            bool
+	noShutoff         bool
+	noPreheat         bool
+	noReinforceTower  bool
+	noReplaceTool     bool
+	gcodeVersion      int
+	writeManifest     bool
+	detectOnly        bool
+	jsonOutput        bool
+	setOrigin         string
+	thumbnailSize     string
+	forceModel        string
+	placeholder       bool
+	recomputeFilament bool
+	allowJ1V0         bool
+	outDir            string
+	linearizeArcs     bool
+	arcTolerance      float64
+	allowedMaterials  string
+	clampZ            bool
+	luban             bool
+	slicerComment     bool
+	setAcceleration   bool
+	noTempCheck       bool
+	recountOnly       bool
+	reheader          bool
+	compareWith       string
+	noHeatGuard       bool
+	checksum          bool
+	explain           bool
+	progress          bool
+	stream            bool
+	verbose           bool
+	dryRun            bool
+	serial            bool
 )
 
 func init() {
-	flag.StringVar(&OutputPath, "o", "", "output path, default is input path")
+	flag.StringVar(&OutputPath, "o", "", "output path, - is stdout, default is input path or stdout for stdin, it is gzip when it ends in .gz")
+	flag.StringVar(&outDir, "out-dir", "", "write the output into this directory, a directory input is mirrored into it")
 	flag.BoolVar(&noTrim, "notrim", false, "do not trim spaces in the gcode")
 	flag.BoolVar(&noShutoff, "noshutoff", false, "do not shutoff nozzles that are no longer in use")
 	flag.BoolVar(&noPreheat, "nopreheat", true, "do not pre-heat nozzles")
 	flag.BoolVar(&noReinforceTower, "noreinforcetower", true, "do not reinforce the prime tower")
 	flag.BoolVar(&noReplaceTool, "noreplacetool", false, "do not replace the tool number")
-	flag.Parse()
+	flag.BoolVar(&detectOnly, "detect-only", false, "report the slicer, printer model and gcode version of the input files and exit")
+	flag.BoolVar(&jsonOutput, "json", false, "print reports of -detect-only and -dry-run as json")
+	flag.StringVar(&setOrigin, "set-origin", "", "set the work origin `x,y,z` after homing, Snapmaker 2.0 only")
+	flag.BoolVar(&recomputeFilament, "recompute-filament", false, "compute the filament used from the extrusion moves instead of the slicer's")
+	flag.BoolVar(&writeManifest, "manifest", false, "write a json manifest of the job alongside the output")
+	flag.BoolVar(&allowJ1V0, "allow-j1-v0", false, "do not force the v1 header on J1, the stock J1 firmware rejects v0 files")
+	flag.StringVar(&forceModel, "model", "", "force the printer `model` instead of detecting it: A150, A250, A350, A400 or J1")
+	flag.IntVar(&gcodeVersion, "gcode-version", -1, "force the header format for firmware, 0 or 1, default is auto detect. J1 and IDEX modes require 1, forcing 0 is warned")
+	flag.BoolVar(&linearizeArcs, "linearize-arcs", false, "replace G2/G3 arcs with G1 segments")
+	flag.Float64Var(&arcTolerance, "arc-tolerance", 0, "max deviation `mm` of the linearized arcs, default is the slicer's arc fitting tolerance")
+	flag.StringVar(&allowedMaterials, "allowed-materials", "", "fail when a used extruder loads a material not in the `list`, e.g. PLA,PETG")
+	flag.BoolVar(&clampZ, "clamp-z", false, "clamp Z moves far above the max print height of the profile")
+	flag.BoolVar(&luban, "luban", false, "add the header comments Snapmaker Luban reads to preview the job")
+	flag.BoolVar(&slicerComment, "slicer-comment", false, "add the slicer and its version detected from the banner to the header")
+	flag.BoolVar(&setAcceleration, "acceleration", false, "set the print and travel acceleration of the slicer with M204 after homing")
+	flag.BoolVar(&noTempCheck, "notempcheck", false, "do not fail on temperatures that look like Fahrenheit")
+	flag.BoolVar(&recountOnly, "recount", false, "only update the line count in the header of an edited fixed file")
+	flag.BoolVar(&reheader, "reheader", false, "only regenerate the header of an edited fixed file from its body")
+	flag.StringVar(&compareWith, "compare-with", "", "compare the output with a reference `file` of another smfix build and report the first difference")
+	flag.BoolVar(&noHeatGuard, "noheatguard", false, "do not add M109 when the gcode extrudes before waiting for the nozzle temperature")
+	flag.BoolVar(&checksum, "checksum", false, "add the CRC32 of the body to the header to detect a corrupted transfer")
+	flag.BoolVar(&explain, "explain", false, "print what the fix changed in the file")
+	flag.StringVar(&thumbnailSize, "thumbnail-size", "", "use the embedded thumbnail closest to `wxh`, default is the largest")
+	flag.BoolVar(&placeholder, "placeholder-thumbnail", false, "add a placeholder thumbnail when the slicer has none")
+	flag.BoolVar(&progress, "progress", false, "add M73 progress at each layer change, unless the slicer already did")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the detected params and the header that would be written, the file is not written")
+	flag.BoolVar(&verbose, "verbose", false, "log the settings matched in the slicer's comments and the parsed params")
+	flag.BoolVar(&serial, "serial", false, "number the lines and add the checksum for a serial sender, comments are dropped")
+	flag.BoolVar(&stream, "stream", false, "fix the file one line at a time instead of in memory, a print that changes tools needs -noshutoff and -nopreheat")
 }
 
 func main() {
+	flag.Parse()
 	numCPU := runtime.NumCPU()
 	runtime.GOMAXPROCS(numCPU)
 
-	var (
-		in  *os.File
-		err error
-	)
-	if len(flag.Args()) > 0 {
-		in, err = os.OpenFile(flag.Arg(0), os.O_RDONLY, 0666)
+	if detectOnly && len(flag.Args()) > 0 {
+		detect(flag.Args())
+		return
+	}
+
+	// a pipe is read when there is no input file
+	input := flag.Arg(0)
+	if input == "" {
+		if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice != 0 {
+			flag_usage()
+		}
+		input = stdio
+	}
+
+	fix.RecomputeFilament = recomputeFilament
+	fix.AllowJ1V0 = allowJ1V0
+	fix.LubanComments = luban
+	fix.SlicerComment = slicerComment
+	fix.BodyChecksum = checksum
+	fix.PlaceholderThumbnail = placeholder
+	if verbose {
+		fix.Logger = log.New(log.Writer(), "params: ", log.Flags())
+	}
+	if thumbnailSize != "" {
+		w, h, err := parseSize(thumbnailSize)
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatalf("Invalid thumbnail size %q: %s", thumbnailSize, err)
 		}
-		defer in.Close()
+		fix.ThumbnailWidth, fix.ThumbnailHeight = w, h
+	}
+	if allowJ1V0 {
+		log.Println("Warning: -allow-j1-v0 is set, the stock J1 firmware only accepts v1 files")
 	}
 
-	if in == nil {
-		flag_usage()
+	if forceModel != "" {
+		model, err := fix.ParseModel(forceModel)
+		if err != nil {
+			log.Fatalf("Invalid model: %s", err)
+		}
+		fix.ForceModel = model
+	}
+
+	switch gcodeVersion {
+	case -1, 0, 1:
+		fix.ForceVersion = gcodeVersion
+	default:
+		log.Fatalf("Invalid gcode version: %d, must be 0 or 1", gcodeVersion)
 	}
 
 	startCPUProfile()
@@ -57,39 +154,203 @@ func main() {
 		stopCPUProfile()
 	}()
 
-	// read gcodes form file
-	gcodes := []*fix.GcodeBlock{}
-	sc := bufio.NewScanner(in)
-	for sc.Scan() {
-		line := sc.Text()
+	if dryRun && (compareWith != "" || recountOnly || reheader) {
+		log.Fatalln("-dry-run does not write the output, it can not be used with -compare-with, -recount or -reheader")
+	}
+
+	if serial && (recountOnly || reheader) {
+		log.Fatalln("-recount and -reheader keep the body as it is, they can not be used with -serial")
+	}
+
+	if recountOnly && reheader {
+		log.Fatalln("-reheader recounts the lines, it can not be used with -recount")
+	}
 
-		if strings.HasPrefix(line, "; Postprocessed by smfix") {
-			log.Fatalln(fix.ErrIsFixed)
+	run := process
+	if recountOnly {
+		run = recount
+	} else if reheader {
+		run = regenerateHeader
+	} else if stream {
+		if explain || writeManifest {
+			log.Fatalln("-explain and -manifest need the file in memory, they can not be used with -stream")
 		}
+		run = processStream
+	}
+
+	output, err := stdioOutput(input, OutputPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	OutputPath = output
 
-		g, err := fix.ParseGcodeBlock(line)
-		if err == nil {
-			// ignore G4 S0
-			if g.Is("G4") {
-				var s int
-				if err := g.GetParam('S', &s); err == nil && s == 0 {
-					continue
-				}
+	if outDir != "" {
+		if info, err := os.Stat(input); err == nil && info.IsDir() {
+			processed, skipped, err := fix.MirrorTree(input, outDir, run)
+			log.Printf("%d processed, %d skipped", len(processed), len(skipped))
+			if err != nil {
+				log.Fatalln(err)
 			}
+			return
+		}
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			log.Fatalln(err)
+		}
+		OutputPath = filepath.Join(outDir, filepath.Base(input))
+	}
 
-			gcodes = append(gcodes, g)
-			continue
+	// the files of a directory are fixed in place in parallel
+	if info, err := os.Stat(input); input != stdio && err == nil && info.IsDir() {
+		if OutputPath != "" {
+			log.Fatalln("-o can not be a directory, use -out-dir to write the fixed files of a directory")
+		}
+		result, err := fix.ProcessDir(input, func(path string) error {
+			return run(path, path)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println(result)
+		if err := result.Err(); err != nil {
+			log.Fatalln(err)
 		}
-		if err != fix.ErrEmptyString {
-			log.Fatalf("Parse gcode error: %s", err)
+		return
+	}
+
+	// prepare for output file
+	if len(OutputPath) == 0 {
+		OutputPath = input
+	}
+	if err := run(input, OutputPath); err != nil {
+		log.Fatalln(err)
+	}
+	if compareWith != "" {
+		if err := compare(OutputPath, compareWith); err != nil {
+			log.Fatalln(err)
 		}
 	}
+}
+
+// compare reports the first difference of the output to the reference
+func compare(output, reference string) error {
+	got, err := os.ReadFile(output)
+	if err != nil {
+		return err
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		return err
+	}
+	if d := fix.Compare(got, want); d != nil {
+		return fmt.Errorf("output differs from %s, %s", reference, d)
+	}
+	log.Printf("output is identical to %s", reference)
+	return nil
+}
+
+// stdio is the path of stdin as the input and of stdout as the output
+const stdio = "-"
+
+// stdioOutput returns output, stdout when the input is stdin and -o is not
+// given. An error is returned for the options that need files.
+func stdioOutput(input, output string) (string, error) {
+	if input == stdio {
+		if outDir != "" {
+			return "", fmt.Errorf("-out-dir needs an input file, it can not be used with stdin")
+		}
+		if output == "" {
+			output = stdio
+		}
+	}
+	if output == stdio && (writeManifest || explain || compareWith != "") {
+		return "", fmt.Errorf("-manifest, -explain and -compare-with need an output file, they can not be used with stdout")
+	}
+	return output, nil
+}
+
+// readInput reads the whole input, stdin is read to its end
+func readInput(input string) ([]byte, error) {
+	if input == stdio {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(input)
+}
+
+func writeOutput(output string, data []byte) error {
+	if output == stdio {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+// openInput opens the input, stdin is not seekable and is read once
+func openInput(input string) (io.ReadCloser, error) {
+	if input == stdio {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(input)
+}
+
+// createOutput creates the output, stdout is closed once written
+func createOutput(output string) (*os.File, error) {
+	if output == stdio {
+		return os.Stdout, nil
+	}
+	return os.Create(output)
+}
+
+// recount updates the line count of a fixed file without fixing it again
+func recount(input, output string) error {
+	data, err := readInput(input)
+	if err != nil {
+		return err
+	}
+	if data, err = fix.Recount(data); err != nil {
+		return err
+	}
+	return writeOutput(output, data)
+}
+
+func regenerateHeader(input, output string) error {
+	data, err := readInput(input)
+	if err != nil {
+		return err
+	}
+	if data, err = fix.Reheader(data); err != nil {
+		return err
+	}
+	return writeOutput(output, data)
+}
+
+func process(input, output string) error {
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	// read gcodes form file, a gzip file is decompressed
+	r, err := fix.Decompress(in)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	gcodes, err := fix.ReadGcodes(r)
 	in.Close()
-	if err := sc.Err(); err != nil {
-		log.Fatalf("Read input file error: %s", err)
+	if err != nil {
+		return err
 	}
 
-	// fix gcodes
+	var original []string
+	if explain {
+		original = make([]string, len(gcodes))
+		for i, g := range gcodes {
+			original[i] = g.String()
+		}
+	}
+
+	// fix gcodes, the params of the input configure the modifiers, -verbose logs
+	// the params of the fixed file
+	params, paramsErr := fix.ParseSlicerParamsQuiet(gcodes)
 	funcs := make([]fix.GcodeModifier, 0, 6)
 	if !noTrim {
 		// funcs = append(funcs, fix.GcodeTrimLines)
@@ -103,43 +364,318 @@ func main() {
 	if !noReplaceTool {
 		funcs = append(funcs, fix.GcodeReplaceToolNum)
 	}
-	if !noReinforceTower {
-		funcs = append(funcs, fix.GcodeReinforceTower)
-	}
 	funcs = append(funcs, fix.GcodeFixOrcaToolUnload)
+	lines, err := lineModifiers(params, paramsErr)
+	if err != nil {
+		return err
+	}
+	for _, m := range lines {
+		funcs = append(funcs, m.Gcodes)
+	}
+	if progress {
+		if paramsErr != nil {
+			return fmt.Errorf("parse params failed: %w", paramsErr)
+		}
+		funcs = append(funcs, fix.GcodeProgress(params.TotalLayers, params.EstimatedTimeSec))
+	}
 
 	for _, fn := range funcs {
 		gcodes = fn(gcodes)
 	}
 
 	// extract headers
-	var headers [][]byte
-	if headers, err = fix.ExtractHeader(gcodes); err != nil {
-		log.Fatalf("Parse params failed: %s", err)
+	parsed, err := fix.NewParsedGcode(gcodes)
+	if err != nil {
+		return fmt.Errorf("parse params failed: %w", err)
+	}
+	warnings, err := validate(parsed.Params, parsed.Header)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return printDryRun(input, fix.NewDryRun(parsed.Params, parsed.Header, warnings))
 	}
 
-	// prepare for output file
-	if len(OutputPath) == 0 {
-		OutputPath = flag.Arg(0)
+	out, err := createOutput(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := outputWriter(out, output)
+	if err := parsed.Write(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if writeManifest {
+		if err := saveManifest(output, parsed, warnings); err != nil {
+			return fmt.Errorf("write manifest error: %w", err)
+		}
+	}
+	if explain {
+		fmt.Printf("%s:\n%s", output, fix.NewFixResult(original, parsed, warnings).Explain())
+	}
+	return nil
+}
+
+// outputWriter writes the output to out, an output ending in .gz is
+// compressed and -serial frames the lines
+func outputWriter(out io.Writer, output string) io.WriteCloser {
+	w := fix.Compress(out, output)
+	if serial {
+		return fix.NewSerialWriter(w)
+	}
+	return w
+}
+
+// validate checks the header of the output, the warnings are logged
+func validate(params *fix.SlicerParams, header [][]byte) ([]error, error) {
+	if err := fix.ValidateHeader(params.Version, header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if !noTempCheck {
+		if err := params.ValidateTemperatures(); err != nil {
+			return nil, err
+		}
+	}
+	if allowedMaterials != "" {
+		if err := params.ValidateMaterials(strings.Split(allowedMaterials, ",")); err != nil {
+			return nil, err
+		}
+	}
+	warnings := params.Validate()
+	for _, w := range warnings {
+		log.Printf("Warning: %s", w)
 	}
-	out, err := os.Create(OutputPath)
+	return warnings, nil
+}
+
+// processStream is process without keeping the file in memory. The fixes of
+// the tool changes that look at the whole file are refused, they are skipped
+// with -noshutoff and -nopreheat. The input is read before the output is
+// written, it may be the input.
+func processStream(input, output string) error {
+	in := os.Stdin
+	if input != stdio {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		in = f
+	} else if _, err := in.Seek(0, io.SeekCurrent); err != nil {
+		return fmt.Errorf("-stream reads the input twice, stdin is not seekable, it can be redirected from a file: %w", err)
+	}
+	defer in.Close()
+	if r, err := fix.Decompress(in); err != nil {
+		return err
+	} else if _, ok := r.(*gzip.Reader); ok {
+		return fmt.Errorf("-stream reads the input several times, it can not be compressed")
+	}
+
+	streamed, err := fix.NewStreamedGcode(in, func(params *fix.SlicerParams, paramsErr error) ([]fix.LineModifier, error) {
+		// shutoff and preheat look ahead of the tool changes
+		if params.ChangesTools() {
+			if !noShutoff || !noPreheat {
+				return nil, fmt.Errorf("-stream can not shut off or pre-heat the nozzles of a print that changes tools, -noshutoff and -nopreheat skip these fixes")
+			}
+			log.Printf("Warning: -stream skips the orca tool unload fix")
+		}
+		var lines []fix.LineModifier
+		if !noReplaceTool {
+			lines = append(lines, fix.LineReplaceToolNum())
+		}
+		fixes, err := lineModifiers(params, paramsErr)
+		if err != nil {
+			return nil, err
+		}
+		if lines = append(lines, fixes...); !progress || params.HasProgress {
+			return lines, nil
+		}
+		// the layers are not counted ahead, the slicer must report them
+		if paramsErr != nil {
+			return nil, fmt.Errorf("parse params failed: %w", paramsErr)
+		}
+		layerOf := params.ProgressLayers > 0
+		if params.TotalLayers <= 0 && !layerOf {
+			return nil, fmt.Errorf("-progress with -stream needs the layer count of the slicer")
+		}
+		return append(lines, fix.LineProgress(params.TotalLayers, params.EstimatedTimeSec, layerOf)), nil
+	})
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	defer streamed.Close()
+	in.Close()
+
+	warnings, err := validate(streamed.Params, streamed.Header)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return printDryRun(input, fix.NewDryRun(streamed.Params, streamed.Header, warnings))
+	}
+
+	out, err := createOutput(output)
+	if err != nil {
+		return err
 	}
 	defer out.Close()
 
-	bufWriter := bufio.NewWriterSize(out, 64*1024)
-	defer bufWriter.Flush()
+	w := outputWriter(out, output)
+	if err := streamed.Write(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
 
-	// write headers
-	if _, err := bufWriter.Write(bytes.Join(headers, []byte("\n"))); err != nil {
-		log.Fatalln(err)
+// printDryRun prints what the fix would write, the input is left untouched
+func printDryRun(input string, d *fix.DryRun) error {
+	d.File = input
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(d)
 	}
+	fmt.Printf("%s: %s", input, d)
+	return nil
+}
 
-	// write gcodes
-	for _, gcode := range gcodes {
-		if _, err := bufWriter.WriteString(gcode.String() + "\n"); err != nil {
-			log.Fatalln(err)
+// lineModifiers returns the fixes that modify one line at a time, configured
+// by the params of the input
+func lineModifiers(params *fix.SlicerParams, paramsErr error) ([]fix.LineModifier, error) {
+	lines := make([]fix.LineModifier, 0, 6)
+	if !noReinforceTower {
+		lines = append(lines, fix.LineReinforceTower())
+	}
+	if setOrigin != "" {
+		x, y, z, err := parseOrigin(setOrigin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin %q: %w", setOrigin, err)
+		}
+		if err = paramsErr; err == nil {
+			err = params.ValidateOrigin(x, y, z)
+		}
+		if err != nil {
+			log.Printf("Warning: origin is ignored: %s", err)
+		} else {
+			lines = append(lines, fix.LineSetOrigin(x, y, z))
+		}
+	}
+	if linearizeArcs {
+		if paramsErr != nil {
+			return nil, fmt.Errorf("parse params failed: %w", paramsErr)
+		}
+		tolerance := arcTolerance
+		if tolerance <= 0 {
+			tolerance = params.EffectiveArcTolerance()
+		} else if err := params.ValidateArcTolerance(tolerance); err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		lines = append(lines, fix.LineLinearizeArcs(tolerance))
+	}
+	if !noHeatGuard {
+		if paramsErr != nil {
+			return nil, fmt.Errorf("parse params failed: %w", paramsErr)
+		}
+		lines = append(lines, fix.LineEnsureHeat(params.NozzleTemperatures, log.Printf))
+	}
+	if setAcceleration {
+		if paramsErr != nil {
+			return nil, fmt.Errorf("parse params failed: %w", paramsErr)
+		}
+		lines = append(lines, fix.LineSetAcceleration(params.EffectiveAcceleration(), params.TravelAcceleration))
+	}
+	if clampZ {
+		if paramsErr != nil {
+			return nil, fmt.Errorf("parse params failed: %w", paramsErr)
+		}
+		maxZ := params.SafeMaxZ()
+		if maxZ <= 0 {
+			log.Printf("Warning: max print height of %q is unknown, Z is not clamped", params.Model)
+		}
+		lines = append(lines, fix.LineClampZ(maxZ, log.Printf))
+	}
+	return lines, nil
+}
+
+func parseOrigin(s string) (x, y, z float64, err error) {
+	v := strings.Split(s, ",")
+	if len(v) != 3 {
+		return 0, 0, 0, fmt.Errorf("want x,y,z")
+	}
+	var xyz [3]float64
+	for i := range v {
+		if xyz[i], err = strconv.ParseFloat(strings.TrimSpace(v[i]), 64); err != nil {
+			return
+		}
+	}
+	return xyz[0], xyz[1], xyz[2], nil
+}
+
+func parseSize(s string) (w, h int, err error) {
+	v := strings.Split(strings.ToLower(s), "x")
+	if len(v) != 2 {
+		return 0, 0, fmt.Errorf("want wxh")
+	}
+	if w, err = strconv.Atoi(strings.TrimSpace(v[0])); err != nil {
+		return
+	}
+	h, err = strconv.Atoi(strings.TrimSpace(v[1]))
+	return
+}
+
+// detect prints a report line per file, files that can not be read are reported and skipped
+func detect(paths []string) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, path := range paths {
+		d, err := func() (*fix.Detection, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r, err := fix.Decompress(f)
+			if err != nil {
+				return nil, err
+			}
+			return fix.Detect(r)
+		}()
+		if err != nil {
+			log.Printf("%s: %s", path, err)
+			continue
+		}
+		d.File = path
+		if jsonOutput {
+			enc.Encode(d)
+		} else {
+			fmt.Printf("%s: %s\n", path, d)
+		}
+	}
+}
+
+// saveManifest writes <output>.json, and <output>.png or .jpg when there is a thumbnail
+func saveManifest(output string, parsed *fix.ParsedGcode, warnings []error) error {
+	m := fix.NewManifest(parsed.Params, warnings)
+	if len(parsed.Params.Thumbnail) > 0 {
+		img, err := fix.ThumbnailImage(parsed.Params.Thumbnail)
+		if err != nil {
+			return err
 		}
+		m.Thumbnail = output + fix.ThumbnailExt(parsed.Params.Thumbnail)
+		if err := os.WriteFile(m.Thumbnail, img, 0644); err != nil {
+			return err
+		}
+	}
+	data, err := m.JSON()
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(output+".json", data, 0644)
 }